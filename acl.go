@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACLAction is what happens to the requests of a client
+type ACLAction int
+
+const (
+	ACLAllow  ACLAction = iota // the request is served
+	ACLRefuse                  // the request is answered with REFUSED
+	ACLDeny                    // the request is answered with REFUSED and the extended DNS error Prohibited
+	ACLDrop                    // the request is not answered
+)
+
+// parseACLAction parses an action: allow, refuse, deny or drop
+func parseACLAction(s string) (ACLAction, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return ACLAllow, nil
+	case "refuse":
+		return ACLRefuse, nil
+	case "deny":
+		return ACLDeny, nil
+	case "drop":
+		return ACLDrop, nil
+	}
+	return 0, fmt.Errorf("invalid acl action %q", s)
+}
+
+// aclRule applies an action to the clients in its networks
+type aclRule struct {
+	networks []*net.IPNet
+	action   ACLAction
+}
+
+// ACL decides the action for the requests of clients by the first rule matching their address
+type ACL struct {
+	rules         []aclRule
+	defaultAction ACLAction // action for clients not matching any rule
+}
+
+// add adds a rule after the existing ones
+func (a *ACL) add(networks []*net.IPNet, action ACLAction) {
+	a.rules = append(a.rules, aclRule{networks: networks, action: action})
+}
+
+// check returns the action for the client's requests
+func (a *ACL) check(client net.IP) ACLAction {
+	for _, rule := range a.rules {
+		if client != nil && containsIP(rule.networks, client) {
+			return rule.action
+		}
+	}
+	return a.defaultAction
+}
+
+// ACLs are the access control lists of each kind of request
+type ACLs struct {
+	recursion ACL // queries answered from upstream servers, hosts files and blocklists
+	zones     ACL // queries of the local zones
+	transfer  ACL // zone transfers
+	update    ACL // dynamic updates
+}
+
+// NewACLs creates new ACLs allowing all requests
+func NewACLs() *ACLs {
+	return &ACLs{}
+}
+
+// aclResponse returns the response of a request the action does not allow, nil when it is dropped.
+// Denied requests get no records but the OPT record of EDNS clients, explaining the refusal.
+func aclResponse(request *DnsPacket, packet *DnsPacket, action ACLAction, cookie []byte) *DnsPacket {
+	switch action {
+	case ACLDrop:
+		return nil
+	case ACLDeny:
+		packet.answers, packet.authorities, packet.resources = nil, nil, nil
+		if opt := request.edns(); opt != nil {
+			packet.resources = []DnsRecord{responseOpt(opt.dnssecOK(), cookie, []EdnsOption{newExtendedError(EDEProhibited, "")})}
+		}
+	}
+	packet.header.resCode = Refused
+	return packet
+}
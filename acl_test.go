@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACLs(t *testing.T) {
+	config := ACLConfig{
+		Recursion: []ACLRuleConfig{
+			{Networks: []string{"192.0.2.66"}, Action: "drop"},
+			{Networks: []string{"192.0.2.0/24", "2001:db8::/32"}, Action: "allow"},
+		},
+		Zones:    []ACLRuleConfig{{Networks: []string{"198.51.100.0/24"}, Action: "refuse"}},
+		Transfer: []ACLRuleConfig{{Networks: []string{"0.0.0.0/0"}, Action: "deny"}},
+	}
+	acls, err := config.newACLs()
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name   string
+		acl    *ACL
+		client string
+		action ACLAction
+	}{
+		{name: "first match", acl: &acls.recursion, client: "192.0.2.66", action: ACLDrop},
+		{name: "allowed network", acl: &acls.recursion, client: "192.0.2.1", action: ACLAllow},
+		{name: "allowed ipv6 network", acl: &acls.recursion, client: "2001:db8::1", action: ACLAllow},
+		{name: "recursion refused by default", acl: &acls.recursion, client: "203.0.113.1", action: ACLRefuse},
+		{name: "refused zone queries", acl: &acls.zones, client: "198.51.100.7", action: ACLRefuse},
+		{name: "zone queries allowed by default", acl: &acls.zones, client: "203.0.113.1", action: ACLAllow},
+		{name: "denied transfers", acl: &acls.transfer, client: "127.0.0.1", action: ACLDeny},
+		{name: "updates allowed by default", acl: &acls.update, client: "203.0.113.1", action: ACLAllow},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.action, tc.acl.check(net.ParseIP(tc.client)))
+		})
+	}
+
+	for _, invalid := range []ACLConfig{
+		{Zones: []ACLRuleConfig{{Networks: []string{"192.0.2.0/24"}, Action: "reject"}}},
+		{Update: []ACLRuleConfig{{Networks: []string{"192.0.2.0/33"}, Action: "allow"}}},
+	} {
+		_, err := invalid.newACLs()
+		assert.Error(t, err)
+	}
+}
+
+func TestACLResponse(t *testing.T) {
+	zone, err := NewZone("example.com", []DnsRecord{
+		{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 1, minimum: 300},
+		{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	savedZones, savedACLs := zones, acls
+	zones = NewZones()
+	zones.add(zone)
+	acls, err = (&ACLConfig{Zones: []ACLRuleConfig{
+		{Networks: []string{"198.51.100.0/24"}, Action: "refuse"},
+		{Networks: []string{"203.0.113.0/24"}, Action: "deny"},
+		{Networks: []string{"192.0.2.128/25"}, Action: "drop"},
+	}}).newACLs()
+	require.NoError(t, err)
+	t.Cleanup(func() { zones, acls = savedZones, savedACLs })
+
+	testcases := []struct {
+		name     string
+		client   string
+		resCode  ResultCode
+		answers  int
+		ede      []ExtendedErrorCode
+		response bool
+	}{
+		{name: "allow", client: "192.0.2.10", resCode: NoError, answers: 1, response: true},
+		{name: "refuse", client: "198.51.100.10", resCode: Refused, response: true},
+		{name: "deny", client: "203.0.113.10", resCode: Refused, ede: []ExtendedErrorCode{EDEProhibited}, response: true},
+		{name: "drop", client: "192.0.2.200"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := NewDnsPacket()
+			request.header.id = 7
+			request.questions = []DnsQuestion{{name: "www.example.com", qtype: A}}
+			request.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, false)}
+
+			response, err := buildResponse(request, net.ParseIP(tc.client), false)
+			require.NoError(t, err)
+			if !tc.response {
+				assert.Nil(t, response)
+				return
+			}
+			require.NotNil(t, response)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+			assert.Len(t, response.answers, tc.answers)
+			var codes []ExtendedErrorCode
+			for _, option := range extendedErrors(response) {
+				codes = append(codes, ExtendedErrorCode(binary.BigEndian.Uint16(option.data)))
+			}
+			assert.Equal(t, tc.ede, codes)
+		})
+	}
+}
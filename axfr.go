@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"time"
+)
+
+// Time allowed for writing each message of a zone transfer
+const TRANSFER_WRITE_TIMEOUT = 30 * time.Second
+
+// transferZone answers an AXFR request, streaming the zone as a sequence of messages
+func transferZone(conn net.Conn, request *DnsPacket) error {
+	question := request.questions[0]
+	header := DnsHeader{id: request.header.id, response: true, authoritativeAnswer: true}
+
+	if action := acls.transfer.check(clientIP(conn.RemoteAddr())); action != ACLAllow {
+		packet := NewDnsPacket()
+		packet.header = header
+		packet.header.authoritativeAnswer = false
+		packet.questions = []DnsQuestion{question}
+		response := aclResponse(request, packet, action, nil)
+		if response == nil {
+			return nil
+		}
+		data, err := writeResponse(response, MAX_MESSAGE_SIZE)
+		if err != nil {
+			return err
+		}
+		return writeMessage(conn, data)
+	}
+
+	if resCode := verifyRequest(request); resCode != NoError {
+		header.authoritativeAnswer = false
+		header.resCode = resCode
+		return writeTransferError(conn, header, question, request.tsig)
+	}
+	zone := zones.get(question.name)
+	if zone == nil {
+		header.authoritativeAnswer = false
+		header.resCode = NotAuth
+		return writeTransferError(conn, header, question, request.tsig)
+	}
+	if client := clientIP(conn.RemoteAddr()); !zone.transferAllowed(client, request.tsigKeyName()) {
+		log.Printf("zone transfer of %s refused for %s\n", fqdn(zone.origin), client)
+		header.resCode = Refused
+		return writeTransferError(conn, header, question, request.tsig)
+	}
+
+	records, err := zone.transferRecords()
+	if err != nil {
+		log.Printf("error transferring zone %s: %v\n", fqdn(zone.origin), err)
+		header.resCode = Servfail
+		return writeTransferError(conn, header, question, request.tsig)
+	}
+	messages, err := transferMessages(header, question, records, request.tsig)
+	if err != nil {
+		return err
+	}
+	for _, data := range messages {
+		conn.SetWriteDeadline(time.Now().Add(TRANSFER_WRITE_TIMEOUT))
+		if err := writeMessage(conn, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTransferError sends the single message failing a zone transfer
+func writeTransferError(conn net.Conn, header DnsHeader, question DnsQuestion, tsig *TsigSession) error {
+	packet := NewDnsPacket()
+	packet.header = header
+	packet.questions = []DnsQuestion{question}
+	packet.tsig = tsig
+	data, err := writeResponse(packet, MAX_MESSAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	return writeMessage(conn, data)
+}
+
+// transferAllowed reports whether the client, or the holder of the key the request was signed with, may transfer the zone
+func (z *Zone) transferAllowed(client net.IP, key string) bool {
+	return keyAllowed(z.transferKeys, key) || (client != nil && containsIP(z.allowTransfer, client))
+}
+
+// transferRecords returns the records of the zone in AXFR order, starting and ending with the SOA record.
+// Signed zones include their signatures and NSEC or NSEC3 chain.
+func (z *Zone) transferRecords() ([]DnsRecord, error) {
+	names := make([]string, 0, len(z.names))
+	for name := range z.names {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return compareNames(names[i], names[j]) < 0
+	})
+
+	soa := *z.soa()
+	records := []DnsRecord{soa}
+	for _, name := range names {
+		var authoritative []DnsRecord
+		for _, r := range z.names[name] {
+			if r.qType != SOA {
+				records = append(records, r)
+			}
+			// delegation NS records and glue are not signed
+			if !z.delegated(name) || r.qType == DS {
+				authoritative = append(authoritative, r)
+			}
+		}
+		if z.signer != nil {
+			signed, err := z.signer.signRecords(authoritative)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, signed[len(authoritative):]...)
+		}
+	}
+	if z.signer != nil {
+		chain, err := z.signer.signRecords(z.chain)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, chain...)
+	}
+	return append(records, soa), nil
+}
+
+// transferMessages packs the records of a zone transfer into as many messages as needed,
+// each of them holding as many records as fit into the largest message size.
+// The question is only repeated in the first message. With a TSIG session every message is signed.
+func transferMessages(header DnsHeader, question DnsQuestion, records []DnsRecord, tsig *TsigSession) ([][]byte, error) {
+	limit := uint(MAX_MESSAGE_SIZE)
+	if tsig != nil {
+		limit -= uint(tsig.size())
+	}
+
+	var messages [][]byte
+	for first := true; len(records) > 0; first = false {
+		buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+		h := header
+		if first {
+			h.questions = 1
+		}
+		if err := h.write(buf); err != nil {
+			return nil, err
+		}
+		if first {
+			if err := question.write(buf); err != nil {
+				return nil, err
+			}
+		}
+
+		n := 0
+		for ; n < len(records); n++ {
+			pos := buf.position()
+			if err := records[n].write(buf); err != nil || buf.position() > limit {
+				buf.seek(pos)
+				break
+			}
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("record %s does not fit into a message", records[0])
+		}
+
+		// the answer count follows the id, flags and question count
+		if err := buf.set2Byte(6, uint16(n)); err != nil {
+			return nil, err
+		}
+		if tsig != nil {
+			if err := tsig.sign(buf); err != nil {
+				return nil, err
+			}
+		}
+		data, err := buf.getRange(0, buf.position())
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, data)
+		records = records[n:]
+	}
+	return messages, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTCPServer serves the tcp path on a local port and returns its address
+func startTCPServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go serveTCP(listener)
+	return listener.Addr().String()
+}
+
+// sendTCPQuery sends a query over the tcp connection
+func sendTCPQuery(t *testing.T, conn net.Conn, id uint16, question DnsQuestion) {
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{id: id}
+	packet.questions = []DnsQuestion{question}
+	buf := NewBytePacketBuffer()
+	require.NoError(t, packet.write(buf))
+	require.NoError(t, writeMessage(conn, buf.buf[:buf.position()]))
+}
+
+// readTCPResponse reads the next message from the tcp connection
+func readTCPResponse(t *testing.T, conn net.Conn) *DnsPacket {
+	buf, err := readMessage(conn)
+	require.NoError(t, err)
+	packet := NewDnsPacket()
+	require.NoError(t, packet.fromBuffer(buf))
+	return packet
+}
+
+func TestZoneTransfer(t *testing.T) {
+	records := []DnsRecord{
+		{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 1, refresh: 3600, retry: 600, expire: 86400, minimum: 300},
+		{domain: "example.com", qType: NS, ttl: 3600, host: "ns1.example.com"},
+	}
+	// enough records to need more than one message
+	for i := 0; i < 5000; i++ {
+		records = append(records, DnsRecord{domain: fmt.Sprintf("host%d.example.com", i), qType: A, ttl: 3600, addr: fmt.Sprintf("10.0.%d.%d", i>>8, i&0xff)})
+	}
+	zone, err := NewZone("example.com", records)
+	require.NoError(t, err)
+	zone.allowTransfer, err = parseNetworks([]string{"127.0.0.1"})
+	require.NoError(t, err)
+	denied, err := NewZone("denied.com", []DnsRecord{{domain: "denied.com", qType: SOA, ttl: 3600, host: "ns1.denied.com", mailbox: "admin.denied.com", serial: 1, minimum: 300}})
+	require.NoError(t, err)
+
+	saved := zones
+	zones = NewZones()
+	zones.add(zone)
+	zones.add(denied)
+	t.Cleanup(func() { zones = saved })
+
+	conn, err := net.Dial("tcp", startTCPServer(t))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	t.Run("transfer", func(t *testing.T) {
+		sendTCPQuery(t, conn, 1, DnsQuestion{name: "example.com", qtype: AXFR})
+		var transferred []DnsRecord
+		messages := 0
+		for len(transferred) < 2 || transferred[len(transferred)-1].qType != SOA {
+			packet := readTCPResponse(t, conn)
+			require.Equal(t, NoError, packet.header.resCode)
+			assert.Equal(t, uint16(1), packet.header.id)
+			assert.True(t, packet.header.authoritativeAnswer)
+			if messages == 0 {
+				assert.Len(t, packet.questions, 1)
+			} else {
+				assert.Empty(t, packet.questions)
+			}
+			transferred = append(transferred, packet.answers...)
+			messages++
+		}
+
+		assert.Greater(t, messages, 1)
+		assert.Len(t, transferred, len(records)+1)
+		assert.Equal(t, SOA, transferred[0].qType)
+		assert.Equal(t, transferred[0], transferred[len(transferred)-1])
+	})
+
+	t.Run("query on the same connection", func(t *testing.T) {
+		sendTCPQuery(t, conn, 2, DnsQuestion{name: "host42.example.com", qtype: A})
+		packet := readTCPResponse(t, conn)
+		assert.Equal(t, NoError, packet.header.resCode)
+		require.Len(t, packet.answers, 1)
+		assert.Equal(t, "10.0.0.42", packet.answers[0].addr)
+	})
+
+	testcases := []struct {
+		name    string
+		zone    string
+		resCode ResultCode
+	}{
+		{name: "not allowed", zone: "denied.com", resCode: Refused},
+		{name: "unknown zone", zone: "unknown.com", resCode: NotAuth},
+		{name: "not the apex", zone: "host1.example.com", resCode: NotAuth},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			sendTCPQuery(t, conn, 3, DnsQuestion{name: tc.zone, qtype: AXFR})
+			packet := readTCPResponse(t, conn)
+			assert.Equal(t, tc.resCode, packet.header.resCode)
+			assert.Empty(t, packet.answers)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+// Time to live of the answers to blocked names
+const BLOCK_TTL = 60
+
+// BlockMode selects the answer to questions for blocked names
+type BlockMode int
+
+const (
+	BlockNxDomain BlockMode = iota // the name does not exist
+	BlockNull                      // the unspecified address 0.0.0.0 or ::
+	BlockRefused                   // the query is refused
+	BlockIP                        // a configured address
+)
+
+// names of hosts file entries that are not blocked, blocklists in hosts format often start with them
+var localHostNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true, "broadcasthost": true,
+	"ip6-localhost": true, "ip6-loopback": true, "ip6-localnet": true, "ip6-mcastprefix": true,
+	"ip6-allnodes": true, "ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// DomainTrie is a set of domains matching their subdomains too, stored as a trie of labels from the root
+type DomainTrie struct {
+	children map[string]*DomainTrie
+	terminal bool
+}
+
+// NewDomainTrie creates a new empty DomainTrie
+func NewDomainTrie() *DomainTrie {
+	return &DomainTrie{children: map[string]*DomainTrie{}}
+}
+
+// add adds the domain to the set
+func (t *DomainTrie) add(name string) {
+	node := t
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = NewDomainTrie()
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// match reports whether the name or one of its ancestors is in the set
+func (t *DomainTrie) match(name string) bool {
+	node := t
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
+
+// Blocklist answers questions for blocked domains and their subdomains, unless they are allowed
+type Blocklist struct {
+	blocked *DomainTrie
+	allowed *DomainTrie
+	mode    BlockMode
+	ip      net.IP // address answered in BlockIP mode
+}
+
+// NewBlocklist creates a new empty Blocklist
+func NewBlocklist() *Blocklist {
+	return &Blocklist{blocked: NewDomainTrie(), allowed: NewDomainTrie()}
+}
+
+// load adds the domains of the list file at path, to the allowed domains with allow set
+func (b *Blocklist) load(path string, allow bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	list := b.blocked
+	if allow {
+		list = b.allowed
+	}
+	if err := parseBlocklist(f, list, b.allowed); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// parseBlocklist reads domains in hosts, domains-only or Adblock format into list.
+// Adblock exception rules (@@||domain^) are added to exceptions, rules with options are ignored.
+func parseBlocklist(r io.Reader, list *DomainTrie, exceptions *DomainTrie) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue // Adblock comments and header
+		}
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(fields[0], "||") || strings.HasPrefix(fields[0], "@@||"):
+			rule := fields[0]
+			target := list
+			if strings.HasPrefix(rule, "@@") {
+				rule = rule[2:]
+				target = exceptions
+			}
+			name, ok := strings.CutSuffix(rule[2:], "^")
+			if ok && validBlockedName(name) {
+				target.add(name)
+			}
+		case net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				if !localHostNames[strings.ToLower(name)] && validBlockedName(name) {
+					list.add(name)
+				}
+			}
+		case len(fields) == 1 && validBlockedName(fields[0]):
+			list.add(fields[0])
+		}
+	}
+	return scanner.Err()
+}
+
+// validBlockedName reports whether the name can be a list entry, which excludes the root and patterns
+func validBlockedName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	return name != "" && !strings.ContainsAny(name, "*/|^$:@ ")
+}
+
+// parseBlockMode parses a block response: nxdomain, null, refused or an ip address
+func parseBlockMode(s string) (BlockMode, net.IP, error) {
+	switch strings.ToLower(s) {
+	case "", "nxdomain":
+		return BlockNxDomain, nil, nil
+	case "null":
+		return BlockNull, nil, nil
+	case "refused":
+		return BlockRefused, nil, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return 0, nil, fmt.Errorf("invalid block response %q", s)
+	}
+	return BlockIP, ip, nil
+}
+
+// blocks reports whether questions for the name are blocked
+func (b *Blocklist) blocks(name string) bool {
+	return b.blocked.match(name) && !b.allowed.match(name)
+}
+
+// answer returns the answer to a question for a blocked name, or nil when the name is not blocked.
+// Addresses are only answered to questions of their type, other questions get an answer without records.
+func (b *Blocklist) answer(name string, qtype QueryType) *DnsPacket {
+	if !b.blocks(name) {
+		return nil
+	}
+
+	packet := NewDnsPacket()
+	var ip net.IP
+	switch b.mode {
+	case BlockNxDomain:
+		packet.header.resCode = NxDomain
+	case BlockRefused:
+		packet.header.resCode = Refused
+	case BlockNull:
+		ip = net.IPv4zero
+		if qtype == AAAA {
+			ip = net.IPv6zero
+		}
+	case BlockIP:
+		ip = b.ip
+	}
+
+	if ip4 := ip.To4(); ip4 != nil && qtype == A {
+		packet.answers = append(packet.answers, DnsRecord{qType: A, domain: name, ttl: BLOCK_TTL, addr: ip4.String()})
+	} else if ip != nil && ip4 == nil && qtype == AAAA {
+		packet.answers = append(packet.answers, DnsRecord{qType: AAAA, domain: name, ttl: BLOCK_TTL, addr: ip.String()})
+	}
+	return packet
+}
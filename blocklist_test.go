@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	hostsList := filepath.Join(dir, "hosts.txt")
+	require.NoError(t, os.WriteFile(hostsList, []byte(`# hosts format
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.net
+`), 0644))
+	domainsList := filepath.Join(dir, "domains.txt")
+	require.NoError(t, os.WriteFile(domainsList, []byte("malware.test\n# comment\n"), 0644))
+	adblockList := filepath.Join(dir, "adblock.txt")
+	require.NoError(t, os.WriteFile(adblockList, []byte(`[Adblock Plus 2.0]
+! comment
+||doubleclick.test^
+||options.test^$third-party
+@@||good.doubleclick.test^
+`), 0644))
+	allowList := filepath.Join(dir, "allow.txt")
+	require.NoError(t, os.WriteFile(allowList, []byte("cdn.malware.test\n"), 0644))
+
+	blocklist, err := (&BlockingConfig{
+		Blocklists: []string{hostsList, domainsList, adblockList},
+		Allowlists: []string{allowList},
+	}).newBlocklist()
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name    string
+		blocked bool
+	}{
+		{name: "ads.example.com", blocked: true},
+		{name: "ADS.example.com.", blocked: true},
+		{name: "x.ads.example.com", blocked: true},
+		{name: "example.com", blocked: false},
+		{name: "localhost", blocked: false},
+		{name: "malware.test", blocked: true},
+		{name: "www.doubleclick.test", blocked: true},
+		{name: "good.doubleclick.test", blocked: false},
+		{name: "options.test", blocked: false},
+		{name: "cdn.malware.test", blocked: false},
+		{name: "a.cdn.malware.test", blocked: false},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.blocked, blocklist.blocks(tc.name))
+		})
+	}
+
+	responses := []struct {
+		response string
+		qtype    QueryType
+		resCode  ResultCode
+		addrs    []string
+	}{
+		{response: "", qtype: A, resCode: NxDomain},
+		{response: "refused", qtype: A, resCode: Refused},
+		{response: "null", qtype: A, addrs: []string{"0.0.0.0"}},
+		{response: "null", qtype: AAAA, addrs: []string{"::"}},
+		{response: "null", qtype: MX},
+		{response: "192.0.2.1", qtype: A, addrs: []string{"192.0.2.1"}},
+		{response: "192.0.2.1", qtype: AAAA},
+		{response: "2001:db8::1", qtype: AAAA, addrs: []string{"2001:db8::1"}},
+	}
+	for _, tc := range responses {
+		t.Run(tc.response+" "+tc.qtype.String(), func(t *testing.T) {
+			var err error
+			blocklist.mode, blocklist.ip, err = parseBlockMode(tc.response)
+			require.NoError(t, err)
+
+			assert.Nil(t, blocklist.answer("example.com", tc.qtype))
+			response := blocklist.answer("ads.example.com", tc.qtype)
+			require.NotNil(t, response)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+			var addrs []string
+			for _, r := range response.answers {
+				assert.Equal(t, tc.qtype, r.qType)
+				addrs = append(addrs, net.ParseIP(r.addr).String())
+			}
+			assert.Equal(t, tc.addrs, addrs)
+		})
+	}
+
+	_, _, err = parseBlockMode("sinkhole")
+	assert.Error(t, err)
+}
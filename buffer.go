@@ -7,6 +7,9 @@ import (
 
 const MAX_PACKET_SIZE = 512
 
+// Maximum size of a message, as limited by the 16 bit length prefix of tcp messages
+const MAX_MESSAGE_SIZE = 65535
+
 type BytePacketBuffer struct {
 	buf []uint8
 	pos uint
@@ -14,7 +17,12 @@ type BytePacketBuffer struct {
 
 // New creates a new BytePacketBuffer
 func NewBytePacketBuffer() *BytePacketBuffer {
-	b := make([]uint8, MAX_PACKET_SIZE)
+	return NewBytePacketBufferSize(MAX_PACKET_SIZE)
+}
+
+// NewBytePacketBufferSize creates a new BytePacketBuffer holding up to size bytes
+func NewBytePacketBufferSize(size int) *BytePacketBuffer {
+	b := make([]uint8, size)
 	return &BytePacketBuffer{buf: b}
 }
 
@@ -30,7 +38,7 @@ func (b *BytePacketBuffer) seek(position uint) {
 
 // read reads a byte from the buffer and returns it
 func (b *BytePacketBuffer) read() (uint8, error) {
-	if b.pos >= MAX_PACKET_SIZE {
+	if b.pos >= uint(len(b.buf)) {
 		return 0, errors.New("end of buffer")
 	}
 	res := b.buf[b.pos]
@@ -65,19 +73,30 @@ func (b *BytePacketBuffer) read4Byte() (uint32, error) {
 }
 
 func (b *BytePacketBuffer) get(position uint) (uint8, error) {
-	if position >= MAX_PACKET_SIZE {
+	if position >= uint(len(b.buf)) {
 		return 0, errors.New("end of buffer")
 	}
 	return b.buf[position], nil
 }
 
 func (b *BytePacketBuffer) getRange(start uint, len uint) ([]uint8, error) {
-	if start+len >= MAX_PACKET_SIZE {
+	if start+len > uint(cap(b.buf)) {
 		return nil, errors.New("end of buffer")
 	}
 	return b.buf[start : start+len], nil
 }
 
+// readRange reads n bytes from the buffer, stepping n steps forward
+func (b *BytePacketBuffer) readRange(n uint) ([]uint8, error) {
+	if b.pos+n > uint(len(b.buf)) {
+		return nil, errors.New("end of buffer")
+	}
+	res := make([]uint8, n)
+	copy(res, b.buf[b.pos:b.pos+n])
+	b.pos += n
+	return res, nil
+}
+
 // Read a qname
 // The tricky part: Reading domain names, taking labels into consideration.
 // Will take something like [3]www[6]google[3]com[0] and append www.google.com to outstr.
@@ -141,7 +160,7 @@ func (b *BytePacketBuffer) readQName() (string, error) {
 
 // write writes a byte to the buffer
 func (b *BytePacketBuffer) write(val uint8) error {
-	if b.pos >= MAX_PACKET_SIZE {
+	if b.pos >= uint(len(b.buf)) {
 		return errors.New("end of buffer")
 	}
 	b.buf[b.pos] = val
@@ -165,20 +184,43 @@ func (b *BytePacketBuffer) write4Byte(val uint32) error {
 	return b.write2Byte(uint16(val))
 }
 
+// writeRange writes a slice of bytes to the buffer
+func (b *BytePacketBuffer) writeRange(data []uint8) error {
+	for _, v := range data {
+		if err := b.write(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// set2Byte overwrites two bytes at the specified position without moving the position
+func (b *BytePacketBuffer) set2Byte(position uint, val uint16) error {
+	if position+1 >= uint(len(b.buf)) {
+		return errors.New("end of buffer")
+	}
+	b.buf[position] = uint8(val >> 8)
+	b.buf[position+1] = uint8(val)
+	return nil
+}
+
 func (b *BytePacketBuffer) writeQName(qname string) error {
 	labels := strings.Split(qname, ".")
 	for _, label := range labels {
-		len := uint8(len(label))
-		if len > 0x34 {
+		if len(label) == 0 {
+			// the root name has no labels
+			continue
+		}
+		if len(label) > 0x3f {
 			return errors.New("label too long")
 		}
-
-		b.write(len)
-		for _, c := range []byte(label) {
-			b.write(uint8(c))
+		if err := b.write(uint8(len(label))); err != nil {
+			return err
+		}
+		if err := b.writeRange([]byte(label)); err != nil {
+			return err
 		}
 	}
 
-	b.write(0)
-	return nil
+	return b.write(0)
 }
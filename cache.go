@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the answer cache, the stale ones as recommended by RFC 8767
+const (
+	CACHE_DEFAULT_SIZE           = 10000
+	CACHE_DEFAULT_STALE_WINDOW   = 24 * time.Hour
+	CACHE_DEFAULT_STALE_TTL      = 30 * time.Second
+	CACHE_DEFAULT_CLIENT_TIMEOUT = 1800 * time.Millisecond
+)
+
+// Defaults of prefetching: entries asked for at least 3 times are refreshed in the last 10% of their TTL
+const (
+	CACHE_DEFAULT_PREFETCH_PERCENT = 10
+	CACHE_DEFAULT_PREFETCH_HITS    = 3
+)
+
+// Period of the snapshots of the cache written to its file
+const CACHE_DEFAULT_SNAPSHOT_INTERVAL = 5 * time.Minute
+
+// Time during which a failed refresh is not retried and the stale answer is served right away
+const CACHE_FAILURE_RECHECK = 30 * time.Second
+
+// cacheKey identifies the cached answers of a question
+type cacheKey struct {
+	name   string // lower case
+	qtype  QueryType
+	dnssec bool // looked up with the DNSSEC records
+}
+
+// cacheEntry is a cached answer
+type cacheEntry struct {
+	packet  *DnsPacket
+	stored  time.Time
+	expires time.Time
+	failed  time.Time // time of the last failed refresh
+
+	hits        int  // times the answer has been served
+	prefetching bool // a refresh is under way
+}
+
+// Cache keeps the answers of upstream servers for their TTL, and expired ones for the stale window
+// to serve them when the upstream servers fail (RFC 8767)
+type Cache struct {
+	size          int           // maximum number of entries
+	staleWindow   time.Duration // how long expired answers are kept
+	staleTTL      time.Duration // TTL of the records of expired answers
+	clientTimeout time.Duration // time the upstream servers have before an expired answer is served
+
+	prefetchPercent int // popular entries are refreshed in this last percentage of their TTL, never when zero
+	prefetchHits    int // hits making an entry popular
+
+	file             string // file the cache is saved to and loaded from, none when empty
+	snapshotInterval time.Duration
+
+	// query looks up the answers upstream
+	query func(domain string, qtype QueryType, dnssec bool) (*DnsPacket, error)
+
+	mu      sync.Mutex
+	entries map[cacheKey]*cacheEntry
+
+	refreshes sync.WaitGroup // background refreshes under way
+	stopped   bool           // set under mu once no refreshes are started anymore
+}
+
+// NewCache creates a new empty Cache of the answers of lookup
+func NewCache() *Cache {
+	return &Cache{
+		size:          CACHE_DEFAULT_SIZE,
+		staleWindow:   CACHE_DEFAULT_STALE_WINDOW,
+		staleTTL:      CACHE_DEFAULT_STALE_TTL,
+		clientTimeout: CACHE_DEFAULT_CLIENT_TIMEOUT,
+
+		prefetchPercent: CACHE_DEFAULT_PREFETCH_PERCENT,
+		prefetchHits:    CACHE_DEFAULT_PREFETCH_HITS,
+
+		snapshotInterval: CACHE_DEFAULT_SNAPSHOT_INTERVAL,
+
+		query:   lookup,
+		entries: map[cacheKey]*cacheEntry{},
+	}
+}
+
+// cacheTTL returns how long the answer may be cached: the lowest TTL of its answers, or of the SOA record
+// of negative answers (RFC 2308). Failures and negative answers without a SOA record are not cached.
+func cacheTTL(packet *DnsPacket) time.Duration {
+	if packet.header.resCode != NoError && packet.header.resCode != NxDomain {
+		return 0
+	}
+	if packet.header.resCode == NoError && len(packet.answers) > 0 {
+		ttl := packet.answers[0].ttl
+		for _, r := range packet.answers {
+			ttl = min(ttl, r.ttl)
+		}
+		return time.Duration(ttl) * time.Second
+	}
+	for _, r := range packet.authorities {
+		if r.qType == SOA {
+			return time.Duration(min(r.ttl, r.minimum)) * time.Second
+		}
+	}
+	return 0
+}
+
+// agedRecords returns a copy of the records with their TTLs counted down by the age, or set to ttl when stale
+func agedRecords(records []DnsRecord, age time.Duration, stale bool, ttl time.Duration) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range records {
+		switch {
+		case r.qType == OPT:
+		case stale:
+			r.ttl = uint32(ttl.Seconds())
+		default:
+			r.ttl -= min(r.ttl, uint32(age.Seconds()))
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// answer returns a copy of the cached answer with the TTLs of its age
+func (e *cacheEntry) answer(now time.Time, stale bool, staleTTL time.Duration) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header = e.packet.header
+	age := now.Sub(e.stored)
+	packet.questions = append(packet.questions, e.packet.questions...)
+	packet.answers = agedRecords(e.packet.answers, age, stale, staleTTL)
+	packet.authorities = agedRecords(e.packet.authorities, age, stale, staleTTL)
+	packet.resources = agedRecords(e.packet.resources, age, stale, staleTTL)
+	return packet
+}
+
+// get returns the cached answer and whether it has expired, nil when there is none.
+// prefetch is set when the answer is popular and about to expire, for the caller to refresh it.
+func (c *Cache) get(key cacheKey, now time.Time) (packet *DnsPacket, stale bool, prefetch bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	if entry == nil {
+		return nil, false, false
+	}
+	if now.After(entry.expires.Add(c.staleWindow)) {
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	stale = !now.Before(entry.expires)
+	entry.hits++
+	if !stale && !entry.prefetching && c.prefetchPercent > 0 && entry.hits >= c.prefetchHits &&
+		entry.expires.Sub(now)*100 <= entry.expires.Sub(entry.stored)*time.Duration(c.prefetchPercent) {
+		entry.prefetching = true
+		prefetch = true
+	}
+	return entry.answer(now, stale, c.staleTTL), stale, prefetch
+}
+
+// put caches a copy of the answer, evicting entries when the cache is full
+func (c *Cache) put(key cacheKey, packet *DnsPacket, now time.Time) {
+	ttl := cacheTTL(packet)
+	if ttl <= 0 {
+		return
+	}
+	entry := &cacheEntry{stored: now, expires: now.Add(ttl)}
+	entry.packet = (&cacheEntry{packet: packet, stored: now}).answer(now, false, 0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+}
+
+// evict removes the entries past their stale window, or an arbitrary entry when there are none
+func (c *Cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if now.After(entry.expires.Add(c.staleWindow)) {
+			delete(c.entries, key)
+		}
+	}
+	if len(c.entries) < c.size {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+// fail records a failed refresh of the entry
+func (c *Cache) fail(key cacheKey, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.entries[key]; entry != nil {
+		entry.failed = now
+		entry.prefetching = false
+	}
+}
+
+// refresh looks up the question upstream and caches the answer
+func (c *Cache) refresh(key cacheKey, name string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+	packet, err := c.query(name, qtype, dnssec)
+	if err == nil && packet.header.resCode != Servfail {
+		c.put(key, packet, time.Now())
+	} else {
+		c.fail(key, time.Now())
+	}
+	return packet, err
+}
+
+// recentlyFailed reports whether refreshing the entry failed within the failure recheck time
+func (c *Cache) recentlyFailed(key cacheKey, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry := c.entries[key]
+	return entry != nil && now.Sub(entry.failed) < CACHE_FAILURE_RECHECK
+}
+
+// resolve answers the question from the cache or from the upstream servers, reporting whether the
+// answer is stale. Expired answers are served when the upstream servers fail or take longer than the
+// client timeout, in which case the lookup continues in the background to refresh the cache.
+// Popular answers are refreshed in the background before they expire.
+func (c *Cache) resolve(name string, qtype QueryType, dnssec bool) (*DnsPacket, bool, error) {
+	key := cacheKey{name: strings.ToLower(name), qtype: qtype, dnssec: dnssec}
+	cached, stale, prefetch := c.get(key, time.Now())
+	if prefetch && c.startRefresh() {
+		go func() {
+			defer c.refreshes.Done()
+			c.refresh(key, name, qtype, dnssec)
+		}()
+	}
+	if cached != nil && (!stale || c.recentlyFailed(key, time.Now())) {
+		return cached, stale, nil
+	}
+
+	type result struct {
+		packet *DnsPacket
+		err    error
+	}
+	if !c.startRefresh() {
+		// the stopped cache is no longer updated
+		if cached != nil {
+			return cached, stale, nil
+		}
+		packet, err := c.query(name, qtype, dnssec)
+		return packet, false, err
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer c.refreshes.Done()
+		packet, err := c.refresh(key, name, qtype, dnssec)
+		done <- result{packet, err}
+	}()
+
+	if cached == nil {
+		r := <-done
+		return r.packet, false, r.err
+	}
+	select {
+	case r := <-done:
+		if r.err == nil && r.packet.header.resCode != Servfail {
+			return r.packet, false, nil
+		}
+	case <-time.After(c.clientTimeout):
+	}
+	return cached, true, nil
+}
+
+// startRefresh counts a refresh about to start, unless the cache is stopped
+func (c *Cache) startRefresh() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stopped {
+		return false
+	}
+	c.refreshes.Add(1)
+	return true
+}
+
+// stopRefreshes stops starting refreshes and waits for the ones under way
+func (c *Cache) stopRefreshes() {
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+	c.refreshes.Wait()
+}
+
+// adopt takes over copies of the entries of the previous cache, as far as they fit
+func (c *Cache) adopt(previous *Cache) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range previous.entries {
+		if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+			continue
+		}
+		e := *entry
+		e.prefetching = false
+		c.entries[key] = &e
+	}
+}
+
+// snapshotEntry is a cached answer in the json snapshot of the cache
+type snapshotEntry struct {
+	Name    string    `json:"name"`
+	Type    QueryType `json:"type"`
+	DNSSEC  bool      `json:"dnssec"`
+	Stored  time.Time `json:"stored"`
+	Expires time.Time `json:"expires"`
+	Packet  []byte    `json:"packet"` // wire format
+}
+
+// save writes the entries of the cache to its file, replacing the file only once it is written
+func (c *Cache) save() error {
+	c.mu.Lock()
+	var entries []snapshotEntry
+	for key, entry := range c.entries {
+		buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+		if err := entry.packet.write(buf); err != nil {
+			continue
+		}
+		entries = append(entries, snapshotEntry{
+			Name: key.name, Type: key.qtype, DNSSEC: key.dnssec,
+			Stored: entry.stored, Expires: entry.expires, Packet: buf.buf[:buf.position()],
+		})
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
+
+// load adds the entries of the file to the cache, except the ones past their stale window.
+// The TTLs are counted down by the time passed since the entries were stored.
+func (c *Cache) load(now time.Time) error {
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range entries {
+		if now.After(e.Expires.Add(c.staleWindow)) || len(c.entries) >= c.size {
+			continue
+		}
+		buf := NewBytePacketBufferSize(len(e.Packet))
+		copy(buf.buf, e.Packet)
+		packet := NewDnsPacket()
+		if err := packet.fromBuffer(buf); err != nil {
+			continue
+		}
+		key := cacheKey{name: e.Name, qtype: e.Type, dnssec: e.DNSSEC}
+		c.entries[key] = &cacheEntry{packet: packet, stored: e.Stored, expires: e.Expires}
+	}
+	return nil
+}
+
+// run saves the cache to its file periodically and once more when stopped
+func (c *Cache) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(c.snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.save(); err != nil {
+				log.Printf("error saving the cache: %v\n", err)
+			}
+		case <-stop:
+			if err := c.save(); err != nil {
+				log.Printf("error saving the cache: %v\n", err)
+			}
+			return
+		}
+	}
+}
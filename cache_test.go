@@ -0,0 +1,273 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheTTL(t *testing.T) {
+	soa := DnsRecord{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", minimum: 300}
+	testcases := []struct {
+		name        string
+		resCode     ResultCode
+		answers     []DnsRecord
+		authorities []DnsRecord
+		ttl         time.Duration
+	}{
+		{name: "lowest answer ttl", answers: []DnsRecord{{qType: CNAME, ttl: 600}, {qType: A, ttl: 60}}, ttl: time.Minute},
+		{name: "nxdomain", resCode: NxDomain, authorities: []DnsRecord{soa}, ttl: 5 * time.Minute},
+		{name: "nodata", authorities: []DnsRecord{soa}, ttl: 5 * time.Minute},
+		{name: "negative without soa", resCode: NxDomain},
+		{name: "servfail", resCode: Servfail},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := NewDnsPacket()
+			packet.header.resCode = tc.resCode
+			packet.answers = tc.answers
+			packet.authorities = tc.authorities
+			assert.Equal(t, tc.ttl, cacheTTL(packet))
+		})
+	}
+}
+
+func TestCacheResolve(t *testing.T) {
+	var queries atomic.Int32
+	var fail atomic.Bool
+	var delay atomic.Int64
+	cache := NewCache()
+	cache.clientTimeout = 50 * time.Millisecond
+	cache.query = func(domain string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+		queries.Add(1)
+		time.Sleep(time.Duration(delay.Load()))
+		if fail.Load() {
+			return nil, errors.New("timeout")
+		}
+		packet := NewDnsPacket()
+		packet.questions = []DnsQuestion{{name: domain, qtype: qtype}}
+		packet.answers = []DnsRecord{{domain: domain, qType: A, ttl: 300, addr: "192.0.2.1"}}
+		return packet, nil
+	}
+	key := cacheKey{name: "www.example.com", qtype: A}
+	// expire moves the cached answer into the past
+	expire := func(d time.Duration) {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		entry := cache.entries[key]
+		entry.stored = entry.stored.Add(-d)
+		entry.expires = entry.expires.Add(-d)
+		entry.failed = time.Time{}
+	}
+
+	packet, stale, err := cache.resolve("www.example.com", A, false)
+	require.NoError(t, err)
+	assert.False(t, stale)
+	assert.Equal(t, uint32(300), packet.answers[0].ttl)
+
+	t.Run("fresh", func(t *testing.T) {
+		expire(100 * time.Second)
+		packet, stale, err := cache.resolve("www.example.com", A, false)
+		require.NoError(t, err)
+		assert.False(t, stale)
+		assert.Equal(t, uint32(200), packet.answers[0].ttl)
+		assert.Equal(t, int32(1), queries.Load())
+
+		// the cached answer is a copy
+		packet.answers[0].domain = "changed.example.com"
+		packet, _, _ = cache.resolve("www.example.com", A, false)
+		assert.Equal(t, "www.example.com", packet.answers[0].domain)
+	})
+
+	t.Run("upstream failure", func(t *testing.T) {
+		fail.Store(true)
+		expire(time.Hour)
+		packet, stale, err := cache.resolve("www.example.com", A, false)
+		require.NoError(t, err)
+		assert.True(t, stale)
+		assert.Equal(t, uint32(30), packet.answers[0].ttl)
+		assert.Equal(t, int32(2), queries.Load())
+
+		// the upstream servers are not asked again right after the failure
+		_, stale, _ = cache.resolve("www.example.com", A, false)
+		assert.True(t, stale)
+		assert.Equal(t, int32(2), queries.Load())
+	})
+
+	t.Run("client timeout", func(t *testing.T) {
+		fail.Store(false)
+		delay.Store(int64(200 * time.Millisecond))
+		expire(0)
+		_, stale, err := cache.resolve("www.example.com", A, false)
+		require.NoError(t, err)
+		assert.True(t, stale)
+
+		// the lookup refreshes the cache in the background
+		assert.Eventually(t, func() bool {
+			_, stale, _ := cache.resolve("www.example.com", A, false)
+			return !stale
+		}, time.Second, 20*time.Millisecond)
+		delay.Store(0)
+	})
+
+	t.Run("past the stale window", func(t *testing.T) {
+		fail.Store(true)
+		expire(cache.staleWindow + time.Hour)
+		_, _, err := cache.resolve("www.example.com", A, false)
+		assert.Error(t, err)
+	})
+}
+
+func TestCacheStopRefreshes(t *testing.T) {
+	release := make(chan struct{})
+	var queries atomic.Int32
+	cache := NewCache()
+	cache.query = func(domain string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+		queries.Add(1)
+		<-release
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{{domain: domain, qType: A, ttl: 300, addr: "192.0.2.1"}}
+		return packet, nil
+	}
+
+	// stopping waits for the refreshes under way, whose answers are cached
+	go cache.resolve("www.example.com", A, false)
+	assert.Eventually(t, func() bool { return queries.Load() == 1 }, time.Second, time.Millisecond)
+	stopped := make(chan struct{})
+	go func() {
+		cache.stopRefreshes()
+		close(stopped)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-stopped:
+		t.Fatal("stopped before the refresh finished")
+	default:
+	}
+	close(release)
+	<-stopped
+	assert.Contains(t, cache.entries, cacheKey{name: "www.example.com", qtype: A})
+
+	// the stopped cache still answers, without being updated
+	packet, _, err := cache.resolve("other.example.com", A, false)
+	require.NoError(t, err)
+	assert.Len(t, packet.answers, 1)
+	assert.NotContains(t, cache.entries, cacheKey{name: "other.example.com", qtype: A})
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := NewCache()
+	cache.size = 2
+	now := time.Now()
+	answer := func(ttl uint32) *DnsPacket {
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{{domain: "example.com", qType: A, ttl: ttl, addr: "192.0.2.1"}}
+		return packet
+	}
+	cache.put(cacheKey{name: "old.example.com", qtype: A}, answer(1), now.Add(-cache.staleWindow-time.Hour))
+	cache.put(cacheKey{name: "a.example.com", qtype: A}, answer(300), now)
+	cache.put(cacheKey{name: "b.example.com", qtype: A}, answer(300), now)
+	assert.Len(t, cache.entries, 2)
+	assert.NotContains(t, cache.entries, cacheKey{name: "old.example.com", qtype: A})
+
+	cache.put(cacheKey{name: "c.example.com", qtype: A}, answer(300), now)
+	assert.Len(t, cache.entries, 2)
+	assert.Contains(t, cache.entries, cacheKey{name: "c.example.com", qtype: A})
+}
+
+func TestCachePrefetch(t *testing.T) {
+	var queries atomic.Int32
+	cache := NewCache()
+	cache.query = func(domain string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+		queries.Add(1)
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{{domain: domain, qType: A, ttl: 100, addr: "192.0.2.1"}}
+		return packet, nil
+	}
+	key := cacheKey{name: "www.example.com", qtype: A}
+	age := func(d time.Duration) {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		cache.entries[key].stored = cache.entries[key].stored.Add(-d)
+		cache.entries[key].expires = cache.entries[key].expires.Add(-d)
+	}
+
+	_, _, err := cache.resolve("www.example.com", A, false)
+	require.NoError(t, err)
+
+	// not refreshed before the last 10% of the TTL
+	cache.resolve("www.example.com", A, false)
+	cache.resolve("www.example.com", A, false)
+	age(85 * time.Second)
+	cache.resolve("www.example.com", A, false)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(1), queries.Load())
+
+	// refreshed once in the background while the answer is still served from the cache
+	age(10 * time.Second)
+	packet, stale, err := cache.resolve("www.example.com", A, false)
+	require.NoError(t, err)
+	assert.False(t, stale)
+	assert.Equal(t, uint32(5), packet.answers[0].ttl)
+	assert.Eventually(t, func() bool {
+		packet, _, _ := cache.resolve("www.example.com", A, false)
+		return packet.answers[0].ttl == 100
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(2), queries.Load())
+
+	t.Run("unpopular", func(t *testing.T) {
+		cache.resolve("rare.example.com", A, false)
+		key = cacheKey{name: "rare.example.com", qtype: A}
+		age(95 * time.Second)
+		cache.resolve("rare.example.com", A, false)
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, int32(3), queries.Load())
+	})
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache.json")
+	cache := NewCache()
+	cache.file = file
+	now := time.Now()
+
+	answer := NewDnsPacket()
+	answer.questions = []DnsQuestion{{name: "www.example.com", qtype: A}}
+	answer.answers = []DnsRecord{{domain: "www.example.com", qType: A, ttl: 300, addr: "192.0.2.1"}}
+	cache.put(cacheKey{name: "www.example.com", qtype: A}, answer, now.Add(-100*time.Second))
+	negative := NewDnsPacket()
+	negative.header.resCode = NxDomain
+	negative.questions = []DnsQuestion{{name: "missing.example.com", qtype: A}}
+	negative.authorities = []DnsRecord{{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", minimum: 300}}
+	cache.put(cacheKey{name: "missing.example.com", qtype: A, dnssec: true}, negative, now)
+	cache.put(cacheKey{name: "old.example.com", qtype: A}, answer, now.Add(-cache.staleWindow-time.Hour))
+	require.NoError(t, cache.save())
+
+	// an hour later, after a restart
+	loaded := NewCache()
+	loaded.file = file
+	require.NoError(t, loaded.load(now.Add(time.Hour)))
+	assert.Len(t, loaded.entries, 2)
+
+	packet, stale, _ := loaded.get(cacheKey{name: "www.example.com", qtype: A}, now.Add(150*time.Second))
+	require.NotNil(t, packet)
+	assert.False(t, stale)
+	assert.Equal(t, uint32(50), packet.answers[0].ttl)
+	assert.Equal(t, "192.0.2.1", packet.answers[0].addr)
+
+	packet, stale, _ = loaded.get(cacheKey{name: "missing.example.com", qtype: A, dnssec: true}, now.Add(time.Hour))
+	require.NotNil(t, packet)
+	assert.True(t, stale)
+	assert.Equal(t, NxDomain, packet.header.resCode)
+
+	// a missing file leaves the cache empty
+	empty := NewCache()
+	empty.file = filepath.Join(t.TempDir(), "missing.json")
+	require.NoError(t, empty.load(now))
+	assert.Empty(t, empty.entries)
+}
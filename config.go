@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The root zone KSK-2017, used when no trust anchor is configured
+const rootTrustAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// Config holds the settings read from the json configuration file
+type Config struct {
+	DNSSEC   DnssecConfig    `json:"dnssec"`
+	Zones    []ZoneConfig    `json:"zones"`
+	TSIGKeys []TsigKeyConfig `json:"tsigKeys"`
+	// HostsFiles are files in /etc/hosts format answering A, AAAA and PTR questions
+	HostsFiles []string `json:"hostsFiles"`
+	// Blocking filters the queries for the domains of blocklists
+	Blocking *BlockingConfig `json:"blocking"`
+	// RPZ lists the response policy zones in the order of their precedence
+	RPZ []RPZConfig `json:"rpz"`
+	// Forward lists the upstream servers of domains and their subdomains, the longest matching domain applies.
+	// The rule of the domain "." replaces the default of sending all other queries to 8.8.8.8.
+	Forward []ForwardConfig `json:"forward"`
+	// Rewrite lists rules changing the questions before they are answered, the first matching rule applies
+	Rewrite []RewriteConfig `json:"rewrite"`
+	// DNS64 synthesizes AAAA records for IPv6-only clients
+	DNS64 *DNS64Config `json:"dns64"`
+	// Rebinding keeps private addresses out of the answers of upstream servers
+	Rebinding *RebindingConfig `json:"rebinding"`
+	// ACL controls the access of clients to recursion, local zones, zone transfers and dynamic updates
+	ACL *ACLConfig `json:"acl"`
+	// RateLimit limits the rate of responses sent over udp to the same clients
+	RateLimit *RateLimitConfig `json:"rateLimit"`
+	// Cookies configures the server cookies of DNS cookies, which are always supported
+	Cookies *CookieConfig `json:"cookies"`
+	// Cache enables the cache of upstream answers
+	Cache *CacheConfig `json:"cache"`
+}
+
+// CacheConfig configures the cache of upstream answers
+type CacheConfig struct {
+	// Size is the maximum number of cached answers, 10000 by default
+	Size int `json:"size"`
+	// StaleWindow is how long expired answers are kept to be served when the upstream servers fail, 24h by default
+	StaleWindow Duration `json:"staleWindow"`
+	// StaleTTL is the TTL of the records of expired answers, 30s by default
+	StaleTTL Duration `json:"staleTTL"`
+	// ClientTimeout is how long the upstream servers may take before an expired answer is served, 1.8s by default
+	ClientTimeout Duration `json:"clientTimeout"`
+	// PrefetchPercent refreshes popular answers asked for in this last percentage of their TTL, 10 by default,
+	// and 0 disables prefetching. PrefetchHits is the number of times an answer is asked for to be popular, 3 by default.
+	PrefetchPercent *int `json:"prefetchPercent"`
+	PrefetchHits    int  `json:"prefetchHits"`
+	// File keeps the cache across restarts, saved every SnapshotInterval (5m by default) and on shutdown
+	File             string   `json:"file"`
+	SnapshotInterval Duration `json:"snapshotInterval"`
+}
+
+// CookieConfig configures the generation of server cookies
+type CookieConfig struct {
+	// Secret is a fixed key of 16 bytes in hex shared by the servers of an anycast address,
+	// a random key rotated periodically by default
+	Secret string `json:"secret"`
+	// Rotation is the period of the random key, 24h by default
+	Rotation Duration `json:"rotation"`
+	// Required answers udp queries with a client cookie but no valid server cookie with BADCOOKIE
+	Required bool `json:"required"`
+}
+
+// RateLimitConfig configures response rate limiting, the rates are responses per second
+// sent to a netblock of clients and unlimited when zero
+type RateLimitConfig struct {
+	// ResponsesPerSecond limits identical answers, referrals and NODATA responses
+	ResponsesPerSecond int `json:"responsesPerSecond"`
+	// NxDomainsPerSecond limits NXDOMAIN responses of names in the same zone
+	NxDomainsPerSecond int `json:"nxdomainsPerSecond"`
+	// ErrorsPerSecond limits responses with other result codes
+	ErrorsPerSecond int `json:"errorsPerSecond"`
+	// Window is the period over which the responses are counted, 15s by default
+	Window Duration `json:"window"`
+	// Slip truncates every slip-th limited response instead of dropping it, 2 by default, and 0 drops all of them
+	Slip *int `json:"slip"`
+	// IPv4PrefixLength and IPv6PrefixLength define the netblocks of clients, /24 and /56 by default
+	IPv4PrefixLength int `json:"ipv4PrefixLength"`
+	IPv6PrefixLength int `json:"ipv6PrefixLength"`
+	// LogOnly logs the responses to limit but sends them
+	LogOnly bool `json:"logOnly"`
+}
+
+// ACLConfig configures the access control lists of each kind of request.
+// Clients not matching any rule are allowed, except for recursion once it has rules, which is refused.
+type ACLConfig struct {
+	Recursion []ACLRuleConfig `json:"recursion"`
+	Zones     []ACLRuleConfig `json:"zones"`
+	Transfer  []ACLRuleConfig `json:"transfer"`
+	Update    []ACLRuleConfig `json:"update"`
+}
+
+// ACLRuleConfig applies an action to clients by their address
+type ACLRuleConfig struct {
+	// Networks lists addresses or networks in CIDR notation
+	Networks []string `json:"networks"`
+	// Action is allow, refuse for answering REFUSED, deny for answering REFUSED with the
+	// extended DNS error Prohibited, or drop for not answering
+	Action string `json:"action"`
+}
+
+// RebindingConfig configures the DNS rebinding protection
+type RebindingConfig struct {
+	// Block refuses answers with private addresses instead of removing the addresses
+	Block bool `json:"block"`
+	// AllowedDomains are internal domains whose names and subdomains may have private addresses
+	AllowedDomains []string `json:"allowedDomains"`
+}
+
+// DNS64Config configures the synthesis of AAAA records from A records
+type DNS64Config struct {
+	// Prefix is the NAT64 prefix, 64:ff9b::/96 by default
+	Prefix string `json:"prefix"`
+	// Exclude lists IPv6 networks of AAAA records treated as missing, ::ffff:0:0/96 by default,
+	// and IPv4 networks of A records not synthesized
+	Exclude []string `json:"exclude"`
+	// Clients lists the addresses or networks of the clients getting synthesized answers, all by default
+	Clients []string `json:"clients"`
+}
+
+// RewriteConfig configures a rewrite rule, the answer of the rewritten question is sent for the original one
+type RewriteConfig struct {
+	// Match is exact (default), suffix or regex
+	Match string `json:"match"`
+	// Name is the name, suffix or regular expression the question name is matched with, empty for any name
+	Name string `json:"name"`
+	// To replaces the name or suffix, or the name matching the regular expression using $1 for its groups
+	To string `json:"to"`
+	// Type restricts the rule to questions of the type, and ToType is the type asked instead
+	Type   string `json:"type"`
+	ToType string `json:"toType"`
+}
+
+// ForwardConfig configures the upstream servers of a domain
+type ForwardConfig struct {
+	Domain string `json:"domain"`
+	// Upstreams are addresses with an optional port, tried in order until one answers
+	Upstreams []string `json:"upstreams"`
+	// Transport is udp (default), retrying truncated answers over tcp, or tcp
+	Transport string `json:"transport"`
+	// Timeout is the time allowed for each upstream to answer, 2s by default
+	Timeout Duration `json:"timeout"`
+}
+
+// RPZConfig configures a response policy zone, read from a zone file or transferred from a primary
+type RPZConfig struct {
+	Name    string `json:"name"`
+	File    string `json:"file"`
+	Primary string `json:"primary"`
+	// Key names the TSIG key signing the transfer requests
+	Key string `json:"key"`
+	// Log logs the queries the policies of the zone apply to
+	Log bool `json:"log"`
+}
+
+// BlockingConfig configures the blocking of domains, which also blocks their subdomains
+type BlockingConfig struct {
+	// Blocklists are files of domains in hosts, domains-only or Adblock (||domain^) format
+	Blocklists []string `json:"blocklists"`
+	// Allowlists are files in the same formats of domains never blocked
+	Allowlists []string `json:"allowlists"`
+	// Response is nxdomain (default), null for 0.0.0.0 and ::, refused or an ip address answered instead
+	Response string `json:"response"`
+}
+
+// TsigKeyConfig is a shared key for TSIG transaction signatures
+type TsigKeyConfig struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"` // hmac-sha256 or hmac-sha512
+	Secret    string `json:"secret"`    // base64
+}
+
+type DnssecConfig struct {
+	// Validate enables the validation of upstream answers
+	Validate bool `json:"validate"`
+	// TrustAnchors are DS or DNSKEY records in presentation format
+	TrustAnchors []string `json:"trustAnchors"`
+}
+
+// ZoneConfig configures a zone served from a local zone file, or transferred from a primary
+type ZoneConfig struct {
+	Name    string         `json:"name"`
+	File    string         `json:"file"`
+	Signing *SigningConfig `json:"signing"`
+	// Primary makes the zone a secondary zone transferred from the primary at this address
+	Primary string `json:"primary"`
+	// Notify lists the addresses of secondaries notified when the zone changes
+	Notify []string `json:"notify"`
+	// AllowUpdate lists the addresses or networks allowed to send dynamic updates
+	AllowUpdate []string `json:"allowUpdate"`
+	// Journal is the file recording dynamic updates, by default the zone file name with a .jnl extension
+	Journal string `json:"journal"`
+	// TransferKeys and UpdateKeys name the TSIG keys allowing transfers and updates of the zone from any address
+	TransferKeys []string `json:"transferKeys"`
+	UpdateKeys   []string `json:"updateKeys"`
+	// Key names the TSIG key signing the requests to the primary and the NOTIFY messages to secondaries.
+	// NOTIFY messages to a secondary zone with a key must be signed with it.
+	Key string `json:"key"`
+	// AllowTransfer lists the addresses or networks in CIDR notation allowed to transfer the zone
+	AllowTransfer []string `json:"allowTransfer"`
+}
+
+// SigningConfig enables online signing of a zone
+type SigningConfig struct {
+	// KSK and ZSK are BIND style key file names without the .key/.private extension
+	KSK []string `json:"ksk"`
+	ZSK []string `json:"zsk"`
+	// NSEC3 selects NSEC3 instead of NSEC records for the denial of existence
+	NSEC3      bool   `json:"nsec3"`
+	OptOut     bool   `json:"optOut"`
+	Salt       string `json:"salt"` // hex
+	Iterations uint16 `json:"iterations"`
+	// Validity is the validity period of new signatures, which are refreshed once Refresh is left of it
+	Validity Duration `json:"validity"`
+	Refresh  Duration `json:"refresh"`
+}
+
+// Duration is a time.Duration written like "1h30m" in the configuration file
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	d.Duration = duration
+	return nil
+}
+
+// newZoneSigner creates the signer of a zone from its signing configuration
+func (c *SigningConfig) newZoneSigner() (*ZoneSigner, error) {
+	var ksks, zsks []*SigningKey
+	for _, prefix := range c.KSK {
+		key, err := loadSigningKey(prefix)
+		if err != nil {
+			return nil, err
+		}
+		ksks = append(ksks, key)
+	}
+	for _, prefix := range c.ZSK {
+		key, err := loadSigningKey(prefix)
+		if err != nil {
+			return nil, err
+		}
+		zsks = append(zsks, key)
+	}
+
+	signer, err := NewZoneSigner(ksks, zsks)
+	if err != nil {
+		return nil, err
+	}
+	signer.nsec3 = c.NSEC3
+	signer.optOut = c.OptOut
+	signer.iterations = c.Iterations
+	if signer.salt, err = hex.DecodeString(c.Salt); err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	if c.Validity.Duration > 0 {
+		signer.validity = c.Validity.Duration
+	}
+	if c.Refresh.Duration > 0 {
+		signer.refresh = c.Refresh.Duration
+	}
+	if signer.refresh >= signer.validity {
+		return nil, fmt.Errorf("signature refresh %v is not shorter than the validity %v", signer.refresh, signer.validity)
+	}
+	return signer, nil
+}
+
+// newTsigKey creates the TsigKey of a key configuration
+func (c *TsigKeyConfig) newTsigKey() (*TsigKey, error) {
+	secret, err := base64.StdEncoding.DecodeString(c.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("TSIG key %s: invalid secret: %v", c.Name, err)
+	}
+	key, err := NewTsigKey(c.Name, c.Algorithm, secret)
+	if err != nil {
+		return nil, fmt.Errorf("TSIG key %s: %v", c.Name, err)
+	}
+	return key, nil
+}
+
+// newBlocklist creates the Blocklist of the blocking configuration
+func (c *BlockingConfig) newBlocklist() (*Blocklist, error) {
+	blocklist := NewBlocklist()
+	var err error
+	if blocklist.mode, blocklist.ip, err = parseBlockMode(c.Response); err != nil {
+		return nil, err
+	}
+	for _, path := range c.Blocklists {
+		if err := blocklist.load(path, false); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range c.Allowlists {
+		if err := blocklist.load(path, true); err != nil {
+			return nil, err
+		}
+	}
+	return blocklist, nil
+}
+
+// newForwardRule creates the ForwardRule of a forwarding configuration
+func (c *ForwardConfig) newForwardRule() (*ForwardRule, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, fmt.Errorf("forwarding rule %s has no upstreams", c.Domain)
+	}
+	rule := NewForwardRule(c.Domain, c.Upstreams)
+	switch strings.ToLower(c.Transport) {
+	case "", "udp":
+	case "tcp":
+		rule.tcp = true
+	default:
+		return nil, fmt.Errorf("forwarding rule %s: invalid transport %q", c.Domain, c.Transport)
+	}
+	if c.Timeout.Duration > 0 {
+		rule.timeout = c.Timeout.Duration
+	}
+	return rule, nil
+}
+
+// newRewriteRule creates the RewriteRule of a rewrite configuration
+func (c *RewriteConfig) newRewriteRule() (*RewriteRule, error) {
+	rule, err := NewRewriteRule(c.Match, c.Name, c.To)
+	if err != nil {
+		return nil, err
+	}
+	if c.Type != "" {
+		if rule.qtype, err = parseQueryType(c.Type); err != nil {
+			return nil, err
+		}
+	}
+	if c.ToType != "" {
+		if rule.toType, err = parseQueryType(c.ToType); err != nil {
+			return nil, err
+		}
+	}
+	if c.Name != "" && c.To == "" {
+		return nil, fmt.Errorf("rewrite rule for %s has no replacement", c.Name)
+	}
+	return rule, nil
+}
+
+// newDNS64 creates the DNS64 of a DNS64 configuration
+func (c *DNS64Config) newDNS64() (*DNS64, error) {
+	prefix := c.Prefix
+	if prefix == "" {
+		prefix = DNS64_DEFAULT_PREFIX
+	}
+	d, err := NewDNS64(prefix)
+	if err != nil {
+		return nil, err
+	}
+	exclude := c.Exclude
+	if len(exclude) == 0 {
+		exclude = []string{DNS64_DEFAULT_EXCLUDE}
+	}
+	// IPv4-mapped networks like ::ffff:0:0/96 would contain IPv4 addresses, so the families are kept apart
+	var excludeA, excludeAAAA []string
+	for _, s := range exclude {
+		if strings.Contains(s, ":") {
+			excludeAAAA = append(excludeAAAA, s)
+		} else {
+			excludeA = append(excludeA, s)
+		}
+	}
+	if d.excludeAAAA, err = parseNetworks(excludeAAAA); err != nil {
+		return nil, err
+	}
+	if d.excludeA, err = parseNetworks(excludeA); err != nil {
+		return nil, err
+	}
+	if d.clients, err = parseNetworks(c.Clients); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// newRebindingFilter creates the RebindingFilter of a rebinding configuration
+func (c *RebindingConfig) newRebindingFilter() *RebindingFilter {
+	filter := NewRebindingFilter()
+	filter.block = c.Block
+	for _, domain := range c.AllowedDomains {
+		filter.allowed.add(domain)
+	}
+	return filter
+}
+
+// newCache creates the Cache of a cache configuration
+func (c *CacheConfig) newCache() (*Cache, error) {
+	cache := NewCache()
+	if c.Size > 0 {
+		cache.size = c.Size
+	}
+	if c.StaleWindow.Duration > 0 {
+		cache.staleWindow = c.StaleWindow.Duration
+	}
+	if c.StaleTTL.Duration > 0 {
+		cache.staleTTL = c.StaleTTL.Duration
+	}
+	if c.ClientTimeout.Duration > 0 {
+		cache.clientTimeout = c.ClientTimeout.Duration
+	}
+	if c.PrefetchPercent != nil {
+		if *c.PrefetchPercent < 0 || *c.PrefetchPercent > 100 {
+			return nil, fmt.Errorf("invalid prefetch percentage %d", *c.PrefetchPercent)
+		}
+		cache.prefetchPercent = *c.PrefetchPercent
+	}
+	if c.PrefetchHits > 0 {
+		cache.prefetchHits = c.PrefetchHits
+	}
+	cache.file = c.File
+	if c.SnapshotInterval.Duration > 0 {
+		cache.snapshotInterval = c.SnapshotInterval.Duration
+	}
+	return cache, nil
+}
+
+// newServerCookies creates the ServerCookies of a cookie configuration
+func (c *CookieConfig) newServerCookies() (*ServerCookies, error) {
+	cookies := NewServerCookies()
+	cookies.required = c.Required
+	if c.Rotation.Duration > 0 {
+		cookies.rotation = c.Rotation.Duration
+	}
+	if c.Secret != "" {
+		secret, err := hex.DecodeString(c.Secret)
+		if err != nil || len(secret) != len(cookies.secret) {
+			return nil, fmt.Errorf("invalid cookie secret, expected %d bytes in hex", len(cookies.secret))
+		}
+		copy(cookies.secret[:], secret)
+		cookies.previous = cookies.secret
+		cookies.rotation = 0
+	}
+	return cookies, nil
+}
+
+// newRateLimiter creates the RateLimiter of a rate limit configuration
+func (c *RateLimitConfig) newRateLimiter() (*RateLimiter, error) {
+	limiter := NewRateLimiter(c.ResponsesPerSecond, c.NxDomainsPerSecond, c.ErrorsPerSecond)
+	if c.Window.Duration > 0 {
+		limiter.window = c.Window.Duration
+	}
+	if c.Slip != nil {
+		if *c.Slip < 0 {
+			return nil, fmt.Errorf("invalid rate limit slip %d", *c.Slip)
+		}
+		limiter.slip = *c.Slip
+	}
+	if c.IPv4PrefixLength != 0 {
+		if c.IPv4PrefixLength < 0 || c.IPv4PrefixLength > 32 {
+			return nil, fmt.Errorf("invalid rate limit ipv4 prefix length %d", c.IPv4PrefixLength)
+		}
+		limiter.ipv4Prefix = c.IPv4PrefixLength
+	}
+	if c.IPv6PrefixLength != 0 {
+		if c.IPv6PrefixLength < 0 || c.IPv6PrefixLength > 128 {
+			return nil, fmt.Errorf("invalid rate limit ipv6 prefix length %d", c.IPv6PrefixLength)
+		}
+		limiter.ipv6Prefix = c.IPv6PrefixLength
+	}
+	limiter.logOnly = c.LogOnly
+	return limiter, nil
+}
+
+// newACLs creates the ACLs of an ACL configuration
+func (c *ACLConfig) newACLs() (*ACLs, error) {
+	acls := NewACLs()
+	for _, list := range []struct {
+		acl   *ACL
+		rules []ACLRuleConfig
+	}{
+		{&acls.recursion, c.Recursion}, {&acls.zones, c.Zones}, {&acls.transfer, c.Transfer}, {&acls.update, c.Update},
+	} {
+		for _, rc := range list.rules {
+			networks, err := parseNetworks(rc.Networks)
+			if err != nil {
+				return nil, fmt.Errorf("acl: %v", err)
+			}
+			action, err := parseACLAction(rc.Action)
+			if err != nil {
+				return nil, err
+			}
+			list.acl.add(networks, action)
+		}
+	}
+	// an open resolver is only configured explicitly
+	if len(c.Recursion) > 0 {
+		acls.recursion.defaultAction = ACLRefuse
+	}
+	return acls, nil
+}
+
+// parseNetworks parses a list of ip addresses and networks in CIDR notation
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip address %q", s)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// hostPort adds the default dns port to an address without a port
+func hostPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(addr, "53")
+	}
+	return addr
+}
+
+// containsIP reports whether the ip address is in one of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultConfig returns the configuration used when no configuration file is given
+func defaultConfig() *Config {
+	return &Config{}
+}
+
+// loadConfig reads the configuration file at path
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := defaultConfig()
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
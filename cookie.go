@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+// EDNS option code of DNS cookies (RFC 7873)
+const EDNS_COOKIE = 10
+
+// Sizes of the client cookie and of the server cookies we generate (RFC 9018)
+const (
+	COOKIE_CLIENT_SIZE = 8
+	COOKIE_SERVER_SIZE = 16
+)
+
+// Server cookies are valid for an hour, and up to 5 minutes ahead of our clock (RFC 9018 4.3)
+const (
+	COOKIE_LIFETIME = time.Hour
+	COOKIE_FUTURE   = 5 * time.Minute
+)
+
+// Period after which the random cookie secret is replaced
+const COOKIE_DEFAULT_ROTATION = 24 * time.Hour
+
+// CookieStatus is the result of checking the cookie of a request
+type CookieStatus int
+
+const (
+	CookieNone       CookieStatus = iota // the request has no cookie
+	CookieMalformed                      // the cookie option has an invalid length
+	CookieClientOnly                     // the request has a client cookie only
+	CookieValid                          // the server cookie is one we generated for the client
+	CookieInvalid                        // the server cookie is wrong or expired
+)
+
+// ServerCookies generates and verifies the server cookies of clients (RFC 9018)
+type ServerCookies struct {
+	required bool          // answer udp queries without a valid server cookie with BADCOOKIE
+	rotation time.Duration // period of the secret, never rotated when zero
+
+	mu       sync.Mutex
+	secret   [16]byte
+	previous [16]byte // the secret before the last rotation, whose cookies are still valid
+	rotated  time.Time
+}
+
+// NewServerCookies creates new ServerCookies with a random secret
+func NewServerCookies() *ServerCookies {
+	s := &ServerCookies{rotation: COOKIE_DEFAULT_ROTATION, rotated: time.Now()}
+	rand.Read(s.secret[:])
+	s.previous = s.secret
+	return s
+}
+
+// secrets returns the current and the previous secret, rotating the secret when its period has passed
+func (s *ServerCookies) secrets(now time.Time) ([16]byte, [16]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rotation > 0 && now.Sub(s.rotated) >= s.rotation {
+		s.previous = s.secret
+		rand.Read(s.secret[:])
+		s.rotated = now
+	}
+	return s.secret, s.previous
+}
+
+// serverCookie returns the server cookie of the client cookie and address:
+// version 1, three reserved bytes, the timestamp and the SipHash-2-4 of them all
+func serverCookie(secret [16]byte, clientCookie []byte, client net.IP, timestamp uint32) []byte {
+	cookie := make([]byte, 8, COOKIE_SERVER_SIZE)
+	cookie[0] = 1
+	binary.BigEndian.PutUint32(cookie[4:], timestamp)
+
+	msg := append(append([]byte{}, clientCookie...), cookie...)
+	if ip4 := client.To4(); ip4 != nil {
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, client.To16()...)
+	}
+	return binary.LittleEndian.AppendUint64(cookie, siphash24(secret, msg))
+}
+
+// requestCookie returns the data of the cookie option of the request, or nil
+func requestCookie(request *DnsPacket) []byte {
+	opt := request.edns()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.options {
+		if o.code == EDNS_COOKIE {
+			return o.data
+		}
+	}
+	return nil
+}
+
+// check verifies the cookie of the request and returns its status and the cookie of the response,
+// the client cookie followed by a new server cookie, or nil when the request has no valid client cookie
+func (s *ServerCookies) check(request *DnsPacket, client net.IP, now time.Time) (CookieStatus, []byte) {
+	cookie := requestCookie(request)
+	switch {
+	case cookie == nil:
+		return CookieNone, nil
+	case len(cookie) != COOKIE_CLIENT_SIZE && (len(cookie) < COOKIE_CLIENT_SIZE+8 || len(cookie) > COOKIE_CLIENT_SIZE+32):
+		return CookieMalformed, nil
+	case client == nil:
+		return CookieClientOnly, nil
+	}
+
+	secret, previous := s.secrets(now)
+	clientCookie := cookie[:COOKIE_CLIENT_SIZE]
+	response := append(append([]byte{}, clientCookie...), serverCookie(secret, clientCookie, client, uint32(now.Unix()))...)
+	if len(cookie) == COOKIE_CLIENT_SIZE {
+		return CookieClientOnly, response
+	}
+
+	status := CookieInvalid
+	if len(cookie) == COOKIE_CLIENT_SIZE+COOKIE_SERVER_SIZE && cookie[COOKIE_CLIENT_SIZE] == 1 {
+		timestamp := binary.BigEndian.Uint32(cookie[COOKIE_CLIENT_SIZE+4:])
+		generated := time.Unix(int64(timestamp), 0)
+		if generated.After(now.Add(-COOKIE_LIFETIME)) && generated.Before(now.Add(COOKIE_FUTURE)) {
+			for _, key := range [][16]byte{secret, previous} {
+				if bytes.Equal(cookie[COOKIE_CLIENT_SIZE:], serverCookie(key, clientCookie, client, timestamp)) {
+					status = CookieValid
+					break
+				}
+			}
+		}
+	}
+	return status, response
+}
+
+// valid reports whether the request has a valid server cookie of the client
+func (s *ServerCookies) valid(request *DnsPacket, client net.IP) bool {
+	status, _ := s.check(request, client, time.Now())
+	return status == CookieValid
+}
+
+// cookieOptions returns the EDNS options carrying the cookie, none when it is nil
+func cookieOptions(cookie []byte) []EdnsOption {
+	if cookie == nil {
+		return nil
+	}
+	return []EdnsOption{{code: EDNS_COOKIE, data: cookie}}
+}
+
+// ClientCookies holds our client cookies and the server cookies of the upstream servers
+type ClientCookies struct {
+	secret [16]byte
+
+	mu      sync.Mutex
+	servers map[string][]byte // server cookies by upstream address
+}
+
+// NewClientCookies creates new ClientCookies with a random secret
+func NewClientCookies() *ClientCookies {
+	c := &ClientCookies{servers: map[string][]byte{}}
+	rand.Read(c.secret[:])
+	return c
+}
+
+// clientCookie returns our client cookie for the upstream server, different for each server
+func (c *ClientCookies) clientCookie(addr string) []byte {
+	return binary.LittleEndian.AppendUint64(nil, siphash24(c.secret, []byte(addr)))
+}
+
+// add sets the cookie option of a request with an OPT record to the upstream server
+func (c *ClientCookies) add(addr string, request *DnsPacket) {
+	opt := request.edns()
+	if opt == nil {
+		return
+	}
+	c.mu.Lock()
+	cookie := append(c.clientCookie(addr), c.servers[addr]...)
+	c.mu.Unlock()
+
+	var options []EdnsOption
+	for _, o := range opt.options {
+		if o.code != EDNS_COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.options = append(options, cookieOptions(cookie)...)
+}
+
+// update remembers the server cookie of the response from the upstream server.
+// Responses not echoing our client cookie are rejected as spoofed (RFC 7873 5.3).
+func (c *ClientCookies) update(addr string, response *DnsPacket) error {
+	cookie := requestCookie(response)
+	if cookie == nil {
+		return nil
+	}
+	if len(cookie) < COOKIE_CLIENT_SIZE+8 || len(cookie) > COOKIE_CLIENT_SIZE+32 || !bytes.Equal(cookie[:COOKIE_CLIENT_SIZE], c.clientCookie(addr)) {
+		return errors.New("response with a wrong cookie")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.servers[addr] = append([]byte{}, cookie[COOKIE_CLIENT_SIZE:]...)
+	return nil
+}
+
+// siphash24 returns the SipHash-2-4 of the message
+func siphash24(key [16]byte, msg []byte) uint64 {
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13) ^ v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16) ^ v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21) ^ v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17) ^ v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	compress := func(m uint64) {
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+	}
+
+	length := len(msg)
+	for ; len(msg) >= 8; msg = msg[8:] {
+		compress(binary.LittleEndian.Uint64(msg))
+	}
+	var last [8]byte
+	copy(last[:], msg)
+	last[7] = byte(length)
+	compress(binary.LittleEndian.Uint64(last[:]))
+
+	v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		round()
+	}
+	return v0 ^ v1 ^ v2 ^ v3
+}
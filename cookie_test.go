@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSiphash24(t *testing.T) {
+	// the test vector of the SipHash paper
+	var key [16]byte
+	msg := make([]byte, 15)
+	for i := range key {
+		key[i] = byte(i)
+		if i < len(msg) {
+			msg[i] = byte(i)
+		}
+	}
+	assert.Equal(t, uint64(0xa129ca6149be45e5), siphash24(key, msg))
+}
+
+// cookieRequest returns a query with the cookie option
+func cookieRequest(t *testing.T, cookie string) *DnsPacket {
+	data, err := hex.DecodeString(cookie)
+	require.NoError(t, err)
+	request := NewDnsPacket()
+	request.questions = []DnsQuestion{{name: "www.example.com", qtype: A}}
+	opt := newOptRecord(EDNS_BUFFER_SIZE, false)
+	opt.options = cookieOptions(data)
+	request.resources = []DnsRecord{opt}
+	return request
+}
+
+func TestServerCookies(t *testing.T) {
+	// the example of RFC 9018 A.1
+	cookies, err := (&CookieConfig{Secret: "e5e973e5a6b2a43f48e7dc849e37bfcf"}).newServerCookies()
+	require.NoError(t, err)
+	client := net.ParseIP("198.51.100.100")
+	now := time.Unix(1559731985, 0)
+
+	status, cookie := cookies.check(cookieRequest(t, "2464c4abcf10c957"), client, now)
+	assert.Equal(t, CookieClientOnly, status)
+	assert.Equal(t, "2464c4abcf10c957010000005cf79f111f8130c3eee29480", hex.EncodeToString(cookie))
+
+	testcases := []struct {
+		name   string
+		cookie string
+		client string
+		now    time.Time
+		status CookieStatus
+	}{
+		{name: "valid", cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29480", now: now.Add(10 * time.Minute), status: CookieValid},
+		{name: "other client", cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29480", client: "198.51.100.101", now: now, status: CookieInvalid},
+		{name: "expired", cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29480", now: now.Add(2 * time.Hour), status: CookieInvalid},
+		{name: "from the future", cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29480", now: now.Add(-10 * time.Minute), status: CookieInvalid},
+		{name: "other server", cookie: "2464c4abcf10c957010000005cf79f111f8130c3eee29481", now: now, status: CookieInvalid},
+		{name: "too short", cookie: "2464c4abcf10", now: now, status: CookieMalformed},
+		{name: "short server cookie", cookie: "2464c4abcf10c95701000000", now: now, status: CookieMalformed},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := client
+			if tc.client != "" {
+				addr = net.ParseIP(tc.client)
+			}
+			status, _ := cookies.check(cookieRequest(t, tc.cookie), addr, tc.now)
+			assert.Equal(t, tc.status, status)
+		})
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		cookies := NewServerCookies()
+		cookies.rotation = 10 * time.Minute
+		start := cookies.rotated
+		_, cookie := cookies.check(cookieRequest(t, "2464c4abcf10c957"), client, start)
+		request := cookieRequest(t, hex.EncodeToString(cookie))
+
+		// cookies of the previous secret stay valid until the next rotation
+		status, _ := cookies.check(request, client, start.Add(cookies.rotation))
+		assert.Equal(t, CookieValid, status)
+		status, _ = cookies.check(request, client, start.Add(2*cookies.rotation))
+		assert.Equal(t, CookieInvalid, status)
+	})
+}
+
+func TestBadCookie(t *testing.T) {
+	saved := cookies
+	cookies = NewServerCookies()
+	cookies.required = true
+	t.Cleanup(func() { cookies = saved })
+
+	response, err := buildResponse(cookieRequest(t, "2464c4abcf10c957"), net.ParseIP("192.0.2.1"), false)
+	require.NoError(t, err)
+	assert.Equal(t, BadCookie, response.extendedResCode())
+	assert.Empty(t, response.answers)
+
+	// the response is written with the upper bits of the result code in the OPT record
+	data, err := writeResponse(response, MAX_PACKET_SIZE)
+	require.NoError(t, err)
+	buf := NewBytePacketBuffer()
+	copy(buf.buf, data)
+	written := NewDnsPacket()
+	require.NoError(t, written.fromBuffer(buf))
+	assert.Equal(t, BadCookie, written.extendedResCode())
+	cookie := requestCookie(written)
+	require.Len(t, cookie, COOKIE_CLIENT_SIZE+COOKIE_SERVER_SIZE)
+	assert.True(t, cookies.valid(cookieRequest(t, hex.EncodeToString(cookie)), net.ParseIP("192.0.2.1")))
+
+	// over tcp the client has proven its address
+	response, err = buildResponse(NewDnsPacket(), net.ParseIP("192.0.2.1"), true)
+	require.NoError(t, err)
+	assert.NotEqual(t, BadCookie, response.extendedResCode())
+}
+
+func TestClientCookies(t *testing.T) {
+	cookies := NewClientCookies()
+	request := NewDnsPacket()
+	request.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, false)}
+
+	cookies.add("192.0.2.53:53", request)
+	clientCookie := requestCookie(request)
+	require.Len(t, clientCookie, COOKIE_CLIENT_SIZE)
+	assert.NotEqual(t, clientCookie, cookies.clientCookie("192.0.2.54:53"))
+
+	response := NewDnsPacket()
+	response.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, false)}
+	serverCookie := []byte("0123456789abcdef")
+	response.resources[0].options = cookieOptions(append(append([]byte{}, clientCookie...), serverCookie...))
+	require.NoError(t, cookies.update("192.0.2.53:53", response))
+
+	// the server cookie is sent with the next request, replacing the previous option
+	cookies.add("192.0.2.53:53", request)
+	assert.Len(t, request.edns().options, 1)
+	assert.Equal(t, append(append([]byte{}, clientCookie...), serverCookie...), requestCookie(request))
+
+	// a response to another client cookie is spoofed
+	assert.Error(t, cookies.update("192.0.2.54:53", response))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Well-known NAT64 prefix (RFC 6052)
+const DNS64_DEFAULT_PREFIX = "64:ff9b::/96"
+
+// Time to live of the CNAME records of synthesized PTR answers
+const DNS64_CNAME_TTL = 600
+
+// IPv4-mapped addresses, which are never answered as AAAA records of a name (RFC 6147 5.1.4)
+const DNS64_DEFAULT_EXCLUDE = "::ffff:0:0/96"
+
+// DNS64 synthesizes AAAA records from the A records of names without AAAA records (RFC 6147)
+type DNS64 struct {
+	prefix      *net.IPNet   // NAT64 prefix of 32, 40, 48, 56, 64 or 96 bits
+	excludeAAAA []*net.IPNet // networks of AAAA records treated as missing
+	excludeA    []*net.IPNet // networks of A records not synthesized
+	clients     []*net.IPNet // clients getting synthesized answers, all when empty
+}
+
+// NewDNS64 creates a new DNS64 with the NAT64 prefix
+func NewDNS64(prefix string) (*DNS64, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil || network.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid NAT64 prefix %q", prefix)
+	}
+	switch ones, _ := network.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("invalid NAT64 prefix length %d", ones)
+	}
+	// bits 64 to 71 of the addresses must be zero (RFC 6052 2.2)
+	if network.IP[8] != 0 {
+		return nil, fmt.Errorf("invalid NAT64 prefix %q: bits 64 to 71 are not zero", prefix)
+	}
+	return &DNS64{prefix: network}, nil
+}
+
+// embed returns the IPv6 address of the IPv4 address within the NAT64 prefix (RFC 6052 2.2)
+func (d *DNS64) embed(ip4 net.IP) net.IP {
+	ones, _ := d.prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, d.prefix.IP)
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++ // skip the u octet
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extract returns the IPv4 address embedded in an IPv6 address of the NAT64 prefix, or nil
+func (d *DNS64) extract(ip net.IP) net.IP {
+	if !d.prefix.Contains(ip) {
+		return nil
+	}
+	ones, _ := d.prefix.Mask.Size()
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for pos := ones / 8; len(ip4) < net.IPv4len; pos++ {
+		if pos != 8 {
+			ip4 = append(ip4, ip[pos])
+		}
+	}
+	return ip4
+}
+
+// serves reports whether the client gets synthesized answers
+func (d *DNS64) serves(client net.IP) bool {
+	return len(d.clients) == 0 || containsIP(d.clients, client)
+}
+
+// hasAAAA reports whether the answer has AAAA records outside of the excluded networks
+func (d *DNS64) hasAAAA(packet *DnsPacket) bool {
+	for _, r := range packet.answers {
+		if r.qType == AAAA && !containsIP(d.excludeAAAA, net.ParseIP(r.addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// synthesize returns the answer to an AAAA question made from the answer to the A question of the name.
+// CNAME records are kept and the A records become AAAA records of their addresses within the NAT64 prefix.
+func (d *DNS64) synthesize(aAnswer *DnsPacket) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header.resCode = aAnswer.header.resCode
+	for _, r := range aAnswer.answers {
+		switch r.qType {
+		case CNAME:
+			packet.answers = append(packet.answers, r)
+		case A:
+			ip4 := net.ParseIP(r.addr)
+			if ip4 == nil || containsIP(d.excludeA, ip4) {
+				continue
+			}
+			r.qType = AAAA
+			r.addr = d.embed(ip4).String()
+			packet.answers = append(packet.answers, r)
+		}
+	}
+	if len(packet.answers) == 0 {
+		packet.authorities = aAnswer.authorities
+	}
+	return packet
+}
+
+// reverseTarget returns the in-addr.arpa name of the IPv4 address embedded in an ip6.arpa name within the
+// NAT64 prefix, which PTR questions for the name are answered with (RFC 6147 5.3.1), or "" for other names
+func (d *DNS64) reverseTarget(name string) string {
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(name, ".")), ".")
+	if len(labels) != 34 || labels[32] != "ip6" || labels[33] != "arpa" {
+		return ""
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i := 0; i < 32; i++ {
+		nibble, err := strconv.ParseUint(labels[i], 16, 4)
+		if err != nil {
+			return ""
+		}
+		ip[15-i/2] |= byte(nibble) << (4 * (i % 2))
+	}
+	ip4 := d.extract(ip)
+	if ip4 == nil {
+		return ""
+	}
+	return reverseName(ip4)
+}
+
+// answer returns the synthesized answer to an AAAA or PTR question, or nil when the upstream answer stands.
+// query looks up the A records and the PTR records of the embedded IPv4 addresses. The upstream answer
+// stands when the A records cannot be looked up, while a failed PTR lookup is returned as error.
+func (d *DNS64) answer(question DnsQuestion, upstream *DnsPacket, query func(name string, qtype QueryType) (*DnsPacket, error)) (*DnsPacket, error) {
+	switch question.qtype {
+	case AAAA:
+		if upstream.header.resCode != NoError || d.hasAAAA(upstream) {
+			return nil, nil
+		}
+		aAnswer, err := query(question.name, A)
+		if err != nil {
+			log.Printf("error looking up %s A for DNS64: %v\n", question.name, err)
+			return nil, nil
+		}
+		if aAnswer.header.resCode != NoError {
+			return nil, nil
+		}
+		return d.synthesize(aAnswer), nil
+	case PTR:
+		target := d.reverseTarget(question.name)
+		if target == "" {
+			return nil, nil
+		}
+		ptrAnswer, err := query(target, PTR)
+		if err != nil {
+			return nil, err
+		}
+		packet := NewDnsPacket()
+		packet.header.resCode = ptrAnswer.header.resCode
+		packet.answers = append([]DnsRecord{{qType: CNAME, domain: question.name, ttl: DNS64_CNAME_TTL, host: target}}, ptrAnswer.answers...)
+		packet.authorities = ptrAnswer.authorities
+		return packet, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS64(t *testing.T) {
+	t.Run("embedding", func(t *testing.T) {
+		// the examples of RFC 6052 2.4
+		for prefix, expected := range map[string]string{
+			"2001:db8::/32":         "2001:db8:c000:221::",
+			"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+			"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+			"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+			"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+			"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+			DNS64_DEFAULT_PREFIX:    "64:ff9b::c000:221",
+		} {
+			d, err := NewDNS64(prefix)
+			require.NoError(t, err)
+			ip := d.embed(net.ParseIP("192.0.2.33"))
+			assert.Equal(t, expected, ip.String(), prefix)
+			assert.Equal(t, "192.0.2.33", d.extract(ip).String(), prefix)
+		}
+
+		for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24", "2001:db8:0:0:ff00::/96"} {
+			_, err := NewDNS64(prefix)
+			assert.Error(t, err, prefix)
+		}
+	})
+
+	d, err := (&DNS64Config{Exclude: []string{"::ffff:0:0/96", "10.0.0.0/8"}}).newDNS64()
+	require.NoError(t, err)
+
+	upstream := map[string]*DnsPacket{}
+	answer := func(name string, qtype QueryType, resCode ResultCode, records ...DnsRecord) {
+		packet := NewDnsPacket()
+		packet.header.resCode = resCode
+		packet.answers = records
+		upstream[name+" "+qtype.String()] = packet
+	}
+	answer("v4only.example.com", AAAA, NoError)
+	answer("v4only.example.com", A, NoError, DnsRecord{qType: A, domain: "v4only.example.com", ttl: 300, addr: "192.0.2.33"})
+	answer("dual.example.com", AAAA, NoError, DnsRecord{qType: AAAA, domain: "dual.example.com", ttl: 300, addr: "2001:db8::1"})
+	answer("mapped.example.com", AAAA, NoError, DnsRecord{qType: AAAA, domain: "mapped.example.com", ttl: 300, addr: "::ffff:192.0.2.1"})
+	answer("mapped.example.com", A, NoError, DnsRecord{qType: A, domain: "mapped.example.com", ttl: 300, addr: "192.0.2.1"})
+	answer("alias.example.com", AAAA, NoError, DnsRecord{qType: CNAME, domain: "alias.example.com", ttl: 300, host: "v4only.example.com"})
+	answer("alias.example.com", A, NoError,
+		DnsRecord{qType: CNAME, domain: "alias.example.com", ttl: 300, host: "v4only.example.com"},
+		DnsRecord{qType: A, domain: "v4only.example.com", ttl: 300, addr: "192.0.2.33"},
+	)
+	answer("private.example.com", AAAA, NoError)
+	answer("private.example.com", A, NoError, DnsRecord{qType: A, domain: "private.example.com", ttl: 300, addr: "10.0.0.1"})
+	answer("missing.example.com", AAAA, NxDomain)
+	answer("33.2.0.192.in-addr.arpa", PTR, NoError, DnsRecord{qType: PTR, domain: "33.2.0.192.in-addr.arpa", ttl: 300, host: "v4only.example.com"})
+	query := func(name string, qtype QueryType) (*DnsPacket, error) {
+		return upstream[name+" "+qtype.String()], nil
+	}
+
+	testcases := []struct {
+		name     string
+		question DnsQuestion
+		answers  []string // nil when the upstream answer stands
+	}{
+		{
+			name: "synthesized", question: DnsQuestion{name: "v4only.example.com", qtype: AAAA},
+			answers: []string{"v4only.example.com.\t300\tIN\tAAAA\t64:ff9b::c000:221"},
+		},
+		{name: "native", question: DnsQuestion{name: "dual.example.com", qtype: AAAA}},
+		{
+			name: "excluded AAAA", question: DnsQuestion{name: "mapped.example.com", qtype: AAAA},
+			answers: []string{"mapped.example.com.\t300\tIN\tAAAA\t64:ff9b::c000:201"},
+		},
+		{
+			name: "cname", question: DnsQuestion{name: "alias.example.com", qtype: AAAA},
+			answers: []string{
+				"alias.example.com.\t300\tIN\tCNAME\tv4only.example.com.",
+				"v4only.example.com.\t300\tIN\tAAAA\t64:ff9b::c000:221",
+			},
+		},
+		{name: "excluded A", question: DnsQuestion{name: "private.example.com", qtype: AAAA}, answers: []string{}},
+		{name: "nxdomain", question: DnsQuestion{name: "missing.example.com", qtype: AAAA}},
+		{
+			name: "ptr", question: DnsQuestion{name: reverseName(net.ParseIP("64:ff9b::c000:221")), qtype: PTR},
+			answers: []string{
+				"1.2.2.0.0.0.0.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.b.9.f.f.4.6.0.0.ip6.arpa.\t600\tIN\tCNAME\t33.2.0.192.in-addr.arpa.",
+				"33.2.0.192.in-addr.arpa.\t300\tIN\tPTR\tv4only.example.com.",
+			},
+		},
+		{name: "ptr outside of the prefix", question: DnsQuestion{name: reverseName(net.ParseIP("2001:db8::1")), qtype: PTR}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := d.answer(tc.question, upstream[tc.question.name+" "+tc.question.qtype.String()], query)
+			require.NoError(t, err)
+			if tc.answers == nil {
+				assert.Nil(t, response)
+				return
+			}
+			require.NotNil(t, response)
+			answers := []string{}
+			for _, r := range response.answers {
+				answers = append(answers, r.String())
+			}
+			assert.Equal(t, tc.answers, answers)
+		})
+	}
+}
+
+func TestDNS64LookupFailure(t *testing.T) {
+	d, err := NewDNS64(DNS64_DEFAULT_PREFIX)
+	require.NoError(t, err)
+	savedDNS64, savedCache := dns64, cache
+	dns64 = d
+	cache = NewCache()
+	t.Cleanup(func() { dns64, cache = savedDNS64, savedCache })
+	// the question is answered, but the A and PTR lookups of DNS64 fail
+	cache.query = func(name string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+		if qtype == A || strings.HasSuffix(name, ".in-addr.arpa") {
+			return nil, errors.New("upstream unreachable")
+		}
+		packet := NewDnsPacket()
+		packet.authorities = []DnsRecord{{qType: SOA, domain: "example.com", ttl: 300, host: "ns.example.com", mailbox: "admin.example.com", minimum: 300}}
+		return packet, nil
+	}
+
+	testcases := []struct {
+		name     string
+		question DnsQuestion
+		resCode  ResultCode
+		ede      string
+	}{
+		{name: "A lookup", question: DnsQuestion{name: "v4only.example.com", qtype: AAAA}, resCode: NoError},
+		{name: "PTR lookup", question: DnsQuestion{name: reverseName(net.ParseIP("64:ff9b::c000:221")), qtype: PTR}, resCode: Servfail, ede: "Network Error"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := NewDnsPacket()
+			request.header.id = 7
+			request.questions = []DnsQuestion{tc.question}
+			request.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, false)}
+			response, err := buildResponse(request, net.ParseIP("2001:db8::10"), false)
+			require.NoError(t, err)
+			require.NotNil(t, response)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+			assert.Empty(t, response.answers)
+			if tc.ede != "" {
+				assert.Contains(t, describeExtendedErrors(extendedErrors(response)), tc.ede)
+			}
+		})
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// DNSSEC algorithm numbers
+const (
+	RSASHA256       = 8
+	RSASHA512       = 10
+	ECDSAP256SHA256 = 13
+	ECDSAP384SHA384 = 14
+	ED25519         = 15
+)
+
+// DS digest types
+const (
+	DIGEST_SHA1   = 1
+	DIGEST_SHA256 = 2
+	DIGEST_SHA384 = 4
+)
+
+// DNSKEY flags
+const (
+	DNSKEY_ZONE = 0x0100
+	DNSKEY_SEP  = 0x0001
+)
+
+// NSEC3 flag marking an opt-out span
+const NSEC3_OPT_OUT = 0x01
+
+// hash algorithm of NSEC3 records
+const NSEC3_SHA1 = 1
+
+// supportedAlgorithm reports whether signatures of the algorithm can be verified
+func supportedAlgorithm(algorithm uint8) bool {
+	switch algorithm {
+	case RSASHA256, RSASHA512, ECDSAP256SHA256, ECDSAP384SHA384, ED25519:
+		return true
+	}
+	return false
+}
+
+// calculateKeyTag calculates the key tag of a DNSKEY record (RFC 4034 Appendix B)
+func calculateKeyTag(key *DnsRecord) uint16 {
+	rdata, err := canonicalData(key)
+	if err != nil {
+		return 0
+	}
+
+	var ac uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			ac += uint32(b)
+		} else {
+			ac += uint32(b) << 8
+		}
+	}
+	ac += ac >> 16 & 0xFFFF
+	return uint16(ac & 0xFFFF)
+}
+
+// dsDigest calculates the digest of a DNSKEY record as published in a DS record
+func dsDigest(key *DnsRecord, digestType uint8) ([]byte, error) {
+	owner, err := canonicalName(key.domain)
+	if err != nil {
+		return nil, err
+	}
+	rdata, err := canonicalData(key)
+	if err != nil {
+		return nil, err
+	}
+	data := append(owner, rdata...)
+
+	switch digestType {
+	case DIGEST_SHA1:
+		sum := sha1.Sum(data)
+		return sum[:], nil
+	case DIGEST_SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case DIGEST_SHA384:
+		sum := sha512.Sum384(data)
+		return sum[:], nil
+	}
+	return nil, fmt.Errorf("unsupported digest type %d", digestType)
+}
+
+// newDSRecord creates the DS record of a DNSKEY for the parent zone
+func newDSRecord(key *DnsRecord, digestType uint8) (*DnsRecord, error) {
+	digest, err := dsDigest(key, digestType)
+	if err != nil {
+		return nil, err
+	}
+	return &DnsRecord{
+		qType:      DS,
+		domain:     key.domain,
+		ttl:        key.ttl,
+		keyTag:     calculateKeyTag(key),
+		algorithm:  key.algorithm,
+		digestType: digestType,
+		digest:     digest,
+	}, nil
+}
+
+// matchesDS reports whether the DNSKEY record is the one referenced by the DS record
+func matchesDS(key *DnsRecord, ds *DnsRecord) bool {
+	if key.algorithm != ds.algorithm || calculateKeyTag(key) != ds.keyTag || !strings.EqualFold(key.domain, ds.domain) {
+		return false
+	}
+	digest, err := dsDigest(key, ds.digestType)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(digest, ds.digest)
+}
+
+// canonicalName returns the name in canonical wire format (RFC 4034 6.2)
+func canonicalName(name string) ([]byte, error) {
+	buf := NewBytePacketBufferSize(256)
+	if err := buf.writeQName(strings.ToLower(name)); err != nil {
+		return nil, err
+	}
+	return buf.getRange(0, buf.position())
+}
+
+// canonicalData returns the record data in canonical wire format (RFC 4034 6.2)
+func canonicalData(record *DnsRecord) ([]byte, error) {
+	r := *record
+	r.host = strings.ToLower(r.host)
+	r.mailbox = strings.ToLower(r.mailbox)
+	r.signerName = strings.ToLower(r.signerName)
+
+	buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+	if err := r.writeData(buf); err != nil {
+		return nil, err
+	}
+	return buf.getRange(0, buf.position())
+}
+
+// countLabels returns the number of labels of a name, not counting the root
+func countLabels(name string) int {
+	if name == "" {
+		return 0
+	}
+	return len(strings.Split(name, "."))
+}
+
+// parentName strips the first label from the name
+func parentName(name string) string {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return ""
+	}
+	return name[i+1:]
+}
+
+// isSubdomain reports whether the name is equal to or below the zone
+func isSubdomain(name string, zone string) bool {
+	name = strings.ToLower(name)
+	zone = strings.ToLower(zone)
+	return zone == "" || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// compareNames compares two names in canonical DNS name order (RFC 4034 6.1)
+func compareNames(a string, b string) int {
+	la := reverseLabels(a)
+	lb := reverseLabels(b)
+	for i := 0; i < len(la) && i < len(lb); i++ {
+		if c := bytes.Compare([]byte(la[i]), []byte(lb[i])); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+func reverseLabels(name string) []string {
+	if name == "" {
+		return nil
+	}
+	labels := strings.Split(strings.ToLower(name), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return labels
+}
+
+// signatureData builds the data covered by an RRSIG over the RRset (RFC 4034 3.1.8.1)
+func signatureData(sig *DnsRecord, rrset []DnsRecord) ([]byte, error) {
+	buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+	header := *sig
+	header.signerName = strings.ToLower(header.signerName)
+	if err := header.writeRRSIGData(buf); err != nil {
+		return nil, err
+	}
+	data, err := buf.getRange(0, buf.position())
+	if err != nil {
+		return nil, err
+	}
+	data = append([]byte(nil), data...)
+
+	// the owner of a wildcard expansion is signed as the wildcard name
+	owner := strings.ToLower(rrset[0].domain)
+	if labels := strings.Split(owner, "."); owner != "" && len(labels) > int(sig.labels) {
+		owner = "*." + strings.Join(labels[len(labels)-int(sig.labels):], ".")
+		if sig.labels == 0 {
+			owner = "*"
+		}
+	}
+	ownerData, err := canonicalName(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	var rdatas [][]byte
+	for i := range rrset {
+		rdata, err := canonicalData(&rrset[i])
+		if err != nil {
+			return nil, err
+		}
+		rdatas = append(rdatas, rdata)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+
+	for i, rdata := range rdatas {
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, ownerData...)
+		data = append(data, byte(sig.typeCovered>>8), byte(sig.typeCovered), 0, 1)
+		data = append(data, byte(sig.originalTTL>>24), byte(sig.originalTTL>>16), byte(sig.originalTTL>>8), byte(sig.originalTTL))
+		data = append(data, byte(len(rdata)>>8), byte(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data, nil
+}
+
+// publicKey decodes the public key of a DNSKEY record
+func publicKey(key *DnsRecord) (crypto.PublicKey, error) {
+	switch key.algorithm {
+	case RSASHA256, RSASHA512:
+		// RFC 3110: exponent length, exponent, modulus
+		data := key.publicKey
+		if len(data) < 3 {
+			return nil, errors.New("invalid RSA key")
+		}
+		expLen := int(data[0])
+		data = data[1:]
+		if expLen == 0 {
+			expLen = int(data[0])<<8 | int(data[1])
+			data = data[2:]
+		}
+		if expLen > 4 || len(data) <= expLen {
+			return nil, errors.New("invalid RSA key")
+		}
+		exponent := 0
+		for _, b := range data[:expLen] {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(data[expLen:]), E: exponent}, nil
+	case ECDSAP256SHA256, ECDSAP384SHA384:
+		curve := elliptic.P256()
+		if key.algorithm == ECDSAP384SHA384 {
+			curve = elliptic.P384()
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.publicKey) != 2*size {
+			return nil, errors.New("invalid ECDSA key")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.publicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.publicKey[size:]),
+		}, nil
+	case ED25519:
+		if len(key.publicKey) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(key.publicKey), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %d", key.algorithm)
+}
+
+// encodePublicKey encodes a public key as DNSKEY public key data
+func encodePublicKey(pub crypto.PublicKey) ([]byte, uint8, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		exponent := big.NewInt(int64(k.E)).Bytes()
+		data := []byte{byte(len(exponent))}
+		data = append(data, exponent...)
+		return append(data, k.N.Bytes()...), RSASHA256, nil
+	case *ecdsa.PublicKey:
+		size := k.Curve.Params().BitSize / 8
+		data := make([]byte, 2*size)
+		k.X.FillBytes(data[:size])
+		k.Y.FillBytes(data[size:])
+		if size == 48 {
+			return data, ECDSAP384SHA384, nil
+		}
+		return data, ECDSAP256SHA256, nil
+	case ed25519.PublicKey:
+		return []byte(k), ED25519, nil
+	}
+	return nil, 0, errors.New("unsupported key type")
+}
+
+func signatureHash(algorithm uint8) crypto.Hash {
+	switch algorithm {
+	case RSASHA512:
+		return crypto.SHA512
+	case ECDSAP384SHA384:
+		return crypto.SHA384
+	case ED25519:
+		return 0
+	}
+	return crypto.SHA256
+}
+
+// verifySignature verifies the RRSIG over the RRset with the DNSKEY record
+func verifySignature(key *DnsRecord, sig *DnsRecord, rrset []DnsRecord) error {
+	pub, err := publicKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := signatureData(sig, rrset)
+	if err != nil {
+		return err
+	}
+
+	hash := signatureHash(sig.algorithm)
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig.signature)
+	case *ecdsa.PublicKey:
+		size := len(sig.signature) / 2
+		if len(sig.signature) != 2*(k.Curve.Params().BitSize/8) {
+			return errors.New("invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(sig.signature[:size])
+		s := new(big.Int).SetBytes(sig.signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, data, sig.signature) {
+			return errors.New("Ed25519 signature verification failed")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
+
+// signRRset completes the RRSIG header in sig with a signature over the RRset made by the private key
+func signRRset(signer crypto.Signer, sig *DnsRecord, rrset []DnsRecord) error {
+	data, err := signatureData(sig, rrset)
+	if err != nil {
+		return err
+	}
+
+	hash := signatureHash(sig.algorithm)
+	digest := data
+	if hash != 0 {
+		h := hash.New()
+		h.Write(data)
+		digest = h.Sum(nil)
+	}
+
+	signature, err := signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := signer.(*ecdsa.PrivateKey); ok {
+		// convert the ASN.1 signature into the r || s form of RFC 6605
+		var parsed struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &parsed); err != nil {
+			return err
+		}
+		size := signer.Public().(*ecdsa.PublicKey).Curve.Params().BitSize / 8
+		signature = make([]byte, 2*size)
+		parsed.R.FillBytes(signature[:size])
+		parsed.S.FillBytes(signature[size:])
+	}
+
+	sig.signature = signature
+	return nil
+}
+
+// nsec3Hash hashes a name as in NSEC3 owner names (RFC 5155 5)
+func nsec3Hash(name string, salt []byte, iterations uint16) []byte {
+	wire, err := canonicalName(name)
+	if err != nil {
+		return nil
+	}
+	h := sha1.Sum(append(wire, salt...))
+	for i := 0; i < int(iterations); i++ {
+		h = sha1.Sum(append(h[:], salt...))
+	}
+	return h[:]
+}
+
+// nsec3Label returns the hashed owner label of a name in base32hex
+func nsec3Label(name string, salt []byte, iterations uint16) string {
+	return strings.ToLower(base32Hex.EncodeToString(nsec3Hash(name, salt, iterations)))
+}
+
+// hasType reports whether the type is set in the type bitmap of the record
+func hasType(types []QueryType, qtype QueryType) bool {
+	for _, t := range types {
+		if t == qtype {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fixtureZone is a locally signed zone answering queries like an authoritative server
+type fixtureZone struct {
+	origin  string
+	records []DnsRecord
+	nsec3   bool
+}
+
+func generateKey(t *testing.T, algorithm uint8) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	switch algorithm {
+	case RSASHA256:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	case ECDSAP256SHA256:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case ECDSAP384SHA384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case ED25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	}
+	require.NoError(t, err)
+	return key
+}
+
+// newFixtureZone signs the records with a single key of the algorithm, adding the DNSKEY and NSEC or NSEC3 chain
+func newFixtureZone(t *testing.T, origin string, algorithm uint8, nsec3 bool, records []DnsRecord) *fixtureZone {
+	z := &fixtureZone{origin: origin, nsec3: nsec3}
+	records = append(records, DnsRecord{
+		qType: SOA, domain: origin, ttl: 300, host: "ns." + origin, mailbox: "hostmaster." + origin,
+		serial: 1, refresh: 3600, retry: 600, expire: 86400, minimum: 300,
+	})
+	if algorithm == 0 {
+		z.records = records
+		return z
+	}
+
+	signer := generateKey(t, algorithm)
+	publicKey, _, err := encodePublicKey(signer.Public())
+	require.NoError(t, err)
+	dnskey := DnsRecord{qType: DNSKEY, domain: origin, ttl: 300, flags: DNSKEY_ZONE | DNSKEY_SEP, protocol: 3, algorithm: algorithm, publicKey: publicKey}
+	records = append(records, dnskey)
+
+	// owner names of the zone and their types, leaving out the unsigned data below delegations
+	types := map[string][]QueryType{}
+	for _, r := range records {
+		types[r.domain] = append(types[r.domain], r.qType)
+	}
+	var owners []string
+	for owner := range types {
+		owners = append(owners, owner)
+	}
+
+	delegation := func(owner string) bool {
+		return owner != origin && hasType(types[owner], NS)
+	}
+	if nsec3 {
+		hashed := map[string]string{}
+		var optedOut []string
+		for _, owner := range owners {
+			if delegation(owner) && !hasType(types[owner], DS) {
+				optedOut = append(optedOut, nsec3Label(owner, []byte{0xab}, 1))
+				continue
+			}
+			hashed[nsec3Label(owner, []byte{0xab}, 1)] = owner
+		}
+		var hashes []string
+		for h := range hashed {
+			hashes = append(hashes, h)
+		}
+		sort.Strings(hashes)
+		for i, h := range hashes {
+			next := hashes[(i+1)%len(hashes)]
+			nextHashed, _ := base32Hex.DecodeString(strings.ToUpper(next))
+			bitmap := append([]QueryType{}, types[hashed[h]]...)
+			if !delegation(hashed[h]) || hasType(bitmap, DS) {
+				bitmap = append(bitmap, RRSIG)
+			}
+			// only spans hiding an unsigned delegation are flagged opt-out
+			var flags uint16
+			for _, o := range optedOut {
+				if h < o && (o < next || next <= h) || next <= h && o < next {
+					flags = NSEC3_OPT_OUT
+				}
+			}
+			records = append(records, DnsRecord{
+				qType: NSEC3, domain: h + "." + origin, ttl: 300, hashAlgorithm: NSEC3_SHA1, flags: flags,
+				iterations: 1, salt: []byte{0xab}, nextHashed: nextHashed, typeBitMap: bitmap,
+			})
+		}
+	} else {
+		sort.Slice(owners, func(i, j int) bool { return compareNames(owners[i], owners[j]) < 0 })
+		for i, owner := range owners {
+			bitmap := append(append([]QueryType{}, types[owner]...), RRSIG, NSEC)
+			records = append(records, DnsRecord{qType: NSEC, domain: owner, ttl: 300, nextDomain: owners[(i+1)%len(owners)], typeBitMap: bitmap})
+		}
+	}
+
+	rrsets, _ := splitRRsets(records)
+	for _, rrset := range rrsets {
+		if delegation(rrset[0].domain) && rrset[0].qType == NS {
+			continue // delegations are not signed
+		}
+		sig := DnsRecord{
+			qType: RRSIG, domain: rrset[0].domain, ttl: rrset[0].ttl, typeCovered: rrset[0].qType, algorithm: algorithm,
+			labels: uint8(countLabels(rrset[0].domain)), originalTTL: rrset[0].ttl,
+			inception: uint32(time.Now().Add(-time.Hour).Unix()), expiration: uint32(time.Now().Add(time.Hour).Unix()),
+			keyTag: calculateKeyTag(&dnskey), signerName: origin,
+		}
+		if strings.HasPrefix(rrset[0].domain, "*.") {
+			sig.labels--
+		}
+		require.NoError(t, signRRset(signer, &sig, rrset))
+		records = append(records, sig)
+	}
+
+	z.records = records
+	return z
+}
+
+func (z *fixtureZone) dnskey() DnsRecord {
+	for _, r := range z.records {
+		if r.qType == DNSKEY {
+			return r
+		}
+	}
+	return DnsRecord{}
+}
+
+// find returns the records of the name and type, together with the RRSIGs covering them
+func (z *fixtureZone) find(name string, qtype QueryType) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range z.records {
+		if r.domain == name && (r.qType == qtype || r.qType == RRSIG && r.typeCovered == qtype) {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+func (z *fixtureZone) exists(name string) bool {
+	for _, r := range z.records {
+		if r.domain == name && r.qType != NSEC3 && r.qType != RRSIG {
+			return true
+		}
+	}
+	return false
+}
+
+func (z *fixtureZone) answer(name string, qtype QueryType) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{response: true, authoritativeAnswer: true}
+	packet.questions = []DnsQuestion{{name: name, qtype: qtype}}
+	if answers := z.find(name, qtype); len(answers) > 0 {
+		packet.answers = answers
+		return packet
+	}
+
+	// synthesize from a wildcard
+	wildcard := "*." + parentName(name)
+	if !z.exists(name) && len(z.find(wildcard, qtype)) > 0 {
+		for _, r := range z.find(wildcard, qtype) {
+			r.domain = name
+			packet.answers = append(packet.answers, r)
+		}
+		packet.authorities = z.coveringProofs(name)
+		return packet
+	}
+
+	packet.authorities = z.find(z.origin, SOA)
+	if z.exists(name) {
+		if z.nsec3 {
+			matching := z.matchingNSEC3(name)
+			if len(matching) == 0 {
+				packet.authorities = append(packet.authorities, z.matchingNSEC3(z.origin)...)
+				packet.authorities = append(packet.authorities, z.coveringProofs(name)...)
+			}
+			packet.authorities = append(packet.authorities, matching...)
+		} else {
+			packet.authorities = append(packet.authorities, z.find(name, NSEC)...)
+		}
+		return packet
+	}
+
+	packet.header.resCode = NxDomain
+	packet.authorities = append(packet.authorities, z.coveringProofs(name)...)
+	if !z.nsec3 {
+		packet.authorities = append(packet.authorities, z.coveringProofs("*."+z.origin)...)
+	} else {
+		packet.authorities = append(packet.authorities, z.matchingNSEC3(z.origin)...)
+		packet.authorities = append(packet.authorities, z.coveringProofs("*."+z.origin)...)
+	}
+	return packet
+}
+
+// coveringProofs returns the NSEC or NSEC3 record covering the name, or its next closer name, with its RRSIG
+func (z *fixtureZone) coveringProofs(name string) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range z.records {
+		if r.qType == NSEC && nsecCovers(&r, name) || r.qType == NSEC3 && nsec3Covers(&r, nextCloserName(name, z.origin)) {
+			res = append(res, r)
+			res = append(res, z.find(r.domain, r.qType)[1:]...)
+		}
+	}
+	return res
+}
+
+func (z *fixtureZone) matchingNSEC3(name string) []DnsRecord {
+	for _, r := range z.records {
+		if r.qType == NSEC3 && nsec3Matches(&r, name) {
+			return z.find(r.domain, NSEC3)
+		}
+	}
+	return nil
+}
+
+func nextCloserName(name string, zone string) string {
+	labels := strings.Split(name, ".")
+	return strings.Join(labels[len(labels)-countLabels(zone)-1:], ".")
+}
+
+// fixtureQuery routes queries to the closest fixture zone, sending DS queries to the parent side
+func fixtureQuery(zones []*fixtureZone) func(string, QueryType) (*DnsPacket, error) {
+	return func(name string, qtype QueryType) (*DnsPacket, error) {
+		var closest *fixtureZone
+		for _, z := range zones {
+			if !isSubdomain(name, z.origin) || (qtype == DS && name == z.origin) {
+				continue
+			}
+			if closest == nil || countLabels(z.origin) > countLabels(closest.origin) {
+				closest = z
+			}
+		}
+		return closest.answer(name, qtype), nil
+	}
+}
+
+func TestValidator(t *testing.T) {
+	example := newFixtureZone(t, "example.test", RSASHA256, false, []DnsRecord{
+		{qType: A, domain: "www.example.test", ttl: 300, addr: "192.0.2.1"},
+		{qType: A, domain: "*.wild.example.test", ttl: 300, addr: "192.0.2.2"},
+	})
+	ed := newFixtureZone(t, "ed.test", ED25519, false, []DnsRecord{
+		{qType: AAAA, domain: "www.ed.test", ttl: 300, addr: "2001:db8::1"},
+	})
+	nsec3 := newFixtureZone(t, "nsec3.test", ECDSAP384SHA384, true, []DnsRecord{
+		{qType: A, domain: "www.nsec3.test", ttl: 300, addr: "192.0.2.3"},
+		{qType: NS, domain: "unsigned.nsec3.test", ttl: 300, host: "ns.unsigned.nsec3.test"},
+	})
+	insecure := newFixtureZone(t, "insecure.test", 0, false, []DnsRecord{
+		{qType: A, domain: "www.insecure.test", ttl: 300, addr: "192.0.2.4"},
+	})
+	unsigned := newFixtureZone(t, "unsigned.nsec3.test", 0, false, []DnsRecord{
+		{qType: A, domain: "www.unsigned.nsec3.test", ttl: 300, addr: "192.0.2.5"},
+	})
+
+	var delegations []DnsRecord
+	for _, child := range []*fixtureZone{example, ed, nsec3, insecure} {
+		delegations = append(delegations, DnsRecord{qType: NS, domain: child.origin, ttl: 300, host: "ns." + child.origin})
+		if key := child.dnskey(); key.qType == DNSKEY {
+			ds, err := newDSRecord(&key, DIGEST_SHA256)
+			require.NoError(t, err)
+			delegations = append(delegations, *ds)
+		}
+	}
+	delegations = append(delegations, DnsRecord{qType: A, domain: "www.test", ttl: 300, addr: "192.0.2.6"})
+	parent := newFixtureZone(t, "test", ECDSAP256SHA256, false, delegations)
+	zones := []*fixtureZone{parent, example, ed, nsec3, insecure, unsigned}
+
+	anchor, err := newDSRecord(&[]DnsRecord{parent.dnskey()}[0], DIGEST_SHA256)
+	require.NoError(t, err)
+
+	tamper := func(p *DnsPacket) *DnsPacket {
+		p.answers[0].addr = "198.51.100.1"
+		return p
+	}
+	removeProofs := func(p *DnsPacket) *DnsPacket {
+		p.authorities = p.authorities[:2]
+		return p
+	}
+
+	testcases := []struct {
+		name     string
+		question DnsQuestion
+		modify   func(*DnsPacket) *DnsPacket
+		now      time.Time
+		expected ValidationResult
+	}{
+		{name: "secure ECDSA P-256 answer", question: DnsQuestion{name: "www.test", qtype: A}, expected: Secure},
+		{name: "secure RSA answer", question: DnsQuestion{name: "www.example.test", qtype: A}, expected: Secure},
+		{name: "secure Ed25519 answer", question: DnsQuestion{name: "www.ed.test", qtype: AAAA}, expected: Secure},
+		{name: "secure ECDSA P-384 answer", question: DnsQuestion{name: "www.nsec3.test", qtype: A}, expected: Secure},
+		{name: "tampered answer", question: DnsQuestion{name: "www.example.test", qtype: A}, modify: tamper, expected: Bogus},
+		{name: "expired signature", question: DnsQuestion{name: "www.example.test", qtype: A}, now: time.Now().Add(2 * time.Hour), expected: Bogus},
+		{name: "wildcard answer", question: DnsQuestion{name: "foo.wild.example.test", qtype: A}, expected: Secure},
+		{name: "nsec nxdomain", question: DnsQuestion{name: "missing.example.test", qtype: A}, expected: Secure},
+		{name: "nsec nxdomain without proof", question: DnsQuestion{name: "missing.example.test", qtype: A}, modify: removeProofs, expected: Bogus},
+		{name: "nsec nodata", question: DnsQuestion{name: "www.example.test", qtype: MX}, expected: Secure},
+		{name: "nsec3 nxdomain", question: DnsQuestion{name: "nothing.nsec3.test", qtype: A}, expected: Secure},
+		{name: "nsec3 nxdomain in opt-out span", question: DnsQuestion{name: "missing.nsec3.test", qtype: A}, expected: Insecure},
+		{name: "nsec3 nodata", question: DnsQuestion{name: "www.nsec3.test", qtype: AAAA}, expected: Secure},
+		{name: "insecure delegation", question: DnsQuestion{name: "www.insecure.test", qtype: A}, expected: Insecure},
+		{name: "nsec3 opt-out delegation", question: DnsQuestion{name: "www.unsigned.nsec3.test", qtype: A}, expected: Insecure},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := fixtureQuery(zones)
+			validator := NewValidator([]DnsRecord{*anchor}, query)
+			if !tc.now.IsZero() {
+				validator.now = func() time.Time { return tc.now }
+			}
+
+			response, err := query(tc.question.name, tc.question.qtype)
+			require.NoError(t, err)
+			if tc.modify != nil {
+				response = tc.modify(response)
+			}
+
+			result, reason := validator.validate(tc.question, response)
+			assert.Equal(t, tc.expected, result, reason)
+		})
+	}
+
+	t.Run("ds cache", func(t *testing.T) {
+		dsQueries := 0
+		query := fixtureQuery(zones)
+		validator := NewValidator([]DnsRecord{*anchor}, func(name string, qtype QueryType) (*DnsPacket, error) {
+			if qtype == DS {
+				dsQueries++
+			}
+			return query(name, qtype)
+		})
+
+		for _, question := range []DnsQuestion{{name: "www.insecure.test", qtype: A}, {name: "www.example.test", qtype: A}} {
+			response, err := query(question.name, question.qtype)
+			require.NoError(t, err)
+			result, reason := validator.validate(question, response)
+			assert.NotEqual(t, Bogus, result, reason)
+
+			queries := dsQueries
+			assert.Greater(t, queries, 0)
+			result, reason = validator.validate(question, response)
+			assert.NotEqual(t, Bogus, result, reason)
+			assert.Equal(t, queries, dsQueries, question.name)
+			dsQueries = 0
+		}
+
+		validator.now = func() time.Time { return time.Now().Add(2 * MAX_KEY_CACHE_TIME) }
+		response, err := query("www.insecure.test", A)
+		require.NoError(t, err)
+		validator.validate(DnsQuestion{name: "www.insecure.test", qtype: A}, response)
+		assert.Greater(t, dsQueries, 0)
+	})
+}
+
+// writeKeyFiles writes a key pair as BIND style key files, returning their file name prefix
+func writeKeyFiles(t *testing.T, dir string, origin string, flags uint16, key crypto.Signer) string {
+	publicKey, algorithm, err := encodePublicKey(key.Public())
+	require.NoError(t, err)
+	dnskey := DnsRecord{qType: DNSKEY, domain: origin, ttl: 3600, flags: flags, protocol: 3, algorithm: algorithm, publicKey: publicKey}
+
+	var private []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		private = k.D.FillBytes(make([]byte, 32))
+	case ed25519.PrivateKey:
+		private = k.Seed()
+	}
+
+	prefix := filepath.Join(dir, fmt.Sprintf("K%s.+%03d+%05d", fqdn(origin), algorithm, calculateKeyTag(&dnskey)))
+	require.NoError(t, os.WriteFile(prefix+".key", []byte("; key file\n"+dnskey.String()+"\n"), 0644))
+	require.NoError(t, os.WriteFile(prefix+".private", []byte(fmt.Sprintf(
+		"Private-key-format: v1.3\nAlgorithm: %d\nPrivateKey: %s\n", algorithm, base64.StdEncoding.EncodeToString(private))), 0600))
+	return prefix
+}
+
+func TestZoneSigning(t *testing.T) {
+	zoneFile := `$ORIGIN example.com.
+$TTL 300
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		3600 600 86400 300 )
+	IN	NS	ns1
+ns1	IN	A	192.0.2.53
+www	IN	A	192.0.2.1
+	IN	AAAA	2001:db8::1
+a.b	IN	A	192.0.2.2 ; b.example.com is an empty non-terminal
+*.wild	IN	A	192.0.2.3
+alias	IN	CNAME	www
+sub	IN	NS	ns.sub
+ns.sub	IN	A	192.0.2.54
+`
+	dir := t.TempDir()
+	kskPrefix := writeKeyFiles(t, dir, "example.com", DNSKEY_ZONE|DNSKEY_SEP, generateKey(t, ECDSAP256SHA256))
+	zskPrefix := writeKeyFiles(t, dir, "example.com", DNSKEY_ZONE, generateKey(t, ED25519))
+	ksk, err := loadSigningKey(kskPrefix)
+	require.NoError(t, err)
+	zsk, err := loadSigningKey(zskPrefix)
+	require.NoError(t, err)
+
+	questions := []struct {
+		question DnsQuestion
+		resCode  ResultCode
+	}{
+		{question: DnsQuestion{name: "www.example.com", qtype: A}, resCode: NoError},
+		{question: DnsQuestion{name: "example.com", qtype: DNSKEY}, resCode: NoError},
+		{question: DnsQuestion{name: "www.example.com", qtype: MX}, resCode: NoError},
+		{question: DnsQuestion{name: "b.example.com", qtype: A}, resCode: NoError},
+		{question: DnsQuestion{name: "missing.example.com", qtype: A}, resCode: NxDomain},
+		{question: DnsQuestion{name: "deep.missing.example.com", qtype: A}, resCode: NxDomain},
+		{question: DnsQuestion{name: "host.wild.example.com", qtype: A}, resCode: NoError},
+		{question: DnsQuestion{name: "host.wild.example.com", qtype: MX}, resCode: NoError},
+		{question: DnsQuestion{name: "alias.example.com", qtype: AAAA}, resCode: NoError},
+		{question: DnsQuestion{name: "sub.example.com", qtype: DS}, resCode: NoError},
+	}
+
+	for _, nsec3 := range []bool{false, true} {
+		records, err := parseZoneFile(strings.NewReader(zoneFile), "")
+		require.NoError(t, err)
+		zone, err := NewZone("example.com", records)
+		require.NoError(t, err)
+
+		signer, err := NewZoneSigner([]*SigningKey{ksk}, []*SigningKey{zsk})
+		require.NoError(t, err)
+		signer.nsec3 = nsec3
+		signer.salt = []byte{0xca, 0xfe}
+		signer.iterations = 2
+		zone.enableSigning(signer)
+
+		validator := NewValidator(zone.dsRecords(), func(name string, qtype QueryType) (*DnsPacket, error) {
+			return zone.answer(name, qtype, true), nil
+		})
+
+		for _, q := range questions {
+			t.Run(fmt.Sprintf("nsec3 %v %s %s", nsec3, q.question.name, q.question.qtype), func(t *testing.T) {
+				response := zone.answer(q.question.name, q.question.qtype, true)
+				assert.Equal(t, q.resCode, response.header.resCode)
+
+				result, reason := validator.validate(q.question, response)
+				assert.Equal(t, Secure, result, reason)
+			})
+		}
+	}
+
+	t.Run("signature cache", func(t *testing.T) {
+		records, err := parseZoneFile(strings.NewReader(zoneFile), "")
+		require.NoError(t, err)
+		zone, err := NewZone("example.com", records)
+		require.NoError(t, err)
+		signer, err := NewZoneSigner([]*SigningKey{ksk}, nil)
+		require.NoError(t, err)
+		zone.enableSigning(signer)
+
+		// ECDSA signatures are randomized, so equal signatures come from the cache
+		first := zone.answer("www.example.com", A, true)
+		second := zone.answer("www.example.com", A, true)
+		assert.Equal(t, first.answers[1].signature, second.answers[1].signature)
+
+		signer.now = func() time.Time { return time.Now().Add(DEFAULT_SIGNATURE_VALIDITY - DEFAULT_SIGNATURE_REFRESH) }
+		refreshed := zone.answer("www.example.com", A, true)
+		assert.NotEqual(t, first.answers[1].signature, refreshed.answers[1].signature)
+		assert.Greater(t, refreshed.answers[1].expiration, first.answers[1].expiration)
+	})
+
+	t.Run("unusable key", func(t *testing.T) {
+		records, err := parseZoneFile(strings.NewReader(zoneFile), "")
+		require.NoError(t, err)
+		zone, err := NewZone("example.com", records)
+		require.NoError(t, err)
+		broken := &SigningKey{dnskey: zsk.dnskey, signer: failingSigner{zsk.signer}}
+		signer, err := NewZoneSigner([]*SigningKey{ksk}, []*SigningKey{broken})
+		require.NoError(t, err)
+		zone.enableSigning(signer)
+
+		// signed answers fail instead of being served without their signatures
+		assert.Equal(t, Servfail, zone.answer("www.example.com", A, true).header.resCode)
+		assert.Equal(t, Servfail, zone.answer("missing.example.com", A, true).header.resCode)
+		assert.Equal(t, NoError, zone.answer("www.example.com", A, false).header.resCode)
+		_, err = zone.transferRecords()
+		assert.Error(t, err)
+	})
+}
+
+// failingSigner is a key whose signing operations fail
+type failingSigner struct {
+	crypto.Signer
+}
+
+func (failingSigner) Sign(io.Reader, []byte, crypto.SignerOpts) ([]byte, error) {
+	return nil, errors.New("key unavailable")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// EDNS option code of extended DNS errors (RFC 8914)
+const EDNS_EDE = 15
+
+// ExtendedErrorCode is the info code of an extended DNS error
+type ExtendedErrorCode uint16
+
+const (
+	EDEOther                ExtendedErrorCode = 0
+	EDEStaleAnswer          ExtendedErrorCode = 3
+	EDEForgedAnswer         ExtendedErrorCode = 4
+	EDEDNSSECBogus          ExtendedErrorCode = 6
+	EDEBlocked              ExtendedErrorCode = 15
+	EDEFiltered             ExtendedErrorCode = 17
+	EDEProhibited           ExtendedErrorCode = 18
+	EDEStaleNxDomainAnswer  ExtendedErrorCode = 19
+	EDENotSupported         ExtendedErrorCode = 21
+	EDENoReachableAuthority ExtendedErrorCode = 22
+	EDENetworkError         ExtendedErrorCode = 23
+)
+
+var extendedErrorNames = []string{
+	"Other", "Unsupported DNSKEY Algorithm", "Unsupported DS Digest Type", "Stale Answer", "Forged Answer",
+	"DNSSEC Indeterminate", "DNSSEC Bogus", "Signature Expired", "Signature Not Yet Valid", "DNSKEY Missing",
+	"RRSIGs Missing", "No Zone Key Bit Set", "NSEC Missing", "Cached Error", "Not Ready", "Blocked", "Censored",
+	"Filtered", "Prohibited", "Stale NXDOMAIN Answer", "Not Authoritative", "Not Supported",
+	"No Reachable Authority", "Network Error", "Invalid Data",
+}
+
+func (c ExtendedErrorCode) String() string {
+	if int(c) < len(extendedErrorNames) {
+		return extendedErrorNames[c]
+	}
+	return fmt.Sprintf("EDE%d", uint16(c))
+}
+
+// newExtendedError returns the EDNS option of an extended DNS error with an explanation for operators
+func newExtendedError(code ExtendedErrorCode, text string) EdnsOption {
+	return EdnsOption{code: EDNS_EDE, data: append(binary.BigEndian.AppendUint16(nil, uint16(code)), text...)}
+}
+
+// extendedErrors returns the extended DNS error options of the packet
+func extendedErrors(packet *DnsPacket) []EdnsOption {
+	opt := packet.edns()
+	if opt == nil {
+		return nil
+	}
+	var options []EdnsOption
+	for _, o := range opt.options {
+		if o.code == EDNS_EDE && len(o.data) >= 2 {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// describeExtendedErrors returns the extended DNS errors like "Blocked (ads.example.com)"
+func describeExtendedErrors(options []EdnsOption) string {
+	var descriptions []string
+	for _, o := range options {
+		description := ExtendedErrorCode(binary.BigEndian.Uint16(o.data)).String()
+		if text := string(o.data[2:]); text != "" {
+			description += " (" + text + ")"
+		}
+		descriptions = append(descriptions, description)
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// lookupError returns the SERVFAIL answer of a failed lookup, explained by an extended DNS error
+func lookupError(err error) (*DnsPacket, EdnsOption) {
+	packet := NewDnsPacket()
+	packet.header.resCode = Servfail
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return packet, newExtendedError(EDENoReachableAuthority, err.Error())
+	}
+	return packet, newExtendedError(EDENetworkError, err.Error())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendedErrors(t *testing.T) {
+	savedBlocklist, savedForwarder, savedACLs := blocklist, forwarder, acls
+	blocklist = NewBlocklist()
+	blocklist.blocked.add("ads.example.com")
+	forwarder = NewForwarder()
+	unreachable := NewForwardRule("unreachable.example", []string{"127.0.0.1:1"})
+	unreachable.timeout = 100 * time.Millisecond
+	forwarder.add(unreachable)
+	var err error
+	acls, err = (&ACLConfig{Recursion: []ACLRuleConfig{
+		{Networks: []string{"192.0.2.0/24"}, Action: "allow"},
+		{Networks: []string{"198.51.100.0/24"}, Action: "deny"},
+	}}).newACLs()
+	require.NoError(t, err)
+	t.Cleanup(func() { blocklist, forwarder, acls = savedBlocklist, savedForwarder, savedACLs })
+
+	testcases := []struct {
+		name    string
+		qname   string
+		client  string
+		resCode ResultCode
+		ede     string
+	}{
+		{name: "blocked", qname: "tracker.ads.example.com", client: "192.0.2.1", resCode: NxDomain, ede: "Blocked (blocklist)"},
+		{name: "prohibited", qname: "www.example.com", client: "198.51.100.1", resCode: Refused, ede: "Prohibited"},
+		{name: "unreachable upstream", qname: "www.unreachable.example", client: "192.0.2.1", resCode: Servfail, ede: "Network Error"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := NewDnsPacket()
+			request.questions = []DnsQuestion{{name: tc.qname, qtype: A}}
+			request.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, false)}
+
+			response, err := buildResponse(request, net.ParseIP(tc.client), false)
+			require.NoError(t, err)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+			assert.Contains(t, describeExtendedErrors(extendedErrors(response)), tc.ede)
+
+			// clients without EDNS get no extended errors
+			request.resources = nil
+			response, err = buildResponse(request, net.ParseIP(tc.client), false)
+			require.NoError(t, err)
+			assert.Nil(t, response.edns())
+		})
+	}
+
+	assert.Equal(t, "DNSSEC Bogus (no signature), EDE4000", describeExtendedErrors([]EdnsOption{
+		newExtendedError(EDEDNSSECBogus, "no signature"),
+		newExtendedError(4000, ""),
+	}))
+}
@@ -0,0 +1,89 @@
+package main
+
+// Size of the udp payload advertised in our OPT records
+const EDNS_BUFFER_SIZE = 4096
+
+// DO bit in the flags part of the OPT ttl
+const EDNS_DNSSEC_OK = 0x8000
+
+// EdnsOption is a single option carried in the OPT record data
+type EdnsOption struct {
+	code uint16
+	data []byte
+}
+
+// newOptRecord creates an OPT record advertising the udp payload size and the DO bit
+func newOptRecord(udpSize uint16, dnssecOK bool) DnsRecord {
+	opt := DnsRecord{qType: OPT, udpSize: udpSize}
+	if dnssecOK {
+		opt.ttl |= EDNS_DNSSEC_OK
+	}
+	return opt
+}
+
+// dnssecOK reports whether the DO bit is set in an OPT record
+func (d *DnsRecord) dnssecOK() bool {
+	return d.ttl&EDNS_DNSSEC_OK != 0
+}
+
+// edns returns the OPT record of the packet, or nil if the packet has none
+func (d *DnsPacket) edns() *DnsRecord {
+	for i := range d.resources {
+		if d.resources[i].qType == OPT {
+			return &d.resources[i]
+		}
+	}
+	return nil
+}
+
+// extendedResCode returns the result code of the packet, with the upper bits of its OPT record
+func (d *DnsPacket) extendedResCode() ResultCode {
+	resCode := d.header.resCode
+	if opt := d.edns(); opt != nil {
+		resCode |= ResultCode(opt.ttl>>24) << 4
+	}
+	return resCode
+}
+
+// setExtendedResCode sets the result code of a packet with an OPT record, the upper bits going into the OPT record
+func (d *DnsPacket) setExtendedResCode(resCode ResultCode) {
+	d.header.resCode = resCode & 0x0F
+	if opt := d.edns(); opt != nil {
+		opt.ttl = opt.ttl&0x00FFFFFF | uint32(resCode>>4)<<24
+	}
+}
+
+func readEdnsOptions(buf *BytePacketBuffer, end uint) ([]EdnsOption, error) {
+	var options []EdnsOption
+	for buf.position() < end {
+		code, err := buf.read2Byte()
+		if err != nil {
+			return nil, err
+		}
+		length, err := buf.read2Byte()
+		if err != nil {
+			return nil, err
+		}
+		data, err := buf.readRange(uint(length))
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, EdnsOption{code: code, data: data})
+	}
+	return options, nil
+}
+
+func writeEdnsOptions(buf *BytePacketBuffer, options []EdnsOption) error {
+	for _, o := range options {
+		if err := buf.write2Byte(o.code); err != nil {
+			return err
+		}
+		if err := buf.write2Byte(uint16(len(o.data))); err != nil {
+			return err
+		}
+		if err := buf.writeRange(o.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Upstream servers of the default forwarding rule
+var DEFAULT_UPSTREAMS = []string{"8.8.8.8:53"}
+
+// Time allowed for each upstream server to answer a query
+const DEFAULT_FORWARD_TIMEOUT = 2 * time.Second
+
+// ForwardRule sends the queries for a domain and its subdomains to a set of upstream servers
+type ForwardRule struct {
+	domain    string   // lower case domain, empty for the default rule
+	upstreams []string // addresses as host:port, tried in order until one answers
+	tcp       bool     // query over tcp instead of udp
+	timeout   time.Duration
+}
+
+// NewForwardRule creates a new ForwardRule sending the queries over udp
+func NewForwardRule(domain string, upstreams []string) *ForwardRule {
+	rule := &ForwardRule{domain: strings.ToLower(strings.TrimSuffix(domain, ".")), timeout: DEFAULT_FORWARD_TIMEOUT}
+	for _, addr := range upstreams {
+		rule.upstreams = append(rule.upstreams, hostPort(addr))
+	}
+	return rule
+}
+
+// Forwarder selects the forwarding rule of the longest domain suffix of a name
+type Forwarder struct {
+	rules map[string]*ForwardRule
+}
+
+// NewForwarder creates a new Forwarder sending all queries to the default upstreams
+func NewForwarder() *Forwarder {
+	return &Forwarder{rules: map[string]*ForwardRule{"": NewForwardRule("", DEFAULT_UPSTREAMS)}}
+}
+
+// add adds the rule, replacing the rule of the same domain
+func (f *Forwarder) add(rule *ForwardRule) {
+	f.rules[rule.domain] = rule
+}
+
+// rule returns the rule of the longest domain suffix of the name
+func (f *Forwarder) rule(name string) *ForwardRule {
+	for n := strings.ToLower(strings.TrimSuffix(name, ".")); ; n = parentName(n) {
+		if rule, ok := f.rules[n]; ok {
+			return rule
+		}
+		if n == "" {
+			return nil
+		}
+	}
+}
+
+// exchange sends the request to the upstream servers in order and returns the first answer
+func (r *ForwardRule) exchange(request *DnsPacket) (*DnsPacket, error) {
+	err := errors.New("no upstream servers")
+	for _, addr := range r.upstreams {
+		var response *DnsPacket
+		response, err = r.query(addr, request)
+		if err == nil && response.extendedResCode() == BadCookie {
+			// retried once with the server cookie of the response (RFC 7873 5.3)
+			response, err = r.query(addr, request)
+		}
+		if err == nil {
+			return response, nil
+		}
+	}
+	return nil, fmt.Errorf("forwarding %s: %w", request.questions[0].name, err)
+}
+
+// query sends the request with our cookies for the upstream server and returns its answer
+func (r *ForwardRule) query(addr string, request *DnsPacket) (*DnsPacket, error) {
+	upstreamCookies.add(addr, request)
+	buf := NewBytePacketBuffer()
+	if err := request.write(buf); err != nil {
+		return nil, err
+	}
+	data := buf.buf[:buf.position()]
+
+	var response *DnsPacket
+	var err error
+	if !r.tcp {
+		response, err = exchangeUDP(addr, data, request.header.id, r.timeout)
+	}
+	// truncated answers are retried over tcp
+	if r.tcp || (err == nil && response.header.truncatedMessage) {
+		response, err = exchangeTCPQuery(addr, data, request.header.id, r.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := upstreamCookies.update(addr, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// exchangeUDP sends the query to the server and reads its response, ignoring responses with other ids
+func exchangeUDP(addr string, data []byte, id uint16, timeout time.Duration) (*DnsPacket, error) {
+	conn, err := net.DialTimeout("udp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(data); err != nil {
+		return nil, err
+	}
+	for {
+		responseBuf := NewBytePacketBufferSize(EDNS_BUFFER_SIZE)
+		if _, err := conn.Read(responseBuf.buf); err != nil {
+			return nil, err
+		}
+		response := NewDnsPacket()
+		if err := response.fromBuffer(responseBuf); err != nil || response.header.id != id {
+			continue
+		}
+		return response, nil
+	}
+}
+
+// exchangeTCPQuery sends the query to the server over tcp and reads its response
+func exchangeTCPQuery(addr string, data []byte, id uint16, timeout time.Duration) (*DnsPacket, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeMessage(conn, data); err != nil {
+		return nil, err
+	}
+	responseBuf, err := readMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	response := NewDnsPacket()
+	if err := response.fromBuffer(responseBuf); err != nil {
+		return nil, err
+	}
+	if response.header.id != id {
+		return nil, errors.New("response id does not match the request")
+	}
+	return response, nil
+}
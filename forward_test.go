@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testUpstream answers A questions with its address over udp and tcp on the same port,
+// sending truncated udp answers when truncate is set
+type testUpstream struct {
+	addr     string
+	answer   string
+	truncate bool
+
+	mu         sync.Mutex
+	transports []string
+}
+
+func (u *testUpstream) serve(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	u.addr = listener.Addr().String()
+	conn, err := net.ListenPacket("udp", u.addr)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	respond := func(data []byte, transport string) []byte {
+		buf := NewBytePacketBuffer()
+		copy(buf.buf, data)
+		request := NewDnsPacket()
+		if err := request.fromBuffer(buf); err != nil {
+			return nil
+		}
+		u.mu.Lock()
+		u.transports = append(u.transports, transport)
+		u.mu.Unlock()
+
+		response := NewDnsPacket()
+		response.header = DnsHeader{id: request.header.id, response: true}
+		response.questions = request.questions
+		if transport == "udp" && u.truncate {
+			response.header.truncatedMessage = true
+		} else {
+			response.answers = []DnsRecord{{qType: A, domain: request.questions[0].name, ttl: 60, addr: u.answer}}
+		}
+		out := NewBytePacketBuffer()
+		response.write(out)
+		return out.buf[:out.position()]
+	}
+
+	go func() {
+		for {
+			buf := make([]byte, MAX_PACKET_SIZE)
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(respond(buf[:n], "udp"), addr)
+		}
+	}()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			buf, err := readMessage(c)
+			if err == nil {
+				writeMessage(c, respond(buf.buf, "tcp"))
+			}
+			c.Close()
+		}
+	}()
+}
+
+func TestForwarding(t *testing.T) {
+	corp := &testUpstream{answer: "10.0.0.1"}
+	corp.serve(t)
+	dev := &testUpstream{answer: "10.0.0.2", truncate: true}
+	dev.serve(t)
+	consul := &testUpstream{answer: "10.0.0.3"}
+	consul.serve(t)
+	fallback := &testUpstream{answer: "192.0.2.1"}
+	fallback.serve(t)
+
+	// a closed port refuses the queries, so the next upstream is tried
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedAddr := closed.LocalAddr().String()
+	closed.Close()
+
+	saved := forwarder
+	forwarder = NewForwarder()
+	t.Cleanup(func() { forwarder = saved })
+	for _, fc := range []ForwardConfig{
+		{Domain: "corp.internal", Upstreams: []string{closedAddr, corp.addr}},
+		{Domain: "dev.corp.internal.", Upstreams: []string{dev.addr}},
+		{Domain: "consul", Upstreams: []string{consul.addr}, Transport: "tcp", Timeout: Duration{time.Second}},
+		{Domain: ".", Upstreams: []string{fallback.addr}},
+	} {
+		rule, err := fc.newForwardRule()
+		require.NoError(t, err)
+		forwarder.add(rule)
+	}
+
+	testcases := []struct {
+		name       string
+		domain     string
+		upstream   *testUpstream
+		transports []string
+	}{
+		{name: "suffix", domain: "host.corp.internal", upstream: corp, transports: []string{"udp"}},
+		{name: "longest suffix", domain: "host.dev.corp.internal", upstream: dev, transports: []string{"udp", "tcp"}},
+		{name: "tcp", domain: "web.service.consul", upstream: consul, transports: []string{"tcp"}},
+		{name: "default", domain: "www.example.com", upstream: fallback, transports: []string{"udp"}},
+		{name: "partial label", domain: "notconsul", upstream: fallback, transports: []string{"udp"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.upstream.mu.Lock()
+			tc.upstream.transports = nil
+			tc.upstream.mu.Unlock()
+
+			response, err := lookup(tc.domain, A, false)
+			require.NoError(t, err)
+			require.Len(t, response.answers, 1)
+			assert.Equal(t, tc.upstream.answer, response.answers[0].addr)
+			tc.upstream.mu.Lock()
+			defer tc.upstream.mu.Unlock()
+			assert.Equal(t, tc.transports, tc.upstream.transports)
+		})
+	}
+
+	_, err = (&ForwardConfig{Domain: "example.com"}).newForwardRule()
+	assert.Error(t, err)
+	_, err = (&ForwardConfig{Domain: "example.com", Upstreams: []string{"127.0.0.1"}, Transport: "quic"}).newForwardRule()
+	assert.Error(t, err)
+}
@@ -1,5 +1,12 @@
 package main
 
+// Opcodes of the header
+const (
+	OPCODE_QUERY  uint8 = 0
+	OPCODE_NOTIFY uint8 = 4
+	OPCODE_UPDATE uint8 = 5
+)
+
 type DnsHeader struct {
 	id                  uint16 // identification number
 	recursionDesired    bool
@@ -87,7 +94,7 @@ func (d *DnsHeader) write(buf *BytePacketBuffer) error {
 		return err
 	}
 
-	flags = (uint8(d.resCode)) | (b2i(d.checkingDisabled) << 4) | (b2i(d.authedData) << 5) | (b2i(d.z) << 6) | (b2i(d.recursionAvailable) >> 7)
+	flags = (uint8(d.resCode)) | (b2i(d.checkingDisabled) << 4) | (b2i(d.authedData) << 5) | (b2i(d.z) << 6) | (b2i(d.recursionAvailable) << 7)
 	if err := buf.write(flags); err != nil {
 		return err
 	}
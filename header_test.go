@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	testcases := []struct {
+		name   string
+		header DnsHeader
+	}{
+		{name: "query", header: DnsHeader{id: 1, recursionDesired: true, questions: 1}},
+		{name: "recursion available", header: DnsHeader{id: 2, response: true, recursionDesired: true, recursionAvailable: true, questions: 1, answers: 2}},
+		{
+			name: "all flags",
+			header: DnsHeader{
+				id: 0xffff, recursionDesired: true, truncatedMessage: true, authoritativeAnswer: true, opcode: 5, response: true,
+				resCode: Refused, checkingDisabled: true, authedData: true, z: true, recursionAvailable: true,
+				questions: 1, answers: 2, authoritativeEntries: 3, resourceEntries: 4,
+			},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := NewBytePacketBuffer()
+			require.NoError(t, tc.header.write(buf))
+			assert.Equal(t, uint(12), buf.position())
+
+			buf.pos = 0
+			var header DnsHeader
+			require.NoError(t, header.read(buf))
+			assert.Equal(t, tc.header, header)
+		})
+	}
+}
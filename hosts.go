@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time to live of the records answered from hosts files
+const HOSTS_TTL = 60
+
+// Interval of the checks of the hosts files for changes
+const HOSTS_POLL_INTERVAL = 5 * time.Second
+
+// Hosts answers A, AAAA and PTR questions from hosts files, reloading them when they change on disk
+type Hosts struct {
+	paths []string
+
+	mu       sync.RWMutex
+	addrs    map[string][]net.IP // addresses by lower case name
+	names    map[string]string   // canonical names by reverse lookup name
+	modTimes []time.Time         // modification times of the loaded files
+}
+
+// NewHosts creates a new Hosts for the files at the paths, which are read by load
+func NewHosts(paths []string) *Hosts {
+	return &Hosts{paths: paths, addrs: map[string][]net.IP{}, names: map[string]string{}}
+}
+
+// load reads the hosts files, replacing the entries read before
+func (h *Hosts) load() error {
+	addrs := map[string][]net.IP{}
+	names := map[string]string{}
+	var modTimes []time.Time
+	for _, path := range h.paths {
+		modTime, err := readHostsFile(path, addrs, names)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, modTime)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs = addrs
+	h.names = names
+	h.modTimes = modTimes
+	return nil
+}
+
+// changed reports whether one of the hosts files was modified since it was loaded
+func (h *Hosts) changed() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for i, path := range h.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue // keep the entries of a file being replaced
+		}
+		if i >= len(h.modTimes) || !info.ModTime().Equal(h.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// run reloads the hosts files when they change until stop is closed
+func (h *Hosts) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(HOSTS_POLL_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !h.changed() {
+				continue
+			}
+			if err := h.load(); err != nil {
+				log.Printf("error reloading hosts files: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// answer answers an A, AAAA or PTR question for a name of the hosts files, returning nil for other questions.
+// Names with only addresses of the other family get an answer without records.
+func (h *Hosts) answer(name string, qtype QueryType) *DnsPacket {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	packet := NewDnsPacket()
+	switch qtype {
+	case A, AAAA:
+		addrs, ok := h.addrs[name]
+		if !ok {
+			return nil
+		}
+		for _, ip := range addrs {
+			if ip4 := ip.To4(); ip4 != nil && qtype == A {
+				packet.answers = append(packet.answers, DnsRecord{qType: A, domain: name, ttl: HOSTS_TTL, addr: ip4.String()})
+			} else if ip4 == nil && qtype == AAAA {
+				packet.answers = append(packet.answers, DnsRecord{qType: AAAA, domain: name, ttl: HOSTS_TTL, addr: ip.String()})
+			}
+		}
+	case PTR:
+		host, ok := h.names[name]
+		if !ok {
+			return nil
+		}
+		packet.answers = append(packet.answers, DnsRecord{qType: PTR, domain: name, ttl: HOSTS_TTL, host: host})
+	default:
+		return nil
+	}
+	return packet
+}
+
+// readHostsFile adds the entries of the hosts file at path, returning its modification time
+func readHostsFile(path string, addrs map[string][]net.IP, names map[string]string) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := parseHostsFile(f, addrs, names); err != nil {
+		return time.Time{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return info.ModTime(), nil
+}
+
+// parseHostsFile reads lines of an address followed by a host name and its aliases.
+// The first name of an address is the answer of its reverse lookup.
+func parseHostsFile(r io.Reader, addrs map[string][]net.IP, names map[string]string) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// lines with an invalid address or one with a zone like fe80::1%eth0 are skipped
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+
+		for _, field := range fields[1:] {
+			name := strings.ToLower(strings.TrimSuffix(field, "."))
+			if !containsIPAddr(addrs[name], ip) {
+				addrs[name] = append(addrs[name], ip)
+			}
+		}
+		reverse := reverseName(ip)
+		if _, ok := names[reverse]; !ok {
+			names[reverse] = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		}
+	}
+	return scanner.Err()
+}
+
+// containsIPAddr reports whether the address is in the list
+func containsIPAddr(list []net.IP, ip net.IP) bool {
+	for _, e := range list {
+		if e.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseName returns the name of the reverse lookup of the address in in-addr.arpa or ip6.arpa
+func reverseName(ip net.IP) string {
+	var labels []string
+	if ip4 := ip.To4(); ip4 != nil {
+		for i := len(ip4) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(ip4[i]))
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+
+	const digits = "0123456789abcdef"
+	for i := len(ip) - 1; i >= 0; i-- {
+		labels = append(labels, string(digits[ip[i]&0xf]), string(digits[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
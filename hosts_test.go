@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(path, []byte(`# local names
+127.0.0.1	localhost
+192.168.1.10	nas.home.arpa nas	# file server
+192.168.1.11	printer.home.arpa.
+2001:db8::10	nas.home.arpa
+fe80::1%lo0	localhost
+`), 0644))
+	hosts := NewHosts([]string{path})
+	require.NoError(t, hosts.load())
+
+	testcases := []struct {
+		name     string
+		qname    string
+		qtype    QueryType
+		answered bool
+		answers  []string
+	}{
+		{name: "ipv4", qname: "nas.home.arpa", qtype: A, answered: true, answers: []string{"nas.home.arpa.\t60\tIN\tA\t192.168.1.10"}},
+		{name: "ipv6", qname: "NAS.home.arpa.", qtype: AAAA, answered: true, answers: []string{"nas.home.arpa.\t60\tIN\tAAAA\t2001:db8::10"}},
+		{name: "alias", qname: "nas", qtype: A, answered: true, answers: []string{"nas.\t60\tIN\tA\t192.168.1.10"}},
+		{name: "no address of the type", qname: "printer.home.arpa", qtype: AAAA, answered: true},
+		{name: "ipv4 reverse", qname: "10.1.168.192.in-addr.arpa", qtype: PTR, answered: true, answers: []string{"10.1.168.192.in-addr.arpa.\t60\tIN\tPTR\tnas.home.arpa."}},
+		{
+			name: "ipv6 reverse", qname: "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa", qtype: PTR, answered: true,
+			answers: []string{"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t60\tIN\tPTR\tnas.home.arpa."},
+		},
+		{name: "unknown name", qname: "www.example.com", qtype: A},
+		{name: "other type", qname: "nas.home.arpa", qtype: MX},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := hosts.answer(tc.qname, tc.qtype)
+			if !tc.answered {
+				assert.Nil(t, response)
+				return
+			}
+			require.NotNil(t, response)
+			var answers []string
+			for _, r := range response.answers {
+				answers = append(answers, r.String())
+			}
+			assert.Equal(t, tc.answers, answers)
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		assert.False(t, hosts.changed())
+
+		require.NoError(t, os.WriteFile(path, []byte("192.168.1.20 nas.home.arpa\n"), 0644))
+		later := time.Now().Add(time.Minute)
+		require.NoError(t, os.Chtimes(path, later, later))
+		assert.True(t, hosts.changed())
+		require.NoError(t, hosts.load())
+
+		assert.Equal(t, "192.168.1.20", hosts.answer("nas.home.arpa", A).answers[0].addr)
+		assert.Nil(t, hosts.answer("printer.home.arpa", A))
+		assert.False(t, hosts.changed())
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// inflightLookup is an upstream lookup the clients asking the same question wait for
+type inflightLookup struct {
+	done   chan struct{}
+	packet *DnsPacket
+	err    error
+}
+
+// InflightLookups merges the concurrent lookups of the same question into a single upstream query
+type InflightLookups struct {
+	mu      sync.Mutex
+	lookups map[cacheKey]*inflightLookup
+}
+
+// NewInflightLookups creates new InflightLookups without lookups
+func NewInflightLookups() *InflightLookups {
+	return &InflightLookups{lookups: map[cacheKey]*inflightLookup{}}
+}
+
+// do returns the answer of query, or of the lookup of the same question already under way.
+// Every caller gets its own copy of the answer.
+func (l *InflightLookups) do(name string, qtype QueryType, dnssec bool, query func() (*DnsPacket, error)) (*DnsPacket, error) {
+	key := cacheKey{name: strings.ToLower(name), qtype: qtype, dnssec: dnssec}
+	l.mu.Lock()
+	call, ok := l.lookups[key]
+	if !ok {
+		call = &inflightLookup{done: make(chan struct{})}
+		l.lookups[key] = call
+	}
+	l.mu.Unlock()
+
+	if !ok {
+		l.lookup(key, call, query)
+	} else {
+		<-call.done
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.packet.clone(), nil
+}
+
+// lookup runs the query of the call, releasing the clients waiting for it even when the query panics
+func (l *InflightLookups) lookup(key cacheKey, call *inflightLookup, query func() (*DnsPacket, error)) {
+	defer func() {
+		l.mu.Lock()
+		delete(l.lookups, key)
+		l.mu.Unlock()
+		close(call.done)
+	}()
+	// the waiting clients get this error when the query does not return
+	call.err = fmt.Errorf("lookup of %s %s failed", key.name, key.qtype)
+	call.packet, call.err = query()
+}
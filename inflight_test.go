@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightLookups(t *testing.T) {
+	lookups := NewInflightLookups()
+	var queries atomic.Int32
+	release := make(chan struct{})
+	query := func() (*DnsPacket, error) {
+		queries.Add(1)
+		<-release
+		packet := NewDnsPacket()
+		packet.header.id = 4242
+		packet.answers = []DnsRecord{{domain: "www.example.com", qType: A, ttl: 60, addr: "192.0.2.1"}}
+		return packet, nil
+	}
+
+	const clients = 10
+	answers := make([]*DnsPacket, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			packet, err := lookups.do("WWW.example.com", A, false, query)
+			require.NoError(t, err)
+			answers[i] = packet
+		}(i)
+	}
+	assert.Eventually(t, func() bool {
+		lookups.mu.Lock()
+		defer lookups.mu.Unlock()
+		return len(lookups.lookups) == 1
+	}, time.Second, time.Millisecond)
+	// give the other clients the time to join the lookup
+	time.Sleep(50 * time.Millisecond)
+	// other questions are looked up on their own
+	_, err := lookups.do("www.example.com", AAAA, false, func() (*DnsPacket, error) {
+		return nil, errors.New("no answer")
+	})
+	assert.Error(t, err)
+
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), queries.Load())
+	assert.Empty(t, lookups.lookups)
+
+	// every client gets its own copy of the answer
+	answers[0].answers[0].domain = "changed.example.com"
+	for _, packet := range answers[1:] {
+		assert.Equal(t, "www.example.com", packet.answers[0].domain)
+	}
+
+	// later lookups query again
+	release = make(chan struct{})
+	close(release)
+	_, err = lookups.do("www.example.com", A, false, query)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), queries.Load())
+}
+
+func TestInflightLookupPanic(t *testing.T) {
+	lookups := NewInflightLookups()
+	release := make(chan struct{})
+	panicking := func() (*DnsPacket, error) {
+		<-release
+		panic("query failed")
+	}
+
+	waiter := make(chan error, 1)
+	leader := make(chan any, 1)
+	go func() {
+		defer func() { leader <- recover() }()
+		lookups.do("www.example.com", A, false, panicking)
+	}()
+	assert.Eventually(t, func() bool {
+		lookups.mu.Lock()
+		defer lookups.mu.Unlock()
+		return len(lookups.lookups) == 1
+	}, time.Second, time.Millisecond)
+	go func() {
+		_, err := lookups.do("www.example.com", A, false, panicking)
+		waiter <- err
+	}()
+	// give the waiter the time to join the lookup
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	assert.Equal(t, "query failed", <-leader)
+	assert.Error(t, <-waiter)
+	assert.Empty(t, lookups.lookups)
+
+	// the question is looked up again
+	packet, err := lookups.do("www.example.com", A, false, func() (*DnsPacket, error) {
+		return NewDnsPacket(), nil
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, packet)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// appendJournal records the changes of a dynamic update in the journal of the zone.
+// Each change is a line with "del" or "add" and the record in presentation format.
+func (z *Zone) appendJournal(deleted []DnsRecord, added []DnsRecord) error {
+	if z.journal == "" {
+		return nil
+	}
+
+	var sb strings.Builder
+	for _, r := range deleted {
+		sb.WriteString("del " + r.String() + "\n")
+	}
+	for _, r := range added {
+		sb.WriteString("add " + r.String() + "\n")
+	}
+
+	f, err := os.OpenFile(z.journal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(sb.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replayJournal applies the changes recorded in the journal at path to the records of the zone file
+func replayJournal(path string, origin string, records []DnsRecord) ([]DnsRecord, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zone := map[string]DnsRecord{}
+	var order []string
+	for _, r := range records {
+		key, err := recordKey(&r)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := zone[key]; !ok {
+			order = append(order, key)
+		}
+		zone[key] = r
+	}
+
+	scanner := bufio.NewScanner(f)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		op, line, _ := strings.Cut(scanner.Text(), " ")
+		r, err := parseRecord(line, origin, 0)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, lineNo, err)
+		}
+		key, err := recordKey(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: line %d: %v", path, lineNo, err)
+		}
+
+		switch op {
+		case "del":
+			// the journal must continue from the serial of the zone file
+			if _, ok := zone[key]; r.qType == SOA && !ok {
+				return nil, fmt.Errorf("%s: line %d: journal does not continue the zone's serial", path, lineNo)
+			}
+			delete(zone, key)
+		case "add":
+			if _, ok := zone[key]; !ok {
+				order = append(order, key)
+			}
+			zone[key] = *r
+		default:
+			return nil, fmt.Errorf("%s: line %d: unknown operation %q", path, lineNo, op)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var res []DnsRecord
+	for _, key := range order {
+		if r, ok := zone[key]; ok {
+			res = append(res, r)
+			delete(zone, key)
+		}
+	}
+	return res, nil
+}
@@ -1,24 +1,529 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+// configuration read at startup
+var config = defaultConfig()
+
+// validator of upstream answers, nil when DNSSEC validation is disabled
+var validator *Validator
+
+// locally served zones
+var zones = NewZones()
+
+// secondary zones by origin
+var secondaries = map[string]*Secondary{}
+
+// TSIG keys by name
+var tsigKeys = map[string]*TsigKey{}
+
+// entries of the hosts files
+var hosts = NewHosts(nil)
+
+// blocked domains
+var blocklist = NewBlocklist()
+
+// response policy zones in the order of their precedence
+var policyZones []*PolicyZone
+
+// upstream servers by domain
+var forwarder = NewForwarder()
+
+// rules rewriting the questions in the order they are tried
+var rewriteRules []*RewriteRule
+
+// synthesis of AAAA records, nil when disabled
+var dns64 *DNS64
+
+// DNS rebinding protection, nil when disabled
+var rebinding *RebindingFilter
+
+// access control lists of the clients
+var acls = NewACLs()
+
+// response rate limiting of udp responses, nil when disabled
+var rateLimiter *RateLimiter
+
+// server cookies of our clients and our cookies for the upstream servers
+var cookies = NewServerCookies()
+var upstreamCookies = NewClientCookies()
+
+// cache of upstream answers, nil when disabled
+var cache *Cache
+
+// upstream lookups under way
+var inflight = NewInflightLookups()
+
+// Time allowed for the queries being answered to finish on shutdown
+const SHUTDOWN_TIMEOUT = 5 * time.Second
+
+// serving is held for reading while a query is answered, and for writing while the configuration is replaced
+var serving sync.RWMutex
+
+// stop is closed to stop the background work of the configuration, whose goroutines background counts.
+// backgroundMu keeps background work from being started while it is stopped.
+var stop = make(chan struct{})
+var background sync.WaitGroup
+var backgroundMu sync.Mutex
+
 func main() {
+	configPath := flag.String("config", "", "path to the json configuration file")
+	flag.Parse()
+
+	c, err := readConfig(*configPath)
+	if err != nil {
+		log.Fatalf("error loading config: %v", err)
+	}
+	config = c
+	if err := setup(config); err != nil {
+		log.Fatalf("error setting up: %v", err)
+	}
+
 	udpAddr, _ := net.ResolveUDPAddr("udp", "0.0.0.0:2054")
 	// Bind udp socket on port 2054
 	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		log.Fatalf("error listening udp socket: %v", err)
 	}
-	defer conn.Close()
 
+	// Serve queries too large for udp and zone transfers over tcp on the same port
+	listener, err := net.Listen("tcp", "0.0.0.0:2054")
+	if err != nil {
+		log.Fatalf("error listening tcp socket: %v", err)
+	}
+	go serveTCP(listener)
+	go serveUDP(conn)
+
+	// SIGHUP reloads the configuration, SIGINT and SIGTERM shut the server down
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := reload(*configPath); err != nil {
+				log.Printf("error reloading config: %v\n", err)
+			}
+			continue
+		}
+		log.Printf("received %s, shutting down\n", sig)
+		break
+	}
+	shutdown(conn, listener)
+}
+
+// serveUDP answers the queries read from the udp socket until reading is stopped
+func serveUDP(conn *net.UDPConn) {
 	for {
 		// Handle incoming queries in a loop
 		err := handleQuery(conn)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
 		if err != nil {
 			log.Printf("error handling query: %v\n", err)
 		}
 	}
 }
+
+// shutdown stops reading queries, waits for the queries being answered
+// and stops the background work, which saves the cache
+func shutdown(conn *net.UDPConn, listener net.Listener) {
+	conn.SetReadDeadline(time.Now())
+	listener.Close()
+
+	// no query is answered from draining until the shut down is done
+	drained := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		serving.Lock()
+		defer serving.Unlock()
+		close(drained)
+		<-done
+	}()
+	select {
+	case <-drained:
+	case <-time.After(SHUTDOWN_TIMEOUT):
+		log.Printf("queries still being answered after %s\n", SHUTDOWN_TIMEOUT)
+	}
+	conn.Close()
+
+	stopBackground()
+	log.Println("shut down")
+}
+
+// readConfig reads the configuration file, or returns the default configuration without one
+func readConfig(path string) (*Config, error) {
+	if path == "" {
+		return defaultConfig(), nil
+	}
+	return loadConfig(path)
+}
+
+// reload replaces the configuration by the one of the file, along with the zones, hosts files and blocklists.
+// The previous configuration is restored when the new one fails to be set up.
+func reload(path string) error {
+	c, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+
+	serving.Lock()
+	defer serving.Unlock()
+
+	previousCache := cache
+	reset()
+	err = setup(c)
+	if err == nil {
+		config = c
+		log.Println("config reloaded")
+	} else {
+		reset()
+		if restoreErr := setup(config); restoreErr != nil {
+			return fmt.Errorf("%v, restoring the previous config: %v", err, restoreErr)
+		}
+	}
+	if cache != nil && previousCache != nil {
+		cache.adopt(previousCache)
+	}
+	return err
+}
+
+// runBackground runs the background work of the configuration until it is stopped,
+// and not at all when it is being stopped
+func runBackground(run func(stop <-chan struct{})) {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	background.Add(1)
+	go func(stop <-chan struct{}) {
+		defer background.Done()
+		run(stop)
+	}(stop)
+}
+
+// stopBackground stops the background work of the configuration and waits for it to finish.
+// The refreshes of the cache finish first, so that the saved cache holds their answers.
+func stopBackground() {
+	if cache != nil {
+		cache.stopRefreshes()
+	}
+	backgroundMu.Lock()
+	close(stop)
+	backgroundMu.Unlock()
+	background.Wait()
+
+	backgroundMu.Lock()
+	stop = make(chan struct{})
+	backgroundMu.Unlock()
+}
+
+// reset stops the background work and restores the components of the configuration to their defaults
+func reset() {
+	stopBackground()
+	validator = nil
+	zones = NewZones()
+	secondaries = map[string]*Secondary{}
+	tsigKeys = map[string]*TsigKey{}
+	hosts = NewHosts(nil)
+	blocklist = NewBlocklist()
+	policyZones = nil
+	forwarder = NewForwarder()
+	rewriteRules = nil
+	dns64 = nil
+	rebinding = nil
+	acls = NewACLs()
+	rateLimiter = nil
+	cookies = NewServerCookies()
+	cache = nil
+}
+
+// setup creates the components enabled in the configuration
+func setup(config *Config) error {
+	if config.DNSSEC.Validate {
+		trustAnchors := config.DNSSEC.TrustAnchors
+		if len(trustAnchors) == 0 {
+			trustAnchors = []string{rootTrustAnchor}
+		}
+
+		var anchors []DnsRecord
+		for _, s := range trustAnchors {
+			anchor, err := parseRecord(s, "", 0)
+			if err != nil {
+				return err
+			}
+			if anchor.qType != DS && anchor.qType != DNSKEY {
+				return fmt.Errorf("trust anchor is not a DS or DNSKEY record: %s", s)
+			}
+			anchors = append(anchors, *anchor)
+		}
+		validator = NewValidator(anchors, func(domain string, qtype QueryType) (*DnsPacket, error) {
+			return lookup(domain, qtype, true)
+		})
+	}
+
+	for _, fc := range config.Forward {
+		rule, err := fc.newForwardRule()
+		if err != nil {
+			return err
+		}
+		forwarder.add(rule)
+	}
+
+	for _, rc := range config.Rewrite {
+		rule, err := rc.newRewriteRule()
+		if err != nil {
+			return err
+		}
+		rewriteRules = append(rewriteRules, rule)
+	}
+
+	if config.DNS64 != nil {
+		d, err := config.DNS64.newDNS64()
+		if err != nil {
+			return err
+		}
+		dns64 = d
+	}
+
+	if config.ACL != nil {
+		a, err := config.ACL.newACLs()
+		if err != nil {
+			return err
+		}
+		acls = a
+	}
+
+	if config.Cache != nil {
+		c, err := config.Cache.newCache()
+		if err != nil {
+			return err
+		}
+		cache = c
+		if cache.file != "" {
+			if err := cache.load(time.Now()); err != nil {
+				return fmt.Errorf("loading cache: %v", err)
+			}
+			runBackground(cache.run)
+		}
+	}
+
+	if config.Cookies != nil {
+		c, err := config.Cookies.newServerCookies()
+		if err != nil {
+			return err
+		}
+		cookies = c
+	}
+
+	if config.RateLimit != nil {
+		l, err := config.RateLimit.newRateLimiter()
+		if err != nil {
+			return err
+		}
+		rateLimiter = l
+	}
+
+	if config.Rebinding != nil {
+		rebinding = config.Rebinding.newRebindingFilter()
+	}
+
+	for _, kc := range config.TSIGKeys {
+		key, err := kc.newTsigKey()
+		if err != nil {
+			return err
+		}
+		tsigKeys[key.name] = key
+	}
+
+	if len(config.HostsFiles) > 0 {
+		hosts = NewHosts(config.HostsFiles)
+		if err := hosts.load(); err != nil {
+			return err
+		}
+		runBackground(hosts.run)
+	}
+
+	if config.Blocking != nil {
+		b, err := config.Blocking.newBlocklist()
+		if err != nil {
+			return err
+		}
+		blocklist = b
+	}
+
+	for _, rc := range config.RPZ {
+		policyZone, err := loadPolicyZone(rc)
+		if err != nil {
+			return err
+		}
+		policyZones = append(policyZones, policyZone)
+	}
+
+	for _, zc := range config.Zones {
+		if zc.Primary != "" {
+			secondary, err := newSecondary(zc)
+			if err != nil {
+				return err
+			}
+			secondaries[secondary.origin] = secondary
+			runBackground(secondary.run)
+			continue
+		}
+
+		zone, err := loadZone(zc)
+		if err != nil {
+			return err
+		}
+		zones.add(zone)
+		zone.sendNotify()
+	}
+	return nil
+}
+
+// loadZone loads a zone from its zone file, signing it if configured
+func loadZone(zc ZoneConfig) (*Zone, error) {
+	origin := absoluteName(zc.Name, "")
+	records, err := loadZoneFile(zc.File, origin)
+	if err != nil {
+		return nil, err
+	}
+	journal := zc.Journal
+	if journal == "" && len(zc.AllowUpdate) > 0 {
+		journal = zc.File + ".jnl"
+	}
+	if journal != "" {
+		if records, err = replayJournal(journal, origin, records); err != nil {
+			return nil, err
+		}
+	}
+	zone, err := NewZone(origin, records)
+	if err != nil {
+		return nil, err
+	}
+	if zone.zoneSettings, err = newZoneSettings(zc); err != nil {
+		return nil, err
+	}
+	zone.journal = journal
+
+	if zc.Signing != nil {
+		signer, err := zc.Signing.newZoneSigner()
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: %v", zc.Name, err)
+		}
+		zone.enableSigning(signer)
+		for _, ds := range zone.dsRecords() {
+			log.Printf("zone %s is signed, DS record for the parent zone: %s\n", fqdn(origin), ds)
+		}
+	}
+	return zone, nil
+}
+
+// loadPolicyZone loads a response policy zone from its zone file, or starts transferring it from its primary
+func loadPolicyZone(rc RPZConfig) (*PolicyZone, error) {
+	origin := absoluteName(rc.Name, "")
+	policyZone := NewPolicyZone(origin)
+	policyZone.log = rc.Log
+
+	if rc.Primary == "" {
+		records, err := loadZoneFile(rc.File, origin)
+		if err != nil {
+			return nil, err
+		}
+		return policyZone, policyZone.load(records)
+	}
+
+	secondary := NewSecondary(origin, rc.Primary)
+	if rc.Key != "" {
+		key, err := findTsigKey(rc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("policy zone %s: %v", rc.Name, err)
+		}
+		secondary.settings.key = key
+	}
+	secondaries[secondary.origin] = secondary
+	secondary.publish = func(zone *Zone) {
+		var records []DnsRecord
+		if zone != nil {
+			records = zone.allRecords()
+		}
+		if err := policyZone.load(records); err != nil {
+			log.Printf("error loading policy zone %s: %v\n", fqdn(origin), err)
+		}
+	}
+	runBackground(secondary.run)
+	return policyZone, nil
+}
+
+// newSecondary creates the Secondary keeping a secondary zone up to date
+func newSecondary(zc ZoneConfig) (*Secondary, error) {
+	if zc.Signing != nil {
+		return nil, fmt.Errorf("zone %s: secondary zones cannot be signed", zc.Name)
+	}
+	secondary := NewSecondary(absoluteName(zc.Name, ""), zc.Primary)
+	var err error
+	if secondary.settings, err = newZoneSettings(zc); err != nil {
+		return nil, err
+	}
+	return secondary, nil
+}
+
+// newZoneSettings creates the settings of a zone from its configuration
+func newZoneSettings(zc ZoneConfig) (zoneSettings, error) {
+	var settings zoneSettings
+	var err error
+	if settings.allowTransfer, err = parseNetworks(zc.AllowTransfer); err != nil {
+		return settings, fmt.Errorf("zone %s: %v", zc.Name, err)
+	}
+	if settings.allowUpdate, err = parseNetworks(zc.AllowUpdate); err != nil {
+		return settings, fmt.Errorf("zone %s: %v", zc.Name, err)
+	}
+	for _, addr := range zc.Notify {
+		settings.notify = append(settings.notify, hostPort(addr))
+	}
+
+	for _, name := range zc.TransferKeys {
+		key, err := findTsigKey(name)
+		if err != nil {
+			return settings, fmt.Errorf("zone %s: %v", zc.Name, err)
+		}
+		settings.transferKeys = append(settings.transferKeys, key.name)
+	}
+	for _, name := range zc.UpdateKeys {
+		key, err := findTsigKey(name)
+		if err != nil {
+			return settings, fmt.Errorf("zone %s: %v", zc.Name, err)
+		}
+		settings.updateKeys = append(settings.updateKeys, key.name)
+	}
+	if zc.Key != "" {
+		if settings.key, err = findTsigKey(zc.Key); err != nil {
+			return settings, fmt.Errorf("zone %s: %v", zc.Name, err)
+		}
+	}
+	return settings, nil
+}
+
+// findTsigKey returns the configured TSIG key with the name
+func findTsigKey(name string) (*TsigKey, error) {
+	key, ok := tsigKeys[strings.ToLower(strings.TrimSuffix(name, "."))]
+	if !ok {
+		return nil, fmt.Errorf("unknown TSIG key %s", name)
+	}
+	return key, nil
+}
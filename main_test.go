@@ -3,9 +3,12 @@ package main
 import (
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestQueryPacket(t *testing.T) {
@@ -372,3 +375,238 @@ func TestDNSServer(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordRoundTrip(t *testing.T) {
+	testcases := []struct {
+		name   string
+		record DnsRecord
+	}{
+		{
+			name:   "a",
+			record: DnsRecord{qType: A, domain: "example.com", ttl: 300, addr: "192.0.2.1"},
+		},
+		{
+			name:   "aaaa",
+			record: DnsRecord{qType: AAAA, domain: "example.com", ttl: 300, addr: "2001:db8:0:0:0:0:0:1"},
+		},
+		{
+			name:   "mx",
+			record: DnsRecord{qType: MX, domain: "example.com", ttl: 300, host: "mail.example.com", priority: 10},
+		},
+		{
+			name: "soa",
+			record: DnsRecord{
+				qType: SOA, domain: "example.com", ttl: 3600, host: "ns1.example.com", mailbox: "hostmaster.example.com",
+				serial: 2024010101, refresh: 7200, retry: 3600, expire: 1209600, minimum: 300,
+			},
+		},
+		{
+			name: "dnskey",
+			record: DnsRecord{
+				qType: DNSKEY, domain: "example.com", ttl: 3600, flags: 257, protocol: 3, algorithm: 13,
+				publicKey: []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+			},
+		},
+		{
+			name: "ds",
+			record: DnsRecord{
+				qType: DS, domain: "example.com", ttl: 3600, keyTag: 12345, algorithm: 13, digestType: 2,
+				digest: []byte{0xde, 0xad, 0xbe, 0xef},
+			},
+		},
+		{
+			name: "rrsig",
+			record: DnsRecord{
+				qType: RRSIG, domain: "www.example.com", ttl: 300, typeCovered: A, algorithm: 13, labels: 3,
+				originalTTL: 300, expiration: 1700000000, inception: 1690000000, keyTag: 12345,
+				signerName: "example.com", signature: []byte{0x0a, 0x0b, 0x0c},
+			},
+		},
+		{
+			name: "nsec",
+			record: DnsRecord{
+				qType: NSEC, domain: "example.com", ttl: 300, nextDomain: "www.example.com",
+				typeBitMap: []QueryType{A, NS, SOA, MX, AAAA, RRSIG, NSEC, DNSKEY, QueryType(257)},
+			},
+		},
+		{
+			name: "tsig",
+			record: DnsRecord{
+				qType: TSIG, domain: "transfer.key", class: CLASS_ANY, algorithmName: "hmac-sha256", timeSigned: 1700000000,
+				fudge: 300, mac: []byte{0x01, 0x02}, originalID: 4321, tsigError: BadTime, otherData: []byte{0, 0, 0x65, 0x53, 0xf1, 0x00},
+			},
+		},
+		{
+			name: "nsec3",
+			record: DnsRecord{
+				qType: NSEC3, domain: "2t7b4g4vsa5smi47k61mv5bv1a22bojr.example.com", ttl: 300, hashAlgorithm: 1, flags: 1,
+				iterations: 10, salt: []byte{0xaa, 0xbb}, nextHashed: []byte{0x01, 0x02, 0x03},
+				typeBitMap: []QueryType{A, RRSIG},
+			},
+		},
+		{
+			name: "nsec3param",
+			record: DnsRecord{
+				qType: NSEC3PARAM, domain: "example.com", ttl: 0, hashAlgorithm: 1, iterations: 10, salt: []byte{0xaa, 0xbb},
+			},
+		},
+		{
+			name:   "unsupported type",
+			record: DnsRecord{qType: QueryType(16), domain: "example.com", ttl: 300, data: []byte{5, 'h', 'e', 'l', 'l', 'o'}},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			packet := NewDnsPacket()
+			packet.header = DnsHeader{id: 1234, response: true}
+			packet.answers = []DnsRecord{tc.record}
+
+			buf := NewBytePacketBuffer()
+			err := packet.write(buf)
+			assert.NoError(t, err)
+
+			buf.seek(0)
+			resPacket := NewDnsPacket()
+			err = resPacket.fromBuffer(buf)
+			assert.NoError(t, err)
+			assert.Equal(t, []DnsRecord{tc.record}, resPacket.answers)
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	hostsFile := filepath.Join(dir, "hosts")
+	require.NoError(t, os.WriteFile(hostsFile, []byte("192.0.2.10 printer.lan\n"), 0o644))
+	configFile := filepath.Join(dir, "config.json")
+	writeConfig := func(data string) {
+		require.NoError(t, os.WriteFile(configFile, []byte(data), 0o644))
+	}
+	saved := config
+	t.Cleanup(func() {
+		serving.Lock()
+		defer serving.Unlock()
+		reset()
+		config = saved
+	})
+
+	writeConfig(`{"hostsFiles": ["` + hostsFile + `"], "forward": [{"domain": "corp.example", "upstreams": ["192.0.2.53"]}], "cache": {}}`)
+	require.NoError(t, reload(configFile))
+	assert.NotNil(t, hosts.answer("printer.lan", A))
+	assert.Equal(t, []string{"192.0.2.53:53"}, forwarder.rule("www.corp.example").upstreams)
+	cachedAnswer := NewDnsPacket()
+	cachedAnswer.answers = []DnsRecord{{domain: "www.example.com", qType: A, ttl: 300, addr: "192.0.2.1"}}
+	cache.put(cacheKey{name: "www.example.com", qtype: A}, cachedAnswer, time.Now())
+
+	// components left out of the new config are reset, the cache is kept
+	writeConfig(`{"blocking": {"response": "refused"}, "cache": {}}`)
+	require.NoError(t, reload(configFile))
+	assert.Nil(t, hosts.answer("printer.lan", A))
+	assert.Equal(t, DEFAULT_UPSTREAMS, forwarder.rule("www.corp.example").upstreams)
+	assert.Equal(t, BlockRefused, blocklist.mode)
+	packet, _, _ := cache.get(cacheKey{name: "www.example.com", qtype: A}, time.Now())
+	assert.NotNil(t, packet)
+
+	// a config failing to load leaves the previous one in place
+	writeConfig(`{"acl": {"recursion": [{"networks": ["192.0.2.0/24"], "action": "reject"}]}}`)
+	assert.Error(t, reload(configFile))
+	assert.Equal(t, BlockRefused, blocklist.mode)
+	assert.Equal(t, ACLAllow, acls.recursion.check(net.ParseIP("198.51.100.1")))
+}
+
+func TestShutdown(t *testing.T) {
+	zone, err := NewZone("example.com", []DnsRecord{
+		{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 1, minimum: 300},
+		{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	saved := zones
+	zones = NewZones()
+	zones.add(zone)
+	t.Cleanup(func() { zones = saved })
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan struct{})
+	go func() {
+		serveUDP(conn)
+		close(served)
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	request := NewDnsPacket()
+	request.header = DnsHeader{id: 99, questions: 1}
+	request.questions = []DnsQuestion{{name: "www.example.com", qtype: A}}
+	buf := NewBytePacketBuffer()
+	require.NoError(t, request.write(buf))
+	_, err = client.Write(buf.buf[:buf.position()])
+	require.NoError(t, err)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	response := NewBytePacketBuffer()
+	_, err = client.Read(response.buf)
+	require.NoError(t, err)
+
+	shutdown(conn, listener)
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("udp queries still served after the shutdown")
+	}
+	// queries are answered again once the shut down is done
+	assert.Eventually(t, func() bool {
+		if !serving.TryRLock() {
+			return false
+		}
+		serving.RUnlock()
+		return true
+	}, time.Second, time.Millisecond)
+}
+
+func TestUDPQueryLimit(t *testing.T) {
+	zone, err := NewZone("example.com", []DnsRecord{
+		{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 1, minimum: 300},
+		{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.1"},
+	})
+	require.NoError(t, err)
+	saved := zones
+	zones = NewZones()
+	zones.add(zone)
+	t.Cleanup(func() { zones = saved })
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer conn.Close()
+	go serveUDP(conn)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	query := func() error {
+		request := NewDnsPacket()
+		request.header = DnsHeader{id: 99, questions: 1}
+		request.questions = []DnsQuestion{{name: "www.example.com", qtype: A}}
+		buf := NewBytePacketBuffer()
+		require.NoError(t, request.write(buf))
+		if _, err := client.Write(buf.buf[:buf.position()]); err != nil {
+			return err
+		}
+		client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err := client.Read(NewBytePacketBuffer().buf)
+		return err
+	}
+
+	// queries are dropped while the maximum number of queries is being answered
+	for i := 0; i < MAX_UDP_QUERIES; i++ {
+		udpQueries <- struct{}{}
+	}
+	assert.Error(t, query())
+	for i := 0; i < MAX_UDP_QUERIES; i++ {
+		<-udpQueries
+	}
+	assert.NoError(t, query())
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// Time waited for the answer to a NOTIFY message before it is sent again, doubled with each retry
+const NOTIFY_TIMEOUT = 2 * time.Second
+
+// Number of times a NOTIFY message is sent before giving up
+const NOTIFY_ATTEMPTS = 5
+
+// sendNotify notifies the secondaries of the zone of a change in the background,
+// giving up when the background work of the configuration is stopped
+func (z *Zone) sendNotify() {
+	soa := *z.soa()
+	key := z.key
+	for _, addr := range z.notify {
+		addr := addr
+		runBackground(func(stop <-chan struct{}) {
+			if err := sendNotify(addr, soa, key, NOTIFY_TIMEOUT, NOTIFY_ATTEMPTS, stop); err != nil {
+				log.Printf("error notifying %s of zone %s: %v\n", addr, fqdn(soa.domain), err)
+			}
+		})
+	}
+}
+
+// sendNotify sends a NOTIFY message with the new SOA record of a zone (RFC 1996) until the secondary answers it
+// or stop is closed. With a key the message is signed.
+func sendNotify(addr string, soa DnsRecord, key *TsigKey, timeout time.Duration, attempts int, stop <-chan struct{}) error {
+	request := NewDnsPacket()
+	request.header = DnsHeader{id: newQueryID(), opcode: OPCODE_NOTIFY, authoritativeAnswer: true}
+	request.questions = []DnsQuestion{{name: soa.domain, qtype: SOA}}
+	request.answers = []DnsRecord{soa}
+	if key != nil {
+		request.tsig = NewTsigSession(key)
+	}
+	buf := NewBytePacketBuffer()
+	if err := request.write(buf); err != nil {
+		return err
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// closing the connection ends waiting for the answer once stopped
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for i := 0; ; i++ {
+		if _, err := conn.Write(buf.buf[:buf.position()]); err != nil {
+			return err
+		}
+
+		response, message, err := readNotifyResponse(conn, request.header.id, time.Now().Add(timeout))
+		if err == nil {
+			if request.tsig != nil {
+				if err := request.tsig.verify(response, message); err != nil {
+					return err
+				}
+			}
+			if response.header.resCode != NoError {
+				return &ResultCodeError{resCode: response.header.resCode}
+			}
+			return nil
+		}
+		select {
+		case <-stop:
+			return errors.New("stopped before the secondary answered")
+		default:
+		}
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() || i+1 == attempts {
+			return err
+		}
+		timeout *= 2
+	}
+}
+
+// readNotifyResponse reads the answer to the NOTIFY message with the id, ignoring unrelated messages.
+// It returns the answer together with the message as received.
+func readNotifyResponse(conn net.Conn, id uint16, deadline time.Time) (*DnsPacket, []byte, error) {
+	conn.SetReadDeadline(deadline)
+	for {
+		responseBuf := NewBytePacketBuffer()
+		n, err := conn.Read(responseBuf.buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		response := NewDnsPacket()
+		if err := response.fromBuffer(responseBuf); err != nil {
+			continue
+		}
+		if response.header.response && response.header.id == id && response.header.opcode == OPCODE_NOTIFY {
+			return response, responseBuf.buf[:n], nil
+		}
+	}
+}
+
+// answerNotify answers a NOTIFY message, making the secondary zone check its primary for a new version right away
+func answerNotify(request *DnsPacket, client net.IP) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{id: request.header.id, opcode: OPCODE_NOTIFY, response: true}
+	packet.questions = request.questions
+	packet.tsig = request.tsig
+	if len(request.questions) != 1 || request.questions[0].qtype != SOA {
+		packet.header.resCode = Formerr
+		return packet
+	}
+
+	origin := strings.ToLower(request.questions[0].name)
+	secondary, ok := secondaries[origin]
+	if !ok {
+		packet.header.resCode = NotAuth
+		return packet
+	}
+	if !secondary.notifyAllowed(client, request.tsigKeyName()) {
+		log.Printf("NOTIFY of zone %s from %s refused\n", fqdn(origin), client)
+		packet.header.resCode = Refused
+		return packet
+	}
+
+	packet.header.authoritativeAnswer = true
+	select {
+	case secondary.check <- struct{}{}:
+	default:
+		// a check is already pending
+	}
+	return packet
+}
+
+// notifyAllowed reports whether a NOTIFY message is accepted from the client. Secondary zones with a key
+// require NOTIFY messages signed with it, others accept them from their primary.
+func (s *Secondary) notifyAllowed(client net.IP, key string) bool {
+	if s.settings.key != nil {
+		return key == s.settings.key.name
+	}
+	return s.fromPrimary(client)
+}
+
+// fromPrimary reports whether the client is the primary of the zone
+func (s *Secondary) fromPrimary(client net.IP) bool {
+	if client == nil {
+		return false
+	}
+	s.addrsMu.RLock()
+	defer s.addrsMu.RUnlock()
+	for _, ip := range s.addrs {
+		if ip.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePrimary looks up the addresses NOTIFY messages of the primary come from,
+// keeping the previous ones when the lookup fails
+func (s *Secondary) resolvePrimary() {
+	host, _, err := net.SplitHostPort(s.primary)
+	if err != nil {
+		return
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		log.Printf("error looking up the primary %s of zone %s: %v\n", host, fqdn(s.origin), err)
+		return
+	}
+	s.addrsMu.Lock()
+	s.addrs = ips
+	s.addrsMu.Unlock()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendNotify(t *testing.T) {
+	soa := DnsRecord{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 7, minimum: 300}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// the secondary answers the second attempt only
+	received := make(chan *DnsPacket, 2)
+	go func() {
+		for attempt := 1; ; attempt++ {
+			buf := NewBytePacketBuffer()
+			_, addr, err := conn.ReadFrom(buf.buf)
+			if err != nil {
+				return
+			}
+			request := NewDnsPacket()
+			if err := request.fromBuffer(buf); err != nil {
+				return
+			}
+			received <- request
+			if attempt == 2 {
+				response := answerNotify(request, nil)
+				data, _ := writeResponse(response, MAX_PACKET_SIZE)
+				conn.WriteTo(data, addr)
+			}
+		}
+	}()
+
+	// unknown zones are answered with NOTAUTH
+	err = sendNotify(conn.LocalAddr().String(), soa, nil, 50*time.Millisecond, 3, nil)
+	var rcodeErr *ResultCodeError
+	require.ErrorAs(t, err, &rcodeErr)
+	assert.Equal(t, NotAuth, rcodeErr.resCode)
+
+	for i := 0; i < 2; i++ {
+		request := <-received
+		assert.Equal(t, OPCODE_NOTIFY, request.header.opcode)
+		assert.Equal(t, []DnsQuestion{{name: "example.com", qtype: SOA}}, request.questions)
+		require.Len(t, request.answers, 1)
+		assert.Equal(t, uint32(7), request.answers[0].serial)
+	}
+}
+
+func TestAnswerNotify(t *testing.T) {
+	secondary := NewSecondary("example.com", "127.0.0.1:5300")
+	saved := secondaries
+	secondaries = map[string]*Secondary{"example.com": secondary}
+	t.Cleanup(func() { secondaries = saved })
+
+	notify := func(zone string, qtype QueryType) *DnsPacket {
+		request := NewDnsPacket()
+		request.header = DnsHeader{id: 42, opcode: OPCODE_NOTIFY, authoritativeAnswer: true}
+		request.questions = []DnsQuestion{{name: zone, qtype: qtype}}
+		return request
+	}
+
+	testcases := []struct {
+		name    string
+		request *DnsPacket
+		client  string
+		resCode ResultCode
+		checked bool
+	}{
+		{name: "from the primary", request: notify("Example.com", SOA), client: "127.0.0.1", resCode: NoError, checked: true},
+		{name: "from another host", request: notify("example.com", SOA), client: "192.0.2.1", resCode: Refused},
+		{name: "unknown zone", request: notify("example.org", SOA), client: "127.0.0.1", resCode: NotAuth},
+		{name: "not a SOA question", request: notify("example.com", A), client: "127.0.0.1", resCode: Formerr},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			response, err := buildResponse(tc.request, net.ParseIP(tc.client), false)
+			require.NoError(t, err)
+			assert.Equal(t, uint16(42), response.header.id)
+			assert.Equal(t, OPCODE_NOTIFY, response.header.opcode)
+			assert.True(t, response.header.response)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+
+			select {
+			case <-secondary.check:
+				assert.True(t, tc.checked)
+			default:
+				assert.False(t, tc.checked)
+			}
+		})
+	}
+}
+
+func TestSendNotifyStop(t *testing.T) {
+	soa := DnsRecord{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 7, minimum: 300}
+
+	// the secondary never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- sendNotify(conn.LocalAddr().String(), soa, nil, time.Second, NOTIFY_ATTEMPTS, stop)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("notifying went on after being stopped")
+	}
+}
+
+func TestNotifyPrimaryAddresses(t *testing.T) {
+	secondary := NewSecondary("example.com", "127.0.0.1:5300")
+	assert.True(t, secondary.fromPrimary(net.ParseIP("127.0.0.1")))
+
+	// the addresses are resolved when set up and with each refresh, not with each NOTIFY message
+	secondary.primary = "192.0.2.53:53"
+	assert.True(t, secondary.fromPrimary(net.ParseIP("127.0.0.1")))
+	secondary.resolvePrimary()
+	assert.False(t, secondary.fromPrimary(net.ParseIP("127.0.0.1")))
+	assert.True(t, secondary.fromPrimary(net.ParseIP("192.0.2.53")))
+}
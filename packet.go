@@ -6,6 +6,11 @@ type DnsPacket struct {
 	answers     []DnsRecord
 	authorities []DnsRecord
 	resources   []DnsRecord
+
+	// tsig signs the packet when it is written, or holds the verified signature of a received packet
+	tsig *TsigSession
+	// signedData is the message covered by the MAC of a received TSIG record
+	signedData []byte
 }
 
 // NewDnsPacket creates a new DnsPacket
@@ -13,6 +18,16 @@ func NewDnsPacket() *DnsPacket {
 	return &DnsPacket{}
 }
 
+// clone returns a copy of the packet whose records can be changed without changing the packet
+func (d *DnsPacket) clone() *DnsPacket {
+	packet := *d
+	packet.questions = append([]DnsQuestion(nil), d.questions...)
+	packet.answers = append([]DnsRecord(nil), d.answers...)
+	packet.authorities = append([]DnsRecord(nil), d.authorities...)
+	packet.resources = append([]DnsRecord(nil), d.resources...)
+	return &packet
+}
+
 // read reads a packet from the buffer
 func (d *DnsPacket) fromBuffer(buf *BytePacketBuffer) error {
 	if err := d.header.read(buf); err != nil {
@@ -43,7 +58,9 @@ func (d *DnsPacket) fromBuffer(buf *BytePacketBuffer) error {
 		d.authorities = append(d.authorities, r)
 	}
 
+	var start uint
 	for i := 0; i < int(d.header.resourceEntries); i++ {
+		start = buf.position()
 		r := DnsRecord{}
 		if err := r.read(buf); err != nil {
 			return err
@@ -51,6 +68,21 @@ func (d *DnsPacket) fromBuffer(buf *BytePacketBuffer) error {
 		d.resources = append(d.resources, r)
 	}
 
+	// the MAC covers the message without the TSIG record, with the original id
+	if tsig := d.tsigRecord(); tsig != nil {
+		data, err := buf.getRange(0, start)
+		if err != nil {
+			return err
+		}
+		d.signedData = append([]byte(nil), data...)
+		d.signedData[0] = uint8(tsig.originalID >> 8)
+		d.signedData[1] = uint8(tsig.originalID)
+		d.signedData[11]--
+		if d.signedData[11] == 0xff {
+			d.signedData[10]--
+		}
+	}
+
 	return nil
 }
 
@@ -88,5 +120,32 @@ func (d *DnsPacket) write(buf *BytePacketBuffer) error {
 		}
 	}
 
+	if d.tsig != nil {
+		return d.tsig.sign(buf)
+	}
+	return nil
+}
+
+// tsigRecord returns the TSIG record, which is the last record of a message
+func (d *DnsPacket) tsigRecord() *DnsRecord {
+	if len(d.resources) > 0 && d.resources[len(d.resources)-1].qType == TSIG {
+		return &d.resources[len(d.resources)-1]
+	}
 	return nil
 }
+
+// misplacedTsig reports whether the message has a TSIG record other than as its last record
+func (d *DnsPacket) misplacedTsig() bool {
+	records := [][]DnsRecord{d.answers, d.authorities, d.resources}
+	if d.tsigRecord() != nil {
+		records[2] = d.resources[:len(d.resources)-1]
+	}
+	for _, section := range records {
+		for _, r := range section {
+			if r.qType == TSIG {
+				return true
+			}
+		}
+	}
+	return false
+}
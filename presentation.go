@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// base32 encoding with the extended hex alphabet used for NSEC3 hashes
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// format of the RRSIG inception and expiration times in presentation format
+const signatureTimeFormat = "20060102150405"
+
+// String returns the record in presentation (zone file) format
+func (d DnsRecord) String() string {
+	return fmt.Sprintf("%s\t%d\tIN\t%s\t%s", fqdn(d.domain), d.ttl, d.qType, d.dataString())
+}
+
+func (d DnsRecord) dataString() string {
+	switch d.qType {
+	case A, AAAA:
+		return d.addr
+	case NS, CNAME, PTR:
+		return fqdn(d.host)
+	case MX:
+		return fmt.Sprintf("%d %s", d.priority, fqdn(d.host))
+	case SOA:
+		return fmt.Sprintf("%s %s %d %d %d %d %d", fqdn(d.host), fqdn(d.mailbox), d.serial, d.refresh, d.retry, d.expire, d.minimum)
+	case DNSKEY:
+		return fmt.Sprintf("%d %d %d %s", d.flags, d.protocol, d.algorithm, base64.StdEncoding.EncodeToString(d.publicKey))
+	case DS:
+		return fmt.Sprintf("%d %d %d %s", d.keyTag, d.algorithm, d.digestType, strings.ToUpper(hex.EncodeToString(d.digest)))
+	case RRSIG:
+		return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", d.typeCovered, d.algorithm, d.labels, d.originalTTL,
+			formatSignatureTime(d.expiration), formatSignatureTime(d.inception), d.keyTag, fqdn(d.signerName),
+			base64.StdEncoding.EncodeToString(d.signature))
+	case NSEC:
+		return strings.TrimSpace(fqdn(d.nextDomain) + " " + typesString(d.typeBitMap))
+	case NSEC3:
+		return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", d.hashAlgorithm, d.flags, d.iterations, saltString(d.salt),
+			strings.ToUpper(base32Hex.EncodeToString(d.nextHashed)), typesString(d.typeBitMap)))
+	case NSEC3PARAM:
+		return fmt.Sprintf("%d %d %d %s", d.hashAlgorithm, d.flags, d.iterations, saltString(d.salt))
+	case TSIG:
+		return fmt.Sprintf("%s %d %d %d %s %d %d %d %s", fqdn(d.algorithmName), d.timeSigned, d.fudge, len(d.mac),
+			base64.StdEncoding.EncodeToString(d.mac), d.originalID, d.tsigError, len(d.otherData), hex.EncodeToString(d.otherData))
+	default:
+		return fmt.Sprintf("\\# %d %s", len(d.data), hex.EncodeToString(d.data))
+	}
+}
+
+// fqdn returns the name with the trailing dot of an absolute name
+func fqdn(name string) string {
+	if name == "" {
+		return "."
+	}
+	return name + "."
+}
+
+func typesString(types []QueryType) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		names[i] = t.String()
+	}
+	return strings.Join(names, " ")
+}
+
+func saltString(salt []byte) string {
+	if len(salt) == 0 {
+		return "-"
+	}
+	return strings.ToUpper(hex.EncodeToString(salt))
+}
+
+func formatSignatureTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format(signatureTimeFormat)
+}
+
+func parseSignatureTime(s string) (uint32, error) {
+	if len(s) == len(signatureTimeFormat) {
+		t, err := time.Parse(signatureTimeFormat, s)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(t.Unix()), nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
+
+// absoluteName completes a name from a zone file with the origin unless it is already absolute
+func absoluteName(name string, origin string) string {
+	if name == "@" {
+		return origin
+	}
+	if strings.HasSuffix(name, ".") {
+		return strings.TrimSuffix(name, ".")
+	}
+	if origin == "" {
+		return name
+	}
+	return name + "." + origin
+}
+
+// parseRecord parses a single record in presentation format.
+// Relative names are completed with origin and a missing ttl defaults to defaultTTL.
+func parseRecord(line string, origin string, defaultTTL uint32) (*DnsRecord, error) {
+	return parseRecordFields(strings.Fields(line), origin, defaultTTL)
+}
+
+// parseRecordFields parses a record from its whitespace separated fields, starting with the owner name
+func parseRecordFields(fields []string, origin string, defaultTTL uint32) (*DnsRecord, error) {
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid record: %q", strings.Join(fields, " "))
+	}
+
+	record := NewDnsRecord()
+	record.domain = absoluteName(fields[0], origin)
+	record.ttl = defaultTTL
+
+	// the ttl and class are optional and may appear in either order
+	i := 1
+	for ; i < len(fields)-1; i++ {
+		if strings.EqualFold(fields[i], "IN") {
+			continue
+		}
+		ttl, err := strconv.ParseUint(fields[i], 10, 32)
+		if err != nil {
+			break
+		}
+		record.ttl = uint32(ttl)
+	}
+
+	qType, err := parseQueryType(fields[i])
+	if err != nil {
+		return nil, err
+	}
+	record.qType = qType
+
+	if err := record.parseData(fields[i+1:], origin); err != nil {
+		return nil, fmt.Errorf("invalid %s record %s: %v", qType, record.domain, err)
+	}
+	return record, nil
+}
+
+func (d *DnsRecord) parseData(fields []string, origin string) error {
+	minFields := map[QueryType]int{
+		A: 1, AAAA: 1, NS: 1, CNAME: 1, PTR: 1, MX: 2, SOA: 7, DNSKEY: 4, DS: 4, RRSIG: 9, NSEC: 1, NSEC3: 5, NSEC3PARAM: 4,
+	}
+	if len(fields) < minFields[d.qType] {
+		return errors.New("missing fields")
+	}
+
+	var err error
+	switch d.qType {
+	case A:
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid address %q", fields[0])
+		}
+		d.addr = ip.String()
+	case AAAA:
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid address %q", fields[0])
+		}
+		d.addr = ip.String()
+	case NS, CNAME, PTR:
+		d.host = absoluteName(fields[0], origin)
+	case MX:
+		d.priority, err = parseUint16(fields[0])
+		d.host = absoluteName(fields[1], origin)
+	case SOA:
+		d.host = absoluteName(fields[0], origin)
+		d.mailbox = absoluteName(fields[1], origin)
+		for i, v := range []*uint32{&d.serial, &d.refresh, &d.retry, &d.expire, &d.minimum} {
+			n, perr := strconv.ParseUint(fields[2+i], 10, 32)
+			if perr != nil {
+				return perr
+			}
+			*v = uint32(n)
+		}
+	case DNSKEY:
+		if d.flags, err = parseUint16(fields[0]); err != nil {
+			return err
+		}
+		if d.protocol, err = parseUint8(fields[1]); err != nil {
+			return err
+		}
+		if d.algorithm, err = parseUint8(fields[2]); err != nil {
+			return err
+		}
+		d.publicKey, err = base64.StdEncoding.DecodeString(strings.Join(fields[3:], ""))
+	case DS:
+		if d.keyTag, err = parseUint16(fields[0]); err != nil {
+			return err
+		}
+		if d.algorithm, err = parseUint8(fields[1]); err != nil {
+			return err
+		}
+		if d.digestType, err = parseUint8(fields[2]); err != nil {
+			return err
+		}
+		d.digest, err = hex.DecodeString(strings.Join(fields[3:], ""))
+	case RRSIG:
+		if d.typeCovered, err = parseQueryType(fields[0]); err != nil {
+			return err
+		}
+		if d.algorithm, err = parseUint8(fields[1]); err != nil {
+			return err
+		}
+		if d.labels, err = parseUint8(fields[2]); err != nil {
+			return err
+		}
+		originalTTL, perr := strconv.ParseUint(fields[3], 10, 32)
+		if perr != nil {
+			return perr
+		}
+		d.originalTTL = uint32(originalTTL)
+		if d.expiration, err = parseSignatureTime(fields[4]); err != nil {
+			return err
+		}
+		if d.inception, err = parseSignatureTime(fields[5]); err != nil {
+			return err
+		}
+		if d.keyTag, err = parseUint16(fields[6]); err != nil {
+			return err
+		}
+		d.signerName = absoluteName(fields[7], origin)
+		d.signature, err = base64.StdEncoding.DecodeString(strings.Join(fields[8:], ""))
+	case NSEC:
+		d.nextDomain = absoluteName(fields[0], origin)
+		d.typeBitMap, err = parseTypes(fields[1:])
+	case NSEC3, NSEC3PARAM:
+		if d.hashAlgorithm, err = parseUint8(fields[0]); err != nil {
+			return err
+		}
+		flags, perr := parseUint8(fields[1])
+		if perr != nil {
+			return perr
+		}
+		d.flags = uint16(flags)
+		if d.iterations, err = parseUint16(fields[2]); err != nil {
+			return err
+		}
+		if fields[3] != "-" {
+			if d.salt, err = hex.DecodeString(fields[3]); err != nil {
+				return err
+			}
+		}
+		if d.qType == NSEC3 {
+			if d.nextHashed, err = base32Hex.DecodeString(strings.ToUpper(fields[4])); err != nil {
+				return err
+			}
+			d.typeBitMap, err = parseTypes(fields[5:])
+		}
+	default:
+		// unknown record format of RFC 3597: \# length hex
+		if len(fields) < 2 || fields[0] != `\#` {
+			return errors.New("unsupported record data")
+		}
+		d.data, err = hex.DecodeString(strings.Join(fields[2:], ""))
+		if err == nil && strconv.Itoa(len(d.data)) != fields[1] {
+			err = errors.New("data length mismatch")
+		}
+	}
+	return err
+}
+
+func parseTypes(fields []string) ([]QueryType, error) {
+	var types []QueryType
+	for _, f := range fields {
+		t, err := parseQueryType(f)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+func parseUint8(s string) (uint8, error) {
+	n, err := strconv.ParseUint(s, 10, 8)
+	return uint8(n), err
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	return uint16(n), err
+}
@@ -1,16 +1,81 @@
 package main
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type QueryType int
 
 const (
-	UNKNOWN QueryType = 0
-	A       QueryType = 1
-	NS      QueryType = 2
-	CNAME   QueryType = 5
-	MX      QueryType = 15
-	AAAA    QueryType = 28
+	UNKNOWN    QueryType = 0
+	A          QueryType = 1
+	NS         QueryType = 2
+	CNAME      QueryType = 5
+	SOA        QueryType = 6
+	PTR        QueryType = 12
+	MX         QueryType = 15
+	AAAA       QueryType = 28
+	OPT        QueryType = 41
+	DS         QueryType = 43
+	RRSIG      QueryType = 46
+	NSEC       QueryType = 47
+	DNSKEY     QueryType = 48
+	NSEC3      QueryType = 50
+	NSEC3PARAM QueryType = 51
+	TSIG       QueryType = 250
+	IXFR       QueryType = 251
+	AXFR       QueryType = 252
+	ANY        QueryType = 255
 )
 
+var queryTypeNames = map[QueryType]string{
+	A:          "A",
+	NS:         "NS",
+	CNAME:      "CNAME",
+	SOA:        "SOA",
+	PTR:        "PTR",
+	MX:         "MX",
+	AAAA:       "AAAA",
+	OPT:        "OPT",
+	DS:         "DS",
+	RRSIG:      "RRSIG",
+	NSEC:       "NSEC",
+	DNSKEY:     "DNSKEY",
+	NSEC3:      "NSEC3",
+	NSEC3PARAM: "NSEC3PARAM",
+	TSIG:       "TSIG",
+	IXFR:       "IXFR",
+	AXFR:       "AXFR",
+	ANY:        "ANY",
+}
+
+// String returns the mnemonic of the query type, or TYPEnnn (RFC 3597) when there is none
+func (q QueryType) String() string {
+	if name, ok := queryTypeNames[q]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(q))
+}
+
+// parseQueryType parses a query type mnemonic or its TYPEnnn form
+func parseQueryType(s string) (QueryType, error) {
+	s = strings.ToUpper(s)
+	for qtype, name := range queryTypeNames {
+		if name == s {
+			return qtype, nil
+		}
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		n, err := strconv.ParseUint(s[4:], 10, 16)
+		if err == nil {
+			return QueryType(n), nil
+		}
+	}
+	return UNKNOWN, fmt.Errorf("unknown record type: %s", s)
+}
+
 type DnsQuestion struct {
 	name  string
 	qtype QueryType
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+)
+
+// Networks not reachable from the internet: unspecified, RFC 1918, loopback, link-local and unique local addresses
+var PRIVATE_NETWORKS = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16",
+	"::/128", "::1/128", "fe80::/10", "fc00::/7",
+}
+
+// RebindingFilter protects clients against DNS rebinding by keeping private addresses out of the answers
+// of upstream servers, except for the names of internal domains
+type RebindingFilter struct {
+	networks []*net.IPNet
+	allowed  *DomainTrie // internal domains and their subdomains
+	block    bool        // refuse answers with private addresses instead of removing the addresses
+}
+
+// NewRebindingFilter creates a new RebindingFilter removing private addresses of all domains
+func NewRebindingFilter() *RebindingFilter {
+	networks, _ := parseNetworks(PRIVATE_NETWORKS)
+	return &RebindingFilter{networks: networks, allowed: NewDomainTrie()}
+}
+
+// private reports whether the A or AAAA record has a private address
+func (f *RebindingFilter) private(r *DnsRecord) bool {
+	if r.qType != A && r.qType != AAAA {
+		return false
+	}
+	ip := net.ParseIP(r.addr)
+	return ip != nil && containsIP(f.networks, ip)
+}
+
+// filter returns the answer without the private addresses of names outside of the internal domains,
+// or a refusal when the filter blocks such answers
+func (f *RebindingFilter) filter(question DnsQuestion, packet *DnsPacket) *DnsPacket {
+	// the question name decides, as a public name may be an alias of an internal name
+	if f.allowed.match(question.name) {
+		return packet
+	}
+	var answers []DnsRecord
+	var removed []string
+	for _, r := range packet.answers {
+		if f.private(&r) {
+			removed = append(removed, r.addr)
+			continue
+		}
+		answers = append(answers, r)
+	}
+	if len(removed) == 0 {
+		return packet
+	}
+
+	log.Printf("possible DNS rebinding: %s %s answered with %s\n", question.name, question.qtype, strings.Join(removed, ", "))
+	filtered := NewDnsPacket()
+	filtered.header = packet.header
+	if f.block {
+		filtered.header.resCode = Refused
+		return filtered
+	}
+	filtered.answers = answers
+	filtered.authorities = packet.authorities
+	filtered.resources = packet.resources
+	return filtered
+}
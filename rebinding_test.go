@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebindingFilter(t *testing.T) {
+	config := RebindingConfig{AllowedDomains: []string{"corp.example.com"}}
+	filter := config.newRebindingFilter()
+
+	testcases := []struct {
+		name    string
+		addrs   []string
+		block   bool
+		resCode ResultCode
+		kept    []string
+	}{
+		{name: "public", addrs: []string{"192.0.2.1", "2001:db8::1"}, kept: []string{"192.0.2.1", "2001:db8::1"}},
+		{name: "rfc 1918", addrs: []string{"192.0.2.1", "10.1.2.3", "172.16.0.1", "192.168.1.1"}, kept: []string{"192.0.2.1"}},
+		{name: "loopback and link-local", addrs: []string{"127.0.0.1", "169.254.1.1", "::1", "fe80::1"}},
+		{name: "unique local and unspecified", addrs: []string{"fd00::1", "0.0.0.0", "::"}},
+		{name: "ipv4-mapped", addrs: []string{"::ffff:10.0.0.1"}},
+		{name: "block", addrs: []string{"192.0.2.1", "10.0.0.1"}, block: true, resCode: Refused},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			filter.block = tc.block
+			packet := NewDnsPacket()
+			for _, addr := range tc.addrs {
+				packet.answers = append(packet.answers, DnsRecord{qType: A, domain: "www.example.com", ttl: 60, addr: addr})
+			}
+
+			filtered := filter.filter(DnsQuestion{name: "www.example.com", qtype: A}, packet)
+			assert.Equal(t, tc.resCode, filtered.header.resCode)
+			var kept []string
+			for _, r := range filtered.answers {
+				kept = append(kept, r.addr)
+			}
+			assert.Equal(t, tc.kept, kept)
+		})
+	}
+
+	t.Run("internal domain", func(t *testing.T) {
+		filter.block = false
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{
+			{qType: CNAME, domain: "wiki.corp.example.com", ttl: 60, host: "app.corp.example.com"},
+			{qType: A, domain: "app.corp.example.com", ttl: 60, addr: "10.0.0.1"},
+		}
+		filtered := filter.filter(DnsQuestion{name: "wiki.corp.example.com", qtype: A}, packet)
+		assert.Equal(t, packet, filtered)
+	})
+
+	t.Run("public alias of an internal domain", func(t *testing.T) {
+		filter.block = true
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{
+			{qType: CNAME, domain: "app.example.com", ttl: 60, host: "app.corp.example.com"},
+			{qType: A, domain: "app.corp.example.com", ttl: 60, addr: "10.0.0.1"},
+		}
+		filtered := filter.filter(DnsQuestion{name: "app.example.com", qtype: A}, packet)
+		assert.Equal(t, Refused, filtered.header.resCode)
+		assert.Empty(t, filtered.answers)
+	})
+}
@@ -1,17 +1,77 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+)
+
+// Record classes; UPDATE messages use ANY and NONE in their prerequisites and deletions
+const (
+	CLASS_IN   uint16 = 1
+	CLASS_NONE uint16 = 254
+	CLASS_ANY  uint16 = 255
 )
 
 type DnsRecord struct {
 	qType    QueryType
 	domain   string
+	class    uint16 // zero for IN
 	ttl      uint32
 	addr     string
 	host     string
 	priority uint16
+
+	// SOA
+	mailbox string
+	serial  uint32
+	refresh uint32
+	retry   uint32
+	expire  uint32
+	minimum uint32
+
+	// DNSKEY, DS and RRSIG
+	flags       uint16 // DNSKEY flags, or the NSEC3/NSEC3PARAM flags octet
+	protocol    uint8
+	algorithm   uint8
+	publicKey   []byte
+	keyTag      uint16
+	digestType  uint8
+	digest      []byte
+	typeCovered QueryType
+	labels      uint8
+	originalTTL uint32
+	expiration  uint32
+	inception   uint32
+	signerName  string
+	signature   []byte
+
+	// NSEC, NSEC3 and NSEC3PARAM
+	nextDomain    string
+	nextHashed    []byte
+	typeBitMap    []QueryType
+	hashAlgorithm uint8
+	iterations    uint16
+	salt          []byte
+
+	// TSIG pseudo-record
+	algorithmName string
+	timeSigned    uint64 // 48 bit seconds since the epoch
+	fudge         uint16
+	mac           []byte
+	originalID    uint16
+	tsigError     ResultCode
+	otherData     []byte
+
+	// OPT pseudo-record; the ttl holds the extended rcode and flags
+	udpSize uint16
+	options []EdnsOption
+
+	// raw rdata of record types without typed support, kept so they can be written back
+	data []byte
+	// empty is set for records without rdata, as in the prerequisites and deletions of UPDATE messages
+	empty bool
 }
 
 // NewDnsRecord creates a new DnsRecord
@@ -30,11 +90,12 @@ func (d *DnsRecord) read(buf *BytePacketBuffer) error {
 	if err != nil {
 		return err
 	}
-	if QueryType(qType) != A && QueryType(qType) != NS && QueryType(qType) != CNAME && QueryType(qType) != MX && QueryType(qType) != AAAA {
-		qType = uint16(UNKNOWN)
-	}
+	d.qType = QueryType(qType)
 
-	buf.read2Byte() // class
+	class, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
 
 	ttl, err := buf.read4Byte()
 	if err != nil {
@@ -46,29 +107,30 @@ func (d *DnsRecord) read(buf *BytePacketBuffer) error {
 	if err != nil {
 		return err
 	}
+	end := buf.position() + uint(dataLen)
+
+	if d.qType != OPT && class != CLASS_IN {
+		d.class = class
+	}
+	if dataLen == 0 && d.qType != OPT {
+		d.empty = true
+		return nil
+	}
 
-	if QueryType(qType) == A {
+	switch d.qType {
+	case A:
 		rawAddr, err := buf.read4Byte()
 		if err != nil {
 			return err
 		}
 		d.addr = fmt.Sprintf("%d.%d.%d.%d", (rawAddr>>24)&0xFF, (rawAddr>>16)&0xFF, (rawAddr>>8)&0xFF, rawAddr&0xFF)
-		d.qType = A
-	} else if QueryType(qType) == CNAME {
+	case NS, CNAME, PTR:
 		host, err := buf.readQName()
 		if err != nil {
 			return err
 		}
 		d.host = host
-		d.qType = CNAME
-	} else if QueryType(qType) == NS {
-		host, err := buf.readQName()
-		if err != nil {
-			return err
-		}
-		d.host = host
-		d.qType = NS
-	} else if QueryType(qType) == MX {
+	case MX:
 		priority, err := buf.read2Byte()
 		if err != nil {
 			return err
@@ -80,8 +142,7 @@ func (d *DnsRecord) read(buf *BytePacketBuffer) error {
 
 		d.priority = priority
 		d.host = host
-		d.qType = MX
-	} else if QueryType(qType) == AAAA {
+	case AAAA:
 		addr1, err := buf.read4Byte()
 		if err != nil {
 			return err
@@ -100,11 +161,282 @@ func (d *DnsRecord) read(buf *BytePacketBuffer) error {
 		}
 		addr := fmt.Sprintf("%x:%x:%x:%x:%x:%x:%x:%x", (addr1>>16)&0xFFFF, addr1&0xFFFF, (addr2>>16)&0xFFFF, addr2&0xFFFF, (addr3>>16)&0xFFFF, addr3&0xFFFF, (addr4>>16)&0xFFFF, addr4&0xFFFF)
 		d.addr = addr
-		d.qType = AAAA
-	} else if QueryType(qType) == UNKNOWN {
-		buf.pos += uint(dataLen)
+	case SOA:
+		if err := d.readSOA(buf); err != nil {
+			return err
+		}
+	case DNSKEY:
+		if err := d.readDNSKEY(buf, end); err != nil {
+			return err
+		}
+	case DS:
+		if err := d.readDS(buf, end); err != nil {
+			return err
+		}
+	case RRSIG:
+		if err := d.readRRSIG(buf, end); err != nil {
+			return err
+		}
+	case NSEC:
+		nextDomain, err := buf.readQName()
+		if err != nil {
+			return err
+		}
+		d.nextDomain = nextDomain
+		types, err := readTypeBitMap(buf, end)
+		if err != nil {
+			return err
+		}
+		d.typeBitMap = types
+	case NSEC3, NSEC3PARAM:
+		if err := d.readNSEC3(buf, end); err != nil {
+			return err
+		}
+	case TSIG:
+		if err := d.readTSIG(buf); err != nil {
+			return err
+		}
+	case OPT:
+		d.udpSize = class
+		options, err := readEdnsOptions(buf, end)
+		if err != nil {
+			return err
+		}
+		d.options = options
+	default:
+		data, err := buf.readRange(uint(dataLen))
+		if err != nil {
+			return err
+		}
+		d.data = data
+	}
+
+	buf.seek(end)
+	return nil
+}
+
+func (d *DnsRecord) readSOA(buf *BytePacketBuffer) error {
+	host, err := buf.readQName()
+	if err != nil {
+		return err
+	}
+	mailbox, err := buf.readQName()
+	if err != nil {
+		return err
+	}
+	d.host = host
+	d.mailbox = mailbox
+
+	for _, v := range []*uint32{&d.serial, &d.refresh, &d.retry, &d.expire, &d.minimum} {
+		n, err := buf.read4Byte()
+		if err != nil {
+			return err
+		}
+		*v = n
+	}
+	return nil
+}
+
+func (d *DnsRecord) readDNSKEY(buf *BytePacketBuffer, end uint) error {
+	flags, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	protocol, err := buf.read()
+	if err != nil {
+		return err
+	}
+	algorithm, err := buf.read()
+	if err != nil {
+		return err
+	}
+	if buf.position() > end {
+		return errors.New("invalid DNSKEY record")
+	}
+	publicKey, err := buf.readRange(end - buf.position())
+	if err != nil {
+		return err
+	}
+
+	d.flags = flags
+	d.protocol = protocol
+	d.algorithm = algorithm
+	d.publicKey = publicKey
+	return nil
+}
+
+func (d *DnsRecord) readDS(buf *BytePacketBuffer, end uint) error {
+	keyTag, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	algorithm, err := buf.read()
+	if err != nil {
+		return err
+	}
+	digestType, err := buf.read()
+	if err != nil {
+		return err
+	}
+	if buf.position() > end {
+		return errors.New("invalid DS record")
+	}
+	digest, err := buf.readRange(end - buf.position())
+	if err != nil {
+		return err
+	}
+
+	d.keyTag = keyTag
+	d.algorithm = algorithm
+	d.digestType = digestType
+	d.digest = digest
+	return nil
+}
+
+func (d *DnsRecord) readRRSIG(buf *BytePacketBuffer, end uint) error {
+	typeCovered, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	algorithm, err := buf.read()
+	if err != nil {
+		return err
+	}
+	labels, err := buf.read()
+	if err != nil {
+		return err
+	}
+	d.typeCovered = QueryType(typeCovered)
+	d.algorithm = algorithm
+	d.labels = labels
+
+	for _, v := range []*uint32{&d.originalTTL, &d.expiration, &d.inception} {
+		n, err := buf.read4Byte()
+		if err != nil {
+			return err
+		}
+		*v = n
+	}
+
+	keyTag, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	signerName, err := buf.readQName()
+	if err != nil {
+		return err
+	}
+	if buf.position() > end {
+		return errors.New("invalid RRSIG record")
+	}
+	signature, err := buf.readRange(end - buf.position())
+	if err != nil {
+		return err
 	}
 
+	d.keyTag = keyTag
+	d.signerName = signerName
+	d.signature = signature
+	return nil
+}
+
+func (d *DnsRecord) readNSEC3(buf *BytePacketBuffer, end uint) error {
+	hashAlgorithm, err := buf.read()
+	if err != nil {
+		return err
+	}
+	flags, err := buf.read()
+	if err != nil {
+		return err
+	}
+	iterations, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	saltLen, err := buf.read()
+	if err != nil {
+		return err
+	}
+	salt, err := buf.readRange(uint(saltLen))
+	if err != nil {
+		return err
+	}
+
+	d.hashAlgorithm = hashAlgorithm
+	d.flags = uint16(flags)
+	d.iterations = iterations
+	d.salt = salt
+	if d.qType == NSEC3PARAM {
+		return nil
+	}
+
+	hashLen, err := buf.read()
+	if err != nil {
+		return err
+	}
+	nextHashed, err := buf.readRange(uint(hashLen))
+	if err != nil {
+		return err
+	}
+	types, err := readTypeBitMap(buf, end)
+	if err != nil {
+		return err
+	}
+
+	d.nextHashed = nextHashed
+	d.typeBitMap = types
+	return nil
+}
+
+func (d *DnsRecord) readTSIG(buf *BytePacketBuffer) error {
+	algorithmName, err := buf.readQName()
+	if err != nil {
+		return err
+	}
+	timeHigh, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	timeLow, err := buf.read4Byte()
+	if err != nil {
+		return err
+	}
+	fudge, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	macSize, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	mac, err := buf.readRange(uint(macSize))
+	if err != nil {
+		return err
+	}
+	originalID, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	tsigError, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	otherLen, err := buf.read2Byte()
+	if err != nil {
+		return err
+	}
+	otherData, err := buf.readRange(uint(otherLen))
+	if err != nil {
+		return err
+	}
+
+	d.algorithmName = algorithmName
+	d.timeSigned = uint64(timeHigh)<<32 | uint64(timeLow)
+	d.fudge = fudge
+	d.mac = mac
+	d.originalID = originalID
+	d.tsigError = ResultCode(tsigError)
+	d.otherData = otherData
 	return nil
 }
 
@@ -114,22 +446,253 @@ func (d *DnsRecord) write(buf *BytePacketBuffer) error {
 		return err
 	}
 	// write resource type to buffer
-	if err := buf.write2Byte(uint16(A)); err != nil {
+	if err := buf.write2Byte(uint16(d.qType)); err != nil {
+		return err
+	}
+	class := d.class
+	if d.qType == OPT {
+		class = d.udpSize
+	} else if class == 0 {
+		class = CLASS_IN
+	}
+	if err := buf.write2Byte(class); err != nil {
 		return err
 	}
-	buf.write2Byte(1) // class
 	// write ttl to buffer
 	if err := buf.write4Byte(d.ttl); err != nil {
 		return err
 	}
-	buf.write2Byte(4)
 
-	ip := net.ParseIP(d.addr)
-	ipv4 := ip.To4()
-	buf.write(ipv4[0])
-	buf.write(ipv4[1])
-	buf.write(ipv4[2])
-	buf.write(ipv4[3])
+	// the data length is only known once the data has been written
+	lenPos := buf.position()
+	if err := buf.write2Byte(0); err != nil {
+		return err
+	}
+	if err := d.writeData(buf); err != nil {
+		return err
+	}
+	return buf.set2Byte(lenPos, uint16(buf.position()-lenPos-2))
+}
 
+// writeData writes the record data (RDATA) to the buffer
+func (d *DnsRecord) writeData(buf *BytePacketBuffer) error {
+	if d.empty {
+		return nil
+	}
+	switch d.qType {
+	case A:
+		ipv4 := net.ParseIP(d.addr).To4()
+		if ipv4 == nil {
+			return fmt.Errorf("invalid A record address: %q", d.addr)
+		}
+		return buf.writeRange(ipv4)
+	case NS, CNAME, PTR:
+		return buf.writeQName(d.host)
+	case MX:
+		if err := buf.write2Byte(d.priority); err != nil {
+			return err
+		}
+		return buf.writeQName(d.host)
+	case AAAA:
+		ip := net.ParseIP(d.addr)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid AAAA record address: %q", d.addr)
+		}
+		return buf.writeRange(ip.To16())
+	case SOA:
+		if err := buf.writeQName(d.host); err != nil {
+			return err
+		}
+		if err := buf.writeQName(d.mailbox); err != nil {
+			return err
+		}
+		for _, v := range []uint32{d.serial, d.refresh, d.retry, d.expire, d.minimum} {
+			if err := buf.write4Byte(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	case DNSKEY:
+		if err := buf.write2Byte(d.flags); err != nil {
+			return err
+		}
+		if err := buf.write(d.protocol); err != nil {
+			return err
+		}
+		if err := buf.write(d.algorithm); err != nil {
+			return err
+		}
+		return buf.writeRange(d.publicKey)
+	case DS:
+		if err := buf.write2Byte(d.keyTag); err != nil {
+			return err
+		}
+		if err := buf.write(d.algorithm); err != nil {
+			return err
+		}
+		if err := buf.write(d.digestType); err != nil {
+			return err
+		}
+		return buf.writeRange(d.digest)
+	case RRSIG:
+		if err := d.writeRRSIGData(buf); err != nil {
+			return err
+		}
+		return buf.writeRange(d.signature)
+	case NSEC:
+		if err := buf.writeQName(d.nextDomain); err != nil {
+			return err
+		}
+		return writeTypeBitMap(buf, d.typeBitMap)
+	case NSEC3, NSEC3PARAM:
+		if err := buf.write(d.hashAlgorithm); err != nil {
+			return err
+		}
+		if err := buf.write(uint8(d.flags)); err != nil {
+			return err
+		}
+		if err := buf.write2Byte(d.iterations); err != nil {
+			return err
+		}
+		if err := buf.write(uint8(len(d.salt))); err != nil {
+			return err
+		}
+		if err := buf.writeRange(d.salt); err != nil {
+			return err
+		}
+		if d.qType == NSEC3PARAM {
+			return nil
+		}
+		if err := buf.write(uint8(len(d.nextHashed))); err != nil {
+			return err
+		}
+		if err := buf.writeRange(d.nextHashed); err != nil {
+			return err
+		}
+		return writeTypeBitMap(buf, d.typeBitMap)
+	case TSIG:
+		if err := buf.writeQName(d.algorithmName); err != nil {
+			return err
+		}
+		if err := d.writeTSIGTimers(buf); err != nil {
+			return err
+		}
+		if err := buf.write2Byte(uint16(len(d.mac))); err != nil {
+			return err
+		}
+		if err := buf.writeRange(d.mac); err != nil {
+			return err
+		}
+		if err := buf.write2Byte(d.originalID); err != nil {
+			return err
+		}
+		return d.writeTSIGError(buf)
+	case OPT:
+		return writeEdnsOptions(buf, d.options)
+	default:
+		return buf.writeRange(d.data)
+	}
+}
+
+// writeTSIGTimers writes the time signed and fudge of a TSIG record
+func (d *DnsRecord) writeTSIGTimers(buf *BytePacketBuffer) error {
+	if err := buf.write2Byte(uint16(d.timeSigned >> 32)); err != nil {
+		return err
+	}
+	if err := buf.write4Byte(uint32(d.timeSigned)); err != nil {
+		return err
+	}
+	return buf.write2Byte(d.fudge)
+}
+
+// writeTSIGError writes the error and other data of a TSIG record
+func (d *DnsRecord) writeTSIGError(buf *BytePacketBuffer) error {
+	if err := buf.write2Byte(uint16(d.tsigError)); err != nil {
+		return err
+	}
+	if err := buf.write2Byte(uint16(len(d.otherData))); err != nil {
+		return err
+	}
+	return buf.writeRange(d.otherData)
+}
+
+// writeRRSIGData writes the RRSIG data up to, but not including, the signature
+func (d *DnsRecord) writeRRSIGData(buf *BytePacketBuffer) error {
+	if err := buf.write2Byte(uint16(d.typeCovered)); err != nil {
+		return err
+	}
+	if err := buf.write(d.algorithm); err != nil {
+		return err
+	}
+	if err := buf.write(d.labels); err != nil {
+		return err
+	}
+	for _, v := range []uint32{d.originalTTL, d.expiration, d.inception} {
+		if err := buf.write4Byte(v); err != nil {
+			return err
+		}
+	}
+	if err := buf.write2Byte(d.keyTag); err != nil {
+		return err
+	}
+	return buf.writeQName(d.signerName)
+}
+
+// readTypeBitMap reads an NSEC/NSEC3 type bitmap ending at the end position
+func readTypeBitMap(buf *BytePacketBuffer, end uint) ([]QueryType, error) {
+	var types []QueryType
+	for buf.position() < end {
+		window, err := buf.read()
+		if err != nil {
+			return nil, err
+		}
+		length, err := buf.read()
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 || length > 32 {
+			return nil, errors.New("invalid type bitmap")
+		}
+		bitmap, err := buf.readRange(uint(length))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, octet := range bitmap {
+			for bit := 0; bit < 8; bit++ {
+				if octet&(0x80>>bit) != 0 {
+					types = append(types, QueryType(int(window)<<8|i*8+bit))
+				}
+			}
+		}
+	}
+	return types, nil
+}
+
+// writeTypeBitMap writes the types as an NSEC/NSEC3 type bitmap, one block per window
+func writeTypeBitMap(buf *BytePacketBuffer, types []QueryType) error {
+	sorted := append([]QueryType(nil), types...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for i := 0; i < len(sorted); {
+		window := sorted[i] >> 8
+		var bitmap [32]uint8
+		length := 0
+		for ; i < len(sorted) && sorted[i]>>8 == window; i++ {
+			low := int(sorted[i] & 0xFF)
+			bitmap[low/8] |= 0x80 >> (low % 8)
+			length = low/8 + 1
+		}
+
+		if err := buf.write(uint8(window)); err != nil {
+			return err
+		}
+		if err := buf.write(uint8(length)); err != nil {
+			return err
+		}
+		if err := buf.writeRange(bitmap[:length]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
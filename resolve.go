@@ -1,13 +1,25 @@
 package main
 
-import "net"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
 
-// Send Queries to Google's DNS server
-const serverAddr = "8.8.8.8:53"
+// Maximum number of udp queries answered at the same time
+const MAX_UDP_QUERIES = 512
 
-// handleQuery handles incoming single queries
+// udpQueries holds a slot for each udp query being answered
+var udpQueries = make(chan struct{}, MAX_UDP_QUERIES)
+
+// handleQuery reads a single query and answers it in its own goroutine, so that clients
+// do not wait for the upstream lookups of other clients. Queries beyond the maximum
+// number answered at the same time are dropped, the clients retry them.
 func handleQuery(conn *net.UDPConn) error {
-	requestBuf := NewBytePacketBuffer()
+	requestBuf := NewBytePacketBufferSize(EDNS_BUFFER_SIZE)
 	// Read incoming query from the connection and get the address of the client
 	_, addr, err := conn.ReadFromUDP(requestBuf.buf)
 	if err != nil {
@@ -20,30 +32,47 @@ func handleQuery(conn *net.UDPConn) error {
 		return err
 	}
 
-	// Create a new packet and set the header
-	packet := NewDnsPacket()
-	packet.header = DnsHeader{id: request.header.id, recursionDesired: true, recursionAvailable: true, response: true}
-	packet.questions = append(packet.questions, request.questions...)
+	select {
+	case udpQueries <- struct{}{}:
+	default:
+		return nil
+	}
+	go func() {
+		defer func() { <-udpQueries }()
+		if err := answerQuery(conn, request, addr); err != nil {
+			log.Printf("error answering query from %s: %v\n", addr, err)
+		}
+	}()
+	return nil
+}
 
-	question := request.questions[0]
-	// Lookup the domain name and query type
-	result, err := lookup(question.name, question.qtype)
-	if err != nil {
+// answerQuery sends the response to the query over udp
+func answerQuery(conn *net.UDPConn, request *DnsPacket, addr *net.UDPAddr) error {
+	serving.RLock()
+	defer serving.RUnlock()
+
+	packet, err := buildResponse(request, clientIP(addr), false)
+	if err != nil || packet == nil {
 		return err
 	}
-	packet.header.resCode = result.header.resCode
-	packet.answers = append(packet.answers, result.answers...)
-	packet.authorities = append(packet.authorities, result.authorities...)
-	packet.resources = append(packet.resources, result.resources...)
 
-	// write the response to the buffer
-	resBuffer := NewBytePacketBuffer()
-	if err := packet.write(resBuffer); err != nil {
-		return err
+	size := MAX_PACKET_SIZE
+	if requestOpt := request.edns(); requestOpt != nil {
+		size = max(size, min(int(requestOpt.udpSize), EDNS_BUFFER_SIZE))
 	}
 
-	len := resBuffer.position()
-	data, err := resBuffer.getRange(0, len)
+	// clients proving their address with a valid cookie are not rate limited
+	if rateLimiter != nil && !cookies.valid(request, clientIP(addr)) {
+		switch rateLimiter.check(clientIP(addr), packet, time.Now()) {
+		case RRLDrop:
+			return nil
+		case RRLSlip:
+			packet = truncate(packet)
+		}
+	}
+
+	// write the response to the buffer
+	data, err := writeResponse(packet, size)
 	if err != nil {
 		return err
 	}
@@ -56,40 +85,289 @@ func handleQuery(conn *net.UDPConn) error {
 	return nil
 }
 
-// lookup queries the domain name and returns the response
-func lookup(domain string, qtype QueryType) (*DnsPacket, error) {
-	// create a new udp connection to listen on port 43210
-	udpAddr, _ := net.ResolveUDPAddr("udp", "0.0.0.0:43210")
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return nil, err
+// buildResponse answers the request from the local zones, the hosts files or by looking it up upstream
+// unless the name is blocked. A nil response without error means that no response is sent.
+func buildResponse(request *DnsPacket, client net.IP, tcp bool) (*DnsPacket, error) {
+	// Create a new packet and set the header
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{id: request.header.id, recursionDesired: true, recursionAvailable: true, response: true}
+	packet.questions = append(packet.questions, request.questions...)
+
+	if resCode := verifyRequest(request); resCode != NoError {
+		packet.header.opcode = request.header.opcode
+		packet.header.resCode = resCode
+		packet.tsig = request.tsig
+		return packet, nil
 	}
-	defer conn.Close()
 
-	// create a new dns packet and set the header
-	packet := NewDnsPacket()
-	requestBuf := NewBytePacketBuffer()
-	packet.header = DnsHeader{id: 6666, questions: 1, recursionDesired: true}
-	packet.questions = []DnsQuestion{{name: domain, qtype: qtype}}
-	packet.write(requestBuf)
+	switch request.header.opcode {
+	case OPCODE_QUERY:
+	case OPCODE_NOTIFY:
+		return answerNotify(request, client), nil
+	case OPCODE_UPDATE:
+		if action := acls.update.check(client); action != ACLAllow {
+			packet.header.opcode = request.header.opcode
+			packet.tsig = request.tsig
+			return aclResponse(request, packet, action, nil), nil
+		}
+		return answerUpdate(request, client), nil
+	default:
+		packet.header.opcode = request.header.opcode
+		packet.header.resCode = NotImp
+		packet.tsig = request.tsig
+		return packet, nil
+	}
+	packet.tsig = request.tsig
 
-	// request dns query to dns Server
-	googleAddr, _ := net.ResolveUDPAddr("udp", serverAddr)
-	if _, err := conn.WriteTo(requestBuf.buf[0:requestBuf.pos], googleAddr); err != nil {
-		return nil, err
+	// DNS cookies let clients prove their address (RFC 7873)
+	cookieStatus, cookie := cookies.check(request, client, time.Now())
+	switch {
+	case cookieStatus == CookieMalformed:
+		packet.header.resCode = Formerr
+		return packet, nil
+	case cookies.required && !tcp && (cookieStatus == CookieClientOnly || cookieStatus == CookieInvalid):
+		// the client retries with the new server cookie
+		packet.resources = []DnsRecord{responseOpt(false, cookie, nil)}
+		packet.setExtendedResCode(BadCookie)
+		return packet, nil
 	}
 
-	// read the response from the dns server
-	responseBuf := NewBytePacketBuffer()
-	if _, _, err := conn.ReadFromUDP(responseBuf.buf); err != nil {
-		return nil, err
+	if len(request.questions) != 1 {
+		packet.header.resCode = Formerr
+		return packet, nil
+	}
+	question := request.questions[0]
+	if question.qtype == AXFR || question.qtype == IXFR {
+		// zone transfers are only served over tcp
+		packet.header.resCode = NotImp
+		return packet, nil
 	}
 
-	// create a new packet and set from the buffer
-	resPacket := NewDnsPacket()
-	if err := resPacket.fromBuffer(responseBuf); err != nil {
-		return nil, err
+	// the answer of a rewritten question is mapped back to the original question
+	original := question
+	question = rewriteQuestion(rewriteRules, question)
+
+	// DNSSEC records are only sent to clients setting the DO bit
+	requestOpt := request.edns()
+	dnssecOK := requestOpt != nil && requestOpt.dnssecOK()
+	validating := validator != nil && !request.header.checkingDisabled
+
+	zone := zones.find(question.name)
+	acl := &acls.recursion
+	if zone != nil {
+		acl = &acls.zones
 	}
+	if action := acl.check(client); action != ACLAllow {
+		return aclResponse(request, packet, action, cookie), nil
+	}
+
+	var result *DnsPacket
+	var err error
+	// extended DNS errors explaining the answer
+	var ede []EdnsOption
+	if zone != nil {
+		// answer from the locally served zone
+		result = zone.answer(question.name, question.qtype, dnssecOK)
+		packet.header.authoritativeAnswer = true
+	} else if answer := hosts.answer(question.name, question.qtype); answer != nil {
+		// answer from the hosts files
+		result = answer
+	} else if answer := blocklist.answer(question.name, question.qtype); answer != nil {
+		result = answer
+		ede = append(ede, newExtendedError(EDEBlocked, "blocklist"))
+	} else {
+		upstream := func() (*DnsPacket, error) {
+			if result != nil {
+				return result, nil
+			}
+			// Lookup the domain name and query type
+			var stale bool
+			if cache != nil {
+				result, stale, err = cache.resolve(question.name, question.qtype, dnssecOK || validating)
+			} else {
+				result, err = lookup(question.name, question.qtype, dnssecOK || validating)
+			}
+			if err != nil {
+				// failed lookups are answered with SERVFAIL, explaining the failure
+				log.Printf("error looking up %s %s: %v\n", question.name, question.qtype, err)
+				var option EdnsOption
+				result, option = lookupError(err)
+				ede = append(ede, option)
+				return result, nil
+			}
+			packet.header.checkingDisabled = request.header.checkingDisabled
+			if stale {
+				code := EDEStaleAnswer
+				if result.header.resCode == NxDomain {
+					code = EDEStaleNxDomainAnswer
+				}
+				ede = append(ede, newExtendedError(code, ""))
+			}
+			// the extended DNS errors of upstream servers are passed on
+			if upstreamErrors := extendedErrors(result); len(upstreamErrors) > 0 {
+				log.Printf("upstream answered %s %s with rcode %d: %s\n", question.name, question.qtype, result.header.resCode, describeExtendedErrors(upstreamErrors))
+				ede = append(ede, upstreamErrors...)
+			}
+
+			if validating {
+				status, reason := validator.validate(question, result)
+				switch status {
+				case Bogus:
+					log.Printf("dnssec validation failed for %s %s: %s\n", question.name, question.qtype, reason)
+					result = NewDnsPacket()
+					result.header.resCode = Servfail
+					ede = append(ede, newExtendedError(EDEDNSSECBogus, reason))
+				case Secure:
+					// the AD bit is set for clients asking for it with either the DO or the AD bit
+					packet.header.authedData = dnssecOK || request.header.authedData
+				}
+			}
+			return result, nil
+		}
+
+		// response policy zones rewrite the answers of upstream servers
+		check := policyCheck{question: question, answer: upstream, query: cachedLookup}
+		policy, err := check.check(policyZones)
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil && policy.action != PolicyPassthru {
+			policy.logQuery(client, question)
+			switch policy.action {
+			case PolicyDrop:
+				return nil, nil
+			case PolicyTCPOnly:
+				if !tcp {
+					packet.header.truncatedMessage = true
+					return packet, nil
+				}
+			default:
+				packet.header.authedData = false
+				result = policy.answer(question, check.query)
+				ede = append(ede, newExtendedError(EDEFiltered, fmt.Sprintf("rpz %s: %s", fqdn(policy.zone), policy.trigger)))
+			}
+		}
+
+		if _, err := upstream(); err != nil {
+			return nil, err
+		}
+
+		rewritten := policy != nil && policy.action != PolicyPassthru
+		if rebinding != nil && !rewritten {
+			if filtered := rebinding.filter(question, result); filtered != result {
+				result = filtered
+				ede = append(ede, newExtendedError(EDEFiltered, "private addresses"))
+			}
+		}
+
+		// DNS64 synthesizes AAAA answers for IPv6-only clients, unless they validate themselves (RFC 6147 5.5)
+		if dns64 != nil && dns64.serves(client) && !rewritten && !(dnssecOK && request.header.checkingDisabled) {
+			synthesized, err := dns64.answer(question, result, check.query)
+			if err != nil {
+				log.Printf("error looking up %s %s for DNS64: %v\n", question.name, question.qtype, err)
+				var option EdnsOption
+				synthesized, option = lookupError(err)
+				ede = append(ede, option)
+			}
+			if synthesized != nil {
+				result = synthesized
+				packet.header.authedData = false
+			}
+		}
+	}
+
+	if question != original {
+		restoreAnswer(result, original, question)
+		packet.header.authedData = false
+	}
+
+	packet.header.resCode = result.header.resCode
+	packet.answers = append(packet.answers, dnssecRecords(result.answers, question.qtype, dnssecOK)...)
+	packet.authorities = append(packet.authorities, dnssecRecords(result.authorities, question.qtype, dnssecOK)...)
+	packet.resources = append(packet.resources, dnssecRecords(result.resources, question.qtype, dnssecOK)...)
+
+	if requestOpt != nil {
+		packet.resources = append(packet.resources, responseOpt(dnssecOK, cookie, ede))
+	}
+	return packet, nil
+}
+
+// responseOpt returns the OPT record of a response with the cookie and the extended DNS errors
+func responseOpt(dnssecOK bool, cookie []byte, ede []EdnsOption) DnsRecord {
+	opt := newOptRecord(EDNS_BUFFER_SIZE, dnssecOK)
+	opt.options = append(cookieOptions(cookie), ede...)
+	return opt
+}
+
+// writeResponse writes the response, truncating it when it does not fit into size bytes
+func writeResponse(packet *DnsPacket, size int) ([]byte, error) {
+	resBuffer := NewBytePacketBufferSize(size)
+	if err := packet.write(resBuffer); err != nil {
+		resBuffer = NewBytePacketBufferSize(size)
+		if err := truncate(packet).write(resBuffer); err != nil {
+			return nil, err
+		}
+	}
+
+	len := resBuffer.position()
+	return resBuffer.getRange(0, len)
+}
+
+// truncate returns the response with only the question, with the TC bit telling the client to retry over tcp
+func truncate(packet *DnsPacket) *DnsPacket {
+	truncated := NewDnsPacket()
+	truncated.header = packet.header
+	truncated.header.truncatedMessage = true
+	truncated.questions = packet.questions
+	truncated.tsig = packet.tsig
+	if opt := packet.edns(); opt != nil {
+		truncated.resources = []DnsRecord{*opt}
+	}
+	return truncated
+}
+
+// dnssecRecords removes the OPT record and, unless dnssecOK is set, the DNSSEC records not asked for
+func dnssecRecords(records []DnsRecord, qtype QueryType, dnssecOK bool) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range records {
+		if r.qType == OPT {
+			continue
+		}
+		if !dnssecOK && r.qType != qtype && (r.qType == RRSIG || r.qType == NSEC || r.qType == NSEC3) {
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// cachedLookup looks up the domain name through the cache when it is enabled
+func cachedLookup(domain string, qtype QueryType) (*DnsPacket, error) {
+	if cache == nil {
+		return lookup(domain, qtype, false)
+	}
+	packet, _, err := cache.resolve(domain, qtype, false)
+	return packet, err
+}
+
+// lookup queries the domain name from the upstream servers of its forwarding rule and returns the response.
+// The query is sent with a DNS cookie. With dnssec set, DNSSEC records are requested and the upstream is asked not to validate.
+// Concurrent lookups of the same question share a single query.
+func lookup(domain string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+	return inflight.do(domain, qtype, dnssec, func() (*DnsPacket, error) {
+		// create a new dns packet and set the header
+		packet := NewDnsPacket()
+		packet.header = DnsHeader{id: newQueryID(), questions: 1, recursionDesired: true, checkingDisabled: dnssec}
+		packet.questions = []DnsQuestion{{name: domain, qtype: qtype}}
+		// the OPT record carries our client cookie
+		packet.resources = []DnsRecord{newOptRecord(EDNS_BUFFER_SIZE, dnssec)}
+		return forwarder.rule(domain).exchange(packet)
+	})
+}
 
-	return resPacket, nil
+// newQueryID returns a random id for an outgoing query
+func newQueryID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
 }
@@ -9,4 +9,19 @@ const (
 	NxDomain
 	NotImp
 	Refused
+	YXDomain
+	YXRRSet
+	NXRRSet
+	NotAuth
+	NotZone
 )
+
+// Extended result codes, carried in the error field of TSIG records
+const (
+	BadSig  ResultCode = 16
+	BadKey  ResultCode = 17
+	BadTime ResultCode = 18
+)
+
+// Extended result code of a missing or invalid server cookie, with its upper bits in the OPT record
+const BadCookie ResultCode = 23
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RewriteRule changes the name or type of the questions it matches before they are answered
+type RewriteRule struct {
+	name   string         // exact name or suffix, empty to match any name
+	suffix bool           // match the name and its subdomains, replacing the suffix
+	regex  *regexp.Regexp // match the whole name, replacing it by to with $1 style groups
+	to     string
+
+	qtype  QueryType // only match questions of the type, UNKNOWN for any type
+	toType QueryType // the type asked instead, UNKNOWN to keep it
+}
+
+// NewRewriteRule creates a new RewriteRule. match is exact, suffix or regex.
+func NewRewriteRule(match string, name string, to string) (*RewriteRule, error) {
+	rule := &RewriteRule{name: strings.ToLower(strings.TrimSuffix(name, ".")), to: strings.ToLower(strings.TrimSuffix(to, "."))}
+	switch match {
+	case "", "exact":
+	case "suffix":
+		rule.suffix = true
+	case "regex":
+		regex, err := regexp.Compile("^(?i:" + name + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid rewrite regex %q: %v", name, err)
+		}
+		rule.regex = regex
+		rule.to = to
+	default:
+		return nil, fmt.Errorf("invalid rewrite match %q", match)
+	}
+	return rule, nil
+}
+
+// apply returns the rewritten question, or false when the rule does not match it
+func (r *RewriteRule) apply(question DnsQuestion) (DnsQuestion, bool) {
+	if r.qtype != UNKNOWN && question.qtype != r.qtype {
+		return question, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(question.name, "."))
+
+	switch {
+	case r.regex != nil:
+		if !r.regex.MatchString(name) {
+			return question, false
+		}
+		name = strings.TrimSuffix(r.regex.ReplaceAllString(name, r.to), ".")
+	case r.name == "":
+		// a rule for the type only
+	case r.suffix && strings.HasSuffix(name, "."+r.name):
+		name = strings.TrimSuffix(name, r.name) + r.to
+	case name == r.name:
+		name = r.to
+	default:
+		return question, false
+	}
+
+	rewritten := DnsQuestion{name: name, qtype: question.qtype}
+	if r.name == "" && r.regex == nil {
+		rewritten.name = question.name
+	}
+	if r.toType != UNKNOWN {
+		rewritten.qtype = r.toType
+	}
+	return rewritten, true
+}
+
+// rewriteQuestion returns the question rewritten by the first matching rule
+func rewriteQuestion(rules []*RewriteRule, question DnsQuestion) DnsQuestion {
+	for _, rule := range rules {
+		if rewritten, ok := rule.apply(question); ok {
+			return rewritten
+		}
+	}
+	return question
+}
+
+// restoreAnswer maps the records of the rewritten question's name back to the original name.
+// Their signatures no longer verify and are removed.
+func restoreAnswer(packet *DnsPacket, original DnsQuestion, rewritten DnsQuestion) {
+	var answers []DnsRecord
+	for _, r := range packet.answers {
+		if strings.EqualFold(r.domain, rewritten.name) {
+			if r.qType == RRSIG {
+				continue
+			}
+			r.domain = original.name
+		}
+		answers = append(answers, r)
+	}
+	packet.answers = answers
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrite(t *testing.T) {
+	var rules []*RewriteRule
+	for _, rc := range []RewriteConfig{
+		{Name: "service.internal", To: "service.prod.example.com"},
+		{Match: "suffix", Name: "corp", To: "corp.example.com."},
+		{Match: "regex", Name: `(\w+)\.(\w+)\.svc`, To: "$1.$2.svc.cluster.local"},
+		{Type: "ANY", ToType: "A"},
+	} {
+		rule, err := rc.newRewriteRule()
+		require.NoError(t, err)
+		rules = append(rules, rule)
+	}
+
+	testcases := []struct {
+		name     string
+		question DnsQuestion
+		expected DnsQuestion
+	}{
+		{name: "exact", question: DnsQuestion{name: "Service.Internal.", qtype: A}, expected: DnsQuestion{name: "service.prod.example.com", qtype: A}},
+		{name: "exact only", question: DnsQuestion{name: "www.service.internal", qtype: A}, expected: DnsQuestion{name: "www.service.internal", qtype: A}},
+		{name: "suffix", question: DnsQuestion{name: "mail.corp", qtype: MX}, expected: DnsQuestion{name: "mail.corp.example.com", qtype: MX}},
+		{name: "suffix itself", question: DnsQuestion{name: "corp", qtype: NS}, expected: DnsQuestion{name: "corp.example.com", qtype: NS}},
+		{name: "suffix label", question: DnsQuestion{name: "notcorp", qtype: A}, expected: DnsQuestion{name: "notcorp", qtype: A}},
+		{name: "regex", question: DnsQuestion{name: "web.default.svc", qtype: A}, expected: DnsQuestion{name: "web.default.svc.cluster.local", qtype: A}},
+		{name: "regex whole name", question: DnsQuestion{name: "a.web.default.svc", qtype: A}, expected: DnsQuestion{name: "a.web.default.svc", qtype: A}},
+		{name: "type", question: DnsQuestion{name: "example.com", qtype: ANY}, expected: DnsQuestion{name: "example.com", qtype: A}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, rewriteQuestion(rules, tc.question))
+		})
+	}
+
+	t.Run("restore answer", func(t *testing.T) {
+		original := DnsQuestion{name: "service.internal", qtype: A}
+		rewritten := rewriteQuestion(rules, original)
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{
+			{qType: CNAME, domain: "service.prod.example.com", ttl: 60, host: "lb.example.com"},
+			{qType: RRSIG, domain: "service.prod.example.com", ttl: 60, typeCovered: CNAME},
+			{qType: A, domain: "lb.example.com", ttl: 60, addr: "192.0.2.1"},
+		}
+		restoreAnswer(packet, original, rewritten)
+
+		var answers []string
+		for _, r := range packet.answers {
+			answers = append(answers, r.String())
+		}
+		assert.Equal(t, []string{"service.internal.\t60\tIN\tCNAME\tlb.example.com.", "lb.example.com.\t60\tIN\tA\t192.0.2.1"}, answers)
+	})
+
+	for _, rc := range []RewriteConfig{
+		{Match: "prefix", Name: "a", To: "b"},
+		{Match: "regex", Name: "(", To: "b"},
+		{Name: "a"},
+		{Type: "BOGUS", ToType: "A"},
+	} {
+		_, err := rc.newRewriteRule()
+		assert.Error(t, err, rc)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PolicyAction is the action of a response policy
+type PolicyAction int
+
+const (
+	PolicyNxDomain  PolicyAction = iota // answer that the name does not exist
+	PolicyNoData                        // answer that the name has no records of the type
+	PolicyPassthru                      // answer normally, ignoring later policy zones
+	PolicyDrop                          // send no answer
+	PolicyTCPOnly                       // truncate udp answers so that clients retry over tcp
+	PolicyLocalData                     // answer with the records of the policy
+)
+
+var policyActionNames = map[PolicyAction]string{
+	PolicyNxDomain:  "NXDOMAIN",
+	PolicyNoData:    "NODATA",
+	PolicyPassthru:  "PASSTHRU",
+	PolicyDrop:      "DROP",
+	PolicyTCPOnly:   "TCP-ONLY",
+	PolicyLocalData: "LOCAL-DATA",
+}
+
+func (a PolicyAction) String() string {
+	return policyActionNames[a]
+}
+
+// Policy is the action of the records of a trigger in a policy zone
+type Policy struct {
+	zone    string // origin of the policy zone
+	log     bool   // log the queries the policy applies to
+	trigger string // owner name of the records relative to the policy zone
+	action  PolicyAction
+	records []DnsRecord // local data
+}
+
+// ipPolicy is a policy triggered by the addresses of a network
+type ipPolicy struct {
+	network *net.IPNet
+	policy  *Policy
+}
+
+// PolicyZone is a response policy zone (RPZ), rewriting the answers of upstream servers.
+// The policies are triggered by the question name (QNAME), by the addresses in the answer (RPZ-IP),
+// by the names of the name servers of the question's zone (NSDNAME) or by their addresses (NSIP).
+type PolicyZone struct {
+	origin string
+	log    bool // log the queries the policies apply to
+
+	mu       sync.RWMutex
+	qnames   map[string]*Policy // by lower case trigger name, *.name for wildcards
+	nsdnames map[string]*Policy
+	ips      []ipPolicy
+	nsips    []ipPolicy
+}
+
+// NewPolicyZone creates a new PolicyZone without policies
+func NewPolicyZone(origin string) *PolicyZone {
+	return &PolicyZone{origin: strings.ToLower(origin), qnames: map[string]*Policy{}, nsdnames: map[string]*Policy{}}
+}
+
+// load replaces the policies by the ones of the records of the policy zone
+func (p *PolicyZone) load(records []DnsRecord) error {
+	owners := map[string][]DnsRecord{}
+	var order []string
+	for _, r := range records {
+		owner := strings.ToLower(r.domain)
+		if !isSubdomain(owner, p.origin) || owner == p.origin {
+			continue // the SOA and NS records of the apex
+		}
+		if _, ok := owners[owner]; !ok {
+			order = append(order, owner)
+		}
+		owners[owner] = append(owners[owner], r)
+	}
+
+	qnames := map[string]*Policy{}
+	nsdnames := map[string]*Policy{}
+	var ips, nsips []ipPolicy
+	for _, owner := range order {
+		trigger := strings.TrimSuffix(owner, "."+p.origin)
+		policy := newPolicy(trigger, owners[owner])
+		policy.zone = p.origin
+		policy.log = p.log
+
+		var err error
+		switch {
+		case strings.HasSuffix(trigger, ".rpz-ip"):
+			ips, err = addIPPolicy(ips, strings.TrimSuffix(trigger, ".rpz-ip"), policy)
+		case strings.HasSuffix(trigger, ".rpz-nsip"):
+			nsips, err = addIPPolicy(nsips, strings.TrimSuffix(trigger, ".rpz-nsip"), policy)
+		case strings.HasSuffix(trigger, ".rpz-nsdname"):
+			nsdnames[strings.TrimSuffix(trigger, ".rpz-nsdname")] = policy
+		case strings.HasSuffix(trigger, ".rpz-client-ip"):
+			// client triggers are not supported
+		default:
+			qnames[trigger] = policy
+		}
+		if err != nil {
+			return fmt.Errorf("policy zone %s: %v", fqdn(p.origin), err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.qnames = qnames
+	p.nsdnames = nsdnames
+	p.ips = ips
+	p.nsips = nsips
+	return nil
+}
+
+// newPolicy creates the policy of the records of a trigger, whose CNAME target selects the action
+func newPolicy(trigger string, records []DnsRecord) *Policy {
+	policy := &Policy{trigger: trigger, action: PolicyLocalData, records: records}
+	if len(records) == 1 && records[0].qType == CNAME {
+		switch strings.ToLower(records[0].host) {
+		case "":
+			policy.action = PolicyNxDomain
+		case "*":
+			policy.action = PolicyNoData
+		case "rpz-passthru":
+			policy.action = PolicyPassthru
+		case "rpz-drop":
+			policy.action = PolicyDrop
+		case "rpz-tcp-only":
+			policy.action = PolicyTCPOnly
+		}
+	}
+	if policy.action != PolicyLocalData {
+		policy.records = nil
+	}
+	return policy
+}
+
+// addIPPolicy adds the policy of an IP trigger, a prefix length followed by the labels of the address in reverse
+func addIPPolicy(policies []ipPolicy, trigger string, policy *Policy) ([]ipPolicy, error) {
+	network, err := parseIPTrigger(trigger)
+	if err != nil {
+		return nil, err
+	}
+	return append(policies, ipPolicy{network: network, policy: policy}), nil
+}
+
+// parseIPTrigger parses an IP trigger like 24.0.2.0.192 or 64.zz.db8.2001, where zz stands for ::
+func parseIPTrigger(trigger string) (*net.IPNet, error) {
+	labels := strings.Split(trigger, ".")
+	prefix, err := strconv.Atoi(labels[0])
+	if err != nil || len(labels) < 2 {
+		return nil, fmt.Errorf("invalid IP trigger %s", trigger)
+	}
+	var parts []string
+	for i := len(labels) - 1; i > 0; i-- {
+		parts = append(parts, labels[i])
+	}
+
+	var addr string
+	if len(parts) == 4 && !strings.Contains(trigger, "zz") && prefix <= 32 {
+		addr = strings.Join(parts, ".")
+	} else {
+		addr = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(addr, ":") && !strings.HasPrefix(addr, "::") {
+			addr = ":" + addr
+		}
+		if strings.HasSuffix(addr, ":") && !strings.HasSuffix(addr, "::") {
+			addr += ":"
+		}
+	}
+
+	_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%d", addr, prefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP trigger %s", trigger)
+	}
+	return network, nil
+}
+
+// matchName returns the policy of the name, or else of the closest wildcard matching it
+func matchName(policies map[string]*Policy, name string) *Policy {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if policy, ok := policies[name]; ok {
+		return policy
+	}
+	for n := name; n != ""; {
+		n = parentName(n)
+		if policy, ok := policies[wildcardName(n)]; ok {
+			return policy
+		}
+	}
+	return nil
+}
+
+// matchIP returns the policy of the longest network containing one of the addresses
+func matchIP(policies []ipPolicy, ips []net.IP) *Policy {
+	var match *Policy
+	longest := -1
+	for _, ip := range ips {
+		for _, p := range policies {
+			if ones, _ := p.network.Mask.Size(); ones > longest && p.network.Contains(ip) {
+				match = p.policy
+				longest = ones
+			}
+		}
+	}
+	return match
+}
+
+// policyCheck is a question checked against the policy zones, with the data of the triggers fetched once when needed
+type policyCheck struct {
+	question DnsQuestion
+	answer   func() (*DnsPacket, error)                             // the upstream answer to the question
+	query    func(name string, qtype QueryType) (*DnsPacket, error) // queries for the name servers and their addresses
+
+	nsNames  []string
+	nsIPs    []net.IP
+	fetched  bool
+	fetchErr error
+}
+
+// check returns the policy of the first policy zone triggered by the question, or nil for none.
+// Within a zone QNAME triggers take precedence over RPZ-IP, NSDNAME and NSIP triggers, in this order.
+func (c *policyCheck) check(policyZones []*PolicyZone) (*Policy, error) {
+	for _, p := range policyZones {
+		p.mu.RLock()
+		policy := matchName(p.qnames, c.question.name)
+		hasIPs := len(p.ips) > 0
+		hasNS := len(p.nsdnames) > 0 || len(p.nsips) > 0
+		p.mu.RUnlock()
+		if policy != nil {
+			return policy, nil
+		}
+
+		if hasIPs {
+			answer, err := c.answer()
+			if err != nil {
+				return nil, err
+			}
+			p.mu.RLock()
+			policy = matchIP(p.ips, answerIPs(answer))
+			p.mu.RUnlock()
+			if policy != nil {
+				return policy, nil
+			}
+		}
+
+		if hasNS {
+			if err := c.fetchNameServers(); err != nil {
+				// the name server triggers do not match without the name servers
+				log.Printf("error looking up the name servers of %s for policy zone %s: %v\n", c.question.name, fqdn(p.origin), err)
+				continue
+			}
+			p.mu.RLock()
+			for _, name := range c.nsNames {
+				if policy = matchName(p.nsdnames, name); policy != nil {
+					break
+				}
+			}
+			if policy == nil {
+				policy = matchIP(p.nsips, c.nsIPs)
+			}
+			p.mu.RUnlock()
+			if policy != nil {
+				return policy, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// fetchNameServers looks up the name servers of the closest zone enclosing the question name, and their addresses,
+// once for all policy zones
+func (c *policyCheck) fetchNameServers() error {
+	if !c.fetched {
+		c.fetched = true
+		c.fetchErr = c.lookupNameServers()
+	}
+	return c.fetchErr
+}
+
+// lookupNameServers queries the name servers and their addresses
+func (c *policyCheck) lookupNameServers() error {
+	for n := strings.ToLower(c.question.name); n != "" && len(c.nsNames) == 0; n = parentName(n) {
+		response, err := c.query(n, NS)
+		if err != nil {
+			return err
+		}
+		for _, r := range response.answers {
+			if r.qType == NS && strings.EqualFold(r.domain, n) {
+				c.nsNames = append(c.nsNames, r.host)
+			}
+		}
+	}
+
+	for _, name := range c.nsNames {
+		for _, qtype := range []QueryType{A, AAAA} {
+			response, err := c.query(name, qtype)
+			if err != nil {
+				return err
+			}
+			c.nsIPs = append(c.nsIPs, answerIPs(response)...)
+		}
+	}
+	return nil
+}
+
+// answerIPs returns the addresses of the A and AAAA records of the answer
+func answerIPs(packet *DnsPacket) []net.IP {
+	var ips []net.IP
+	for _, r := range packet.answers {
+		if r.qType == A || r.qType == AAAA {
+			if ip := net.ParseIP(r.addr); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// answer returns the answer of a NXDOMAIN, NODATA or local data policy to the question.
+// A CNAME record of local data is followed by looking up its target with lookup.
+func (p *Policy) answer(question DnsQuestion, lookup func(name string, qtype QueryType) (*DnsPacket, error)) *DnsPacket {
+	packet := NewDnsPacket()
+	switch p.action {
+	case PolicyNxDomain:
+		packet.header.resCode = NxDomain
+		return packet
+	case PolicyNoData:
+		return packet
+	}
+
+	var cname *DnsRecord
+	for _, r := range p.records {
+		if r.qType == question.qtype || question.qtype == ANY {
+			r.domain = question.name
+			packet.answers = append(packet.answers, r)
+		} else if r.qType == CNAME {
+			c := r
+			cname = &c
+		}
+	}
+	if len(packet.answers) > 0 || cname == nil {
+		return packet
+	}
+
+	// a CNAME record to *.target rewrites the question name into target
+	target := cname.host
+	if strings.HasPrefix(target, "*.") {
+		target = strings.TrimSuffix(question.name, ".") + target[1:]
+	}
+	cname.domain = question.name
+	cname.host = target
+	packet.answers = append(packet.answers, *cname)
+	if question.qtype == CNAME {
+		return packet
+	}
+	if result, err := lookup(target, question.qtype); err == nil {
+		packet.header.resCode = result.header.resCode
+		packet.answers = append(packet.answers, result.answers...)
+	}
+	return packet
+}
+
+// logQuery logs a query the policy applies to, when its policy zone logs them
+func (p *Policy) logQuery(client net.IP, question DnsQuestion) {
+	if p.log {
+		log.Printf("rpz %s: %s %s %s triggered %s, %s\n", fqdn(p.zone), client, question.name, question.qtype, p.trigger, p.action)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsePolicyZone(t *testing.T) {
+	zoneFile := `$ORIGIN rpz.local.
+$TTL 60
+@	IN	SOA	localhost. admin.localhost. 1 3600 600 86400 60
+	IN	NS	localhost.
+blocked.test		CNAME	.
+*.blocked.test		CNAME	.
+nodata.test		CNAME	*.
+allowed.blocked.test	CNAME	rpz-passthru.
+drop.test		CNAME	rpz-drop.
+tcp.test		CNAME	rpz-tcp-only.
+local.test		A	192.0.2.1
+			AAAA	2001:db8::1
+alias.test		CNAME	www.example.com.
+*.rewrite.test		CNAME	*.example.com.
+24.0.100.51.198.rpz-ip	CNAME	.
+32.99.100.51.198.rpz-ip	A	192.0.2.99
+48.zz.db8.2001.rpz-ip	CNAME	*.
+ns.evil.test.rpz-nsdname	CNAME	.
+32.1.100.51.198.rpz-nsip	CNAME	rpz-drop.
+`
+	records, err := parseZoneFile(strings.NewReader(zoneFile), "")
+	require.NoError(t, err)
+	policyZone := NewPolicyZone("rpz.local")
+	require.NoError(t, policyZone.load(records))
+
+	// the upstream answers and the name servers of the zones
+	upstream := map[string][]DnsRecord{
+		"www.example.com A":               {{qType: A, domain: "www.example.com", ttl: 300, addr: "192.0.2.80"}},
+		"bad.example.com A":               {{qType: A, domain: "bad.example.com", ttl: 300, addr: "198.51.100.7"}},
+		"swap.example.com A":              {{qType: A, domain: "swap.example.com", ttl: 300, addr: "198.51.100.99"}},
+		"v6.example.com AAAA":             {{qType: AAAA, domain: "v6.example.com", ttl: 300, addr: "2001:db8::5"}},
+		"example.com NS":                  {{qType: NS, domain: "example.com", ttl: 300, host: "ns.example.com"}},
+		"ns.example.com A":                {{qType: A, domain: "ns.example.com", ttl: 300, addr: "192.0.2.53"}},
+		"evil.test NS":                    {{qType: NS, domain: "evil.test", ttl: 300, host: "ns.evil.test"}},
+		"shady.test NS":                   {{qType: NS, domain: "shady.test", ttl: 300, host: "ns.shady.test"}},
+		"ns.shady.test A":                 {{qType: A, domain: "ns.shady.test", ttl: 300, addr: "198.51.100.1"}},
+		"host.rewrite.test.example.com A": {{qType: A, domain: "host.rewrite.test.example.com", ttl: 300, addr: "192.0.2.7"}},
+	}
+	query := func(name string, qtype QueryType) (*DnsPacket, error) {
+		packet := NewDnsPacket()
+		packet.answers = upstream[name+" "+qtype.String()]
+		return packet, nil
+	}
+
+	testcases := []struct {
+		name    string
+		qname   string
+		qtype   QueryType
+		action  PolicyAction
+		trigger string
+		resCode ResultCode
+		answers []string
+	}{
+		{name: "no trigger", qname: "www.example.com", qtype: A},
+		{name: "qname", qname: "blocked.test", qtype: A, action: PolicyNxDomain, trigger: "blocked.test", resCode: NxDomain},
+		{name: "qname wildcard", qname: "a.b.blocked.test", qtype: A, action: PolicyNxDomain, trigger: "*.blocked.test", resCode: NxDomain},
+		{name: "passthru", qname: "allowed.blocked.test", qtype: A, action: PolicyPassthru, trigger: "allowed.blocked.test"},
+		{name: "nodata", qname: "nodata.test", qtype: A, action: PolicyNoData, trigger: "nodata.test"},
+		{name: "drop", qname: "drop.test", qtype: A, action: PolicyDrop, trigger: "drop.test"},
+		{name: "tcp only", qname: "tcp.test", qtype: A, action: PolicyTCPOnly, trigger: "tcp.test"},
+		{
+			name: "local data", qname: "local.test", qtype: AAAA, action: PolicyLocalData, trigger: "local.test",
+			answers: []string{"local.test.\t60\tIN\tAAAA\t2001:db8::1"},
+		},
+		{name: "local data of another type", qname: "local.test", qtype: MX, action: PolicyLocalData, trigger: "local.test"},
+		{
+			name: "local data cname", qname: "alias.test", qtype: A, action: PolicyLocalData, trigger: "alias.test",
+			answers: []string{"alias.test.\t60\tIN\tCNAME\twww.example.com.", "www.example.com.\t300\tIN\tA\t192.0.2.80"},
+		},
+		{
+			name: "local data wildcard cname", qname: "host.rewrite.test", qtype: A, action: PolicyLocalData, trigger: "*.rewrite.test",
+			answers: []string{"host.rewrite.test.\t60\tIN\tCNAME\thost.rewrite.test.example.com.", "host.rewrite.test.example.com.\t300\tIN\tA\t192.0.2.7"},
+		},
+		{name: "response ip", qname: "bad.example.com", qtype: A, action: PolicyNxDomain, trigger: "24.0.100.51.198.rpz-ip", resCode: NxDomain},
+		{
+			name: "longest response ip prefix", qname: "swap.example.com", qtype: A, action: PolicyLocalData, trigger: "32.99.100.51.198.rpz-ip",
+			answers: []string{"swap.example.com.\t60\tIN\tA\t192.0.2.99"},
+		},
+		{name: "response ipv6", qname: "v6.example.com", qtype: AAAA, action: PolicyNoData, trigger: "48.zz.db8.2001.rpz-ip"},
+		{name: "nsdname", qname: "www.evil.test", qtype: A, action: PolicyNxDomain, trigger: "ns.evil.test.rpz-nsdname", resCode: NxDomain},
+		{name: "nsip", qname: "www.shady.test", qtype: A, action: PolicyDrop, trigger: "32.1.100.51.198.rpz-nsip"},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			question := DnsQuestion{name: tc.qname, qtype: tc.qtype}
+			check := policyCheck{question: question, answer: func() (*DnsPacket, error) { return query(tc.qname, tc.qtype) }, query: query}
+			policy, err := check.check([]*PolicyZone{policyZone})
+			require.NoError(t, err)
+			if tc.trigger == "" {
+				assert.Nil(t, policy)
+				return
+			}
+			require.NotNil(t, policy)
+			assert.Equal(t, tc.action, policy.action)
+			assert.Equal(t, tc.trigger, policy.trigger)
+
+			if tc.action == PolicyNxDomain || tc.action == PolicyNoData || tc.action == PolicyLocalData {
+				response := policy.answer(question, query)
+				assert.Equal(t, tc.resCode, response.header.resCode)
+				var answers []string
+				for _, r := range response.answers {
+					answers = append(answers, r.String())
+				}
+				assert.Equal(t, tc.answers, answers)
+			}
+		})
+	}
+
+	t.Run("cached name server lookups", func(t *testing.T) {
+		saved := cache
+		cache = NewCache()
+		t.Cleanup(func() { cache = saved })
+		var queries atomic.Int32
+		cache.query = func(name string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+			queries.Add(1)
+			packet, err := query(name, qtype)
+			if len(packet.answers) == 0 {
+				// negative answers are cached for the SOA minimum
+				packet.authorities = []DnsRecord{{qType: SOA, domain: "test", ttl: 300, host: "ns.test", mailbox: "admin.test", minimum: 300}}
+			}
+			return packet, err
+		}
+
+		question := DnsQuestion{name: "www.shady.test", qtype: A}
+		answer := func() (*DnsPacket, error) { return query(question.name, question.qtype) }
+		for i := 0; i < 2; i++ {
+			check := policyCheck{question: question, answer: answer, query: cachedLookup}
+			policy, err := check.check([]*PolicyZone{policyZone})
+			require.NoError(t, err)
+			require.NotNil(t, policy)
+			assert.Equal(t, PolicyDrop, policy.action)
+		}
+		// www.shady.test NS, shady.test NS, ns.shady.test A and AAAA are each looked up once
+		assert.Equal(t, int32(4), queries.Load())
+	})
+
+	t.Run("ip triggers", func(t *testing.T) {
+		for trigger, network := range map[string]string{
+			"32.1.2.0.192":            "192.0.2.1/32",
+			"128.1.zz.db8.2001":       "2001:db8::1/128",
+			"64.zz.2001":              "2001::/64",
+			"128.zz.1":                "1::/128",
+			"24.0.2.0.192.extra.zz.1": "",
+		} {
+			parsed, err := parseIPTrigger(trigger)
+			if network == "" {
+				assert.Error(t, err, trigger)
+				continue
+			}
+			require.NoError(t, err, trigger)
+			_, expected, _ := net.ParseCIDR(network)
+			assert.Equal(t, expected, parsed, trigger)
+		}
+	})
+}
+
+func TestPolicyNameServerLookupFailure(t *testing.T) {
+	records, err := parseZoneFile(strings.NewReader(`$ORIGIN rpz.local.
+$TTL 60
+@	IN	SOA	localhost. admin.localhost. 1 3600 600 86400 60
+	IN	NS	localhost.
+ns.evil.test.rpz-nsdname	CNAME	.
+`), "")
+	require.NoError(t, err)
+	policyZone := NewPolicyZone("rpz.local")
+	require.NoError(t, policyZone.load(records))
+
+	savedPolicyZones, savedCache := policyZones, cache
+	policyZones = []*PolicyZone{policyZone}
+	cache = NewCache()
+	t.Cleanup(func() { policyZones, cache = savedPolicyZones, savedCache })
+	// the question is answered, but the name servers cannot be looked up
+	cache.query = func(name string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+		if qtype == NS {
+			return nil, errors.New("upstream unreachable")
+		}
+		packet := NewDnsPacket()
+		packet.answers = []DnsRecord{{qType: A, domain: name, ttl: 300, addr: "192.0.2.1"}}
+		return packet, nil
+	}
+
+	request := NewDnsPacket()
+	request.header.id = 7
+	request.questions = []DnsQuestion{{name: "www.example.test", qtype: A}}
+	response, err := buildResponse(request, net.ParseIP("192.0.2.10"), false)
+	require.NoError(t, err)
+	require.NotNil(t, response)
+	assert.Equal(t, NoError, response.header.resCode)
+	assert.Len(t, response.answers, 1)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of response rate limiting, as in BIND
+const (
+	RRL_DEFAULT_WINDOW      = 15 * time.Second
+	RRL_DEFAULT_SLIP        = 2
+	RRL_DEFAULT_IPV4_PREFIX = 24
+	RRL_DEFAULT_IPV6_PREFIX = 56
+)
+
+// ResponseClass is the kind of response the rate of which is limited
+type ResponseClass int
+
+const (
+	RRLPositive ResponseClass = iota // answers, referrals and NODATA
+	RRLNxDomain
+	RRLError
+)
+
+func (c ResponseClass) String() string {
+	switch c {
+	case RRLPositive:
+		return "positive"
+	case RRLNxDomain:
+		return "nxdomain"
+	}
+	return "error"
+}
+
+// RRLAction is what happens to a response after rate limiting
+type RRLAction int
+
+const (
+	RRLSend RRLAction = iota // the response is sent
+	RRLDrop                  // the response is not sent
+	RRLSlip                  // a truncated response is sent, for legitimate clients to retry over tcp
+)
+
+// rrlKey identifies the responses sharing a token bucket
+type rrlKey struct {
+	netblock string
+	class    ResponseClass
+	name     string // question name and type of positive answers, zone of NXDOMAIN answers
+}
+
+// rrlBucket holds the credit of responses of a key
+type rrlBucket struct {
+	balance float64 // responses allowed, negative while limited
+	last    time.Time
+	slipped int // limited responses since the last slip
+	limited bool
+}
+
+// RateLimiter limits the rate of identical responses sent to the netblocks of clients over udp,
+// to avoid being used as an amplifier of reflection attacks
+type RateLimiter struct {
+	rates      map[ResponseClass]float64 // responses per second, unlimited when zero
+	window     time.Duration             // period the debt of a client accrues over
+	slip       int                       // every slip-th limited response is truncated instead of dropped, none when zero
+	ipv4Prefix int
+	ipv6Prefix int
+	logOnly    bool // log the responses to limit but send them
+
+	mu        sync.Mutex
+	buckets   map[rrlKey]*rrlBucket
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a new RateLimiter with the responses per second of each class
+func NewRateLimiter(responses, nxdomains, errors int) *RateLimiter {
+	return &RateLimiter{
+		rates:      map[ResponseClass]float64{RRLPositive: float64(responses), RRLNxDomain: float64(nxdomains), RRLError: float64(errors)},
+		window:     RRL_DEFAULT_WINDOW,
+		slip:       RRL_DEFAULT_SLIP,
+		ipv4Prefix: RRL_DEFAULT_IPV4_PREFIX,
+		ipv6Prefix: RRL_DEFAULT_IPV6_PREFIX,
+		buckets:    map[rrlKey]*rrlBucket{},
+	}
+}
+
+// netblock returns the network of the client the responses are counted for
+func (l *RateLimiter) netblock(client net.IP) string {
+	if ip4 := client.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(l.ipv4Prefix, 32)).String()
+	}
+	return client.Mask(net.CIDRMask(l.ipv6Prefix, 128)).String()
+}
+
+// classify returns the class of the response and the name its responses are counted for
+func classify(packet *DnsPacket) (ResponseClass, string) {
+	switch packet.header.resCode {
+	case NoError:
+		if len(packet.questions) == 0 {
+			return RRLPositive, ""
+		}
+		q := packet.questions[0]
+		return RRLPositive, strings.ToLower(q.name) + " " + q.qtype.String()
+	case NxDomain:
+		for _, r := range packet.authorities {
+			if r.qType == SOA {
+				return RRLNxDomain, strings.ToLower(r.domain)
+			}
+		}
+		if len(packet.questions) > 0 {
+			return RRLNxDomain, strings.ToLower(packet.questions[0].name)
+		}
+		return RRLNxDomain, ""
+	}
+	return RRLError, ""
+}
+
+// check counts the response to the client and returns what to do with it
+func (l *RateLimiter) check(client net.IP, packet *DnsPacket, now time.Time) RRLAction {
+	class, name := classify(packet)
+	rate := l.rates[class]
+	if rate <= 0 || client == nil {
+		return RRLSend
+	}
+	key := rrlKey{netblock: l.netblock(client), class: class, name: name}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+	bucket := l.buckets[key]
+	if bucket == nil {
+		bucket = &rrlBucket{balance: rate, last: now}
+		l.buckets[key] = bucket
+	}
+	bucket.balance = min(rate, bucket.balance+rate*now.Sub(bucket.last).Seconds()) - 1
+	bucket.balance = max(bucket.balance, -rate*l.window.Seconds())
+	bucket.last = now
+
+	if bucket.balance >= 0 {
+		if bucket.limited {
+			bucket.limited = false
+			log.Printf("rate limit of %s responses to %s ended\n", class, key.netblock)
+		}
+		return RRLSend
+	}
+	if !bucket.limited {
+		bucket.limited = true
+		bucket.slipped = 0
+		log.Printf("rate limiting %s responses to %s for %q\n", class, key.netblock, name)
+	}
+	if l.logOnly {
+		return RRLSend
+	}
+	bucket.slipped++
+	if l.slip > 0 && bucket.slipped >= l.slip {
+		bucket.slipped = 0
+		return RRLSlip
+	}
+	return RRLDrop
+}
+
+// sweep removes the buckets which have been idle for longer than the window, at most once per window
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > l.window {
+			delete(l.buckets, key)
+		}
+	}
+}
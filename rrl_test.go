@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter(t *testing.T) {
+	response := func(name string, resCode ResultCode) *DnsPacket {
+		packet := NewDnsPacket()
+		packet.header.resCode = resCode
+		packet.questions = []DnsQuestion{{name: name, qtype: A}}
+		if resCode == NxDomain {
+			packet.authorities = []DnsRecord{{domain: "example.com", qType: SOA, ttl: 300, host: "ns1.example.com", mailbox: "admin.example.com", minimum: 300}}
+		}
+		return packet
+	}
+	start := time.Unix(1700000000, 0)
+
+	t.Run("slip", func(t *testing.T) {
+		limiter := NewRateLimiter(2, 0, 0)
+		client := net.ParseIP("192.0.2.1")
+		var actions []RRLAction
+		for i := 0; i < 7; i++ {
+			actions = append(actions, limiter.check(client, response("www.example.com", NoError), start))
+		}
+		assert.Equal(t, []RRLAction{RRLSend, RRLSend, RRLDrop, RRLSlip, RRLDrop, RRLSlip, RRLDrop}, actions)
+
+		// other names, netblocks and classes have their own buckets
+		assert.Equal(t, RRLSend, limiter.check(client, response("mail.example.com", NoError), start))
+		assert.Equal(t, RRLSend, limiter.check(net.ParseIP("192.0.3.1"), response("www.example.com", NoError), start))
+		assert.Equal(t, RRLSend, limiter.check(client, response("www.example.com", Servfail), start))
+		// the debt is paid after some seconds
+		assert.Equal(t, RRLSlip, limiter.check(net.ParseIP("192.0.2.200"), response("www.example.com", NoError), start.Add(time.Second)))
+		assert.Equal(t, RRLSend, limiter.check(client, response("www.example.com", NoError), start.Add(5*time.Second)))
+	})
+
+	t.Run("nxdomain of the same zone", func(t *testing.T) {
+		limiter := NewRateLimiter(0, 1, 0)
+		limiter.slip = 0
+		client := net.ParseIP("2001:db8::1")
+		assert.Equal(t, RRLSend, limiter.check(client, response("a.example.com", NxDomain), start))
+		assert.Equal(t, RRLDrop, limiter.check(net.ParseIP("2001:db8::2"), response("b.example.com", NxDomain), start))
+		assert.Equal(t, RRLDrop, limiter.check(client, response("c.example.com", NxDomain), start))
+		assert.Equal(t, RRLSend, limiter.check(client, response("www.example.com", NoError), start))
+	})
+
+	t.Run("log only", func(t *testing.T) {
+		limiter := NewRateLimiter(1, 1, 1)
+		limiter.logOnly = true
+		client := net.ParseIP("192.0.2.1")
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, RRLSend, limiter.check(client, response("www.example.com", Refused), start))
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		limiter := NewRateLimiter(1, 0, 0)
+		limiter.window = 2 * time.Second
+		limiter.slip = 0
+		client := net.ParseIP("192.0.2.1")
+		for i := 0; i < 100; i++ {
+			limiter.check(client, response("www.example.com", NoError), start)
+		}
+		// the debt is limited to the window
+		assert.Equal(t, RRLDrop, limiter.check(client, response("www.example.com", NoError), start.Add(2*time.Second)))
+		assert.Equal(t, RRLSend, limiter.check(client, response("www.example.com", NoError), start.Add(6*time.Second)))
+		// idle buckets are removed
+		limiter.check(net.ParseIP("192.0.3.1"), response("www.example.com", NoError), start.Add(20*time.Second))
+		assert.Len(t, limiter.buckets, 1)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		slip := 0
+		limiter, err := (&RateLimitConfig{ResponsesPerSecond: 5, Slip: &slip, IPv4PrefixLength: 32}).newRateLimiter()
+		require.NoError(t, err)
+		assert.Equal(t, 0, limiter.slip)
+		assert.Equal(t, RRL_DEFAULT_WINDOW, limiter.window)
+		assert.Equal(t, "192.0.2.1", limiter.netblock(net.ParseIP("192.0.2.1")))
+		assert.Equal(t, "2001:db8:0:100::", limiter.netblock(net.ParseIP("2001:db8:0:1ff::1")))
+
+		_, err = (&RateLimitConfig{IPv6PrefixLength: 129}).newRateLimiter()
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval of the checks of a secondary zone before its first transfer and after it expired
+const SECONDARY_INITIAL_RETRY = time.Minute
+
+// Time allowed for connecting to a primary and reading each of its messages
+const TRANSFER_READ_TIMEOUT = 30 * time.Second
+
+// Secondary keeps a zone transferred from its primary up to date
+type Secondary struct {
+	origin   string
+	primary  string       // address of the primary as host:port
+	settings zoneSettings // settings of the transferred zone
+	now      func() time.Time
+	check    chan struct{}    // signalled by NOTIFY messages of the primary
+	publish  func(zone *Zone) // called with each transferred version of the zone and with nil once it expired
+
+	mu      sync.Mutex
+	zone    *Zone // nil before the first transfer and after the zone expired
+	expires time.Time
+
+	addrsMu sync.RWMutex
+	addrs   []net.IP // addresses of the primary, resolved when set up and with each refresh
+}
+
+// NewSecondary creates a new Secondary for the zone with the origin
+func NewSecondary(origin string, primary string) *Secondary {
+	s := &Secondary{origin: strings.ToLower(origin), primary: hostPort(primary), now: time.Now, check: make(chan struct{}, 1)}
+	s.publish = s.serve
+	s.resolvePrimary()
+	return s
+}
+
+// serve serves the transferred zone and notifies its secondaries, or stops serving it when zone is nil
+func (s *Secondary) serve(zone *Zone) {
+	if zone == nil {
+		zones.remove(s.origin)
+		return
+	}
+	zones.add(zone)
+	zone.sendNotify()
+}
+
+// ResultCodeError is the error of a response with an error result code
+type ResultCodeError struct {
+	resCode ResultCode
+}
+
+func (e *ResultCodeError) Error() string {
+	return fmt.Sprintf("response code %d", e.resCode)
+}
+
+// run keeps the zone up to date until stop is closed
+func (s *Secondary) run(stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(s.refresh())
+		select {
+		case <-timer.C:
+		case <-s.check:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refresh checks the serial of the primary's zone, transfers the zone when it changed
+// and returns the time until the next check.
+// The checks follow the refresh and retry intervals of the SOA record, and the zone
+// is no longer served once the primary was unreachable for the expire interval.
+func (s *Secondary) refresh() time.Duration {
+	s.resolvePrimary()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.update()
+	now := s.now()
+	if err == nil {
+		soa := s.zone.soa()
+		s.expires = now.Add(soaInterval(soa.expire))
+		return soaInterval(soa.refresh)
+	}
+
+	log.Printf("error refreshing zone %s from %s: %v\n", fqdn(s.origin), s.primary, err)
+	if s.zone == nil {
+		return SECONDARY_INITIAL_RETRY
+	}
+	if !now.Before(s.expires) {
+		log.Printf("zone %s expired\n", fqdn(s.origin))
+		s.zone = nil
+		s.publish(nil)
+		return SECONDARY_INITIAL_RETRY
+	}
+	return min(soaInterval(s.zone.soa().retry), s.expires.Sub(now))
+}
+
+// update transfers the zone unless the serial of the primary's zone is not newer
+func (s *Secondary) update() error {
+	soa, err := querySOA(s.primary, s.origin, s.settings.key)
+	if err != nil {
+		return err
+	}
+	if s.zone != nil && !serialNewer(soa.serial, s.zone.soa().serial) {
+		return nil
+	}
+
+	records, err := s.transfer()
+	if err != nil {
+		return err
+	}
+	zone, err := NewZone(s.origin, records)
+	if err != nil {
+		return err
+	}
+	zone.zoneSettings = s.settings
+
+	s.zone = zone
+	log.Printf("transferred zone %s serial %d from %s\n", fqdn(s.origin), zone.soa().serial, s.primary)
+	s.publish(zone)
+	return nil
+}
+
+// transfer pulls the zone from the primary, incrementally when there is a current version of it
+func (s *Secondary) transfer() ([]DnsRecord, error) {
+	if s.zone != nil {
+		request := NewDnsPacket()
+		request.header = DnsHeader{id: newQueryID()}
+		request.questions = []DnsQuestion{{name: s.origin, qtype: IXFR}}
+		request.authorities = []DnsRecord{*s.zone.soa()}
+		records, err := receiveTransfer(s.primary, request, s.settings.key)
+		if err == nil && len(records) > 1 {
+			return applyTransfer(s.zone, records)
+		}
+		// primaries not supporting IXFR refuse it or answer with the SOA record only
+		var rcodeErr *ResultCodeError
+		if err != nil && !errors.As(err, &rcodeErr) {
+			return nil, err
+		}
+	}
+
+	request := NewDnsPacket()
+	request.header = DnsHeader{id: newQueryID()}
+	request.questions = []DnsQuestion{{name: s.origin, qtype: AXFR}}
+	records, err := receiveTransfer(s.primary, request, s.settings.key)
+	if err != nil {
+		return nil, err
+	}
+	return applyTransfer(nil, records)
+}
+
+// querySOA queries the SOA record of the zone from the primary
+func querySOA(primary string, origin string, key *TsigKey) (*DnsRecord, error) {
+	request := NewDnsPacket()
+	request.header = DnsHeader{id: newQueryID()}
+	request.questions = []DnsQuestion{{name: origin, qtype: SOA}}
+
+	var soa *DnsRecord
+	err := exchangeTCP(primary, request, key, func(packet *DnsPacket) bool {
+		for i, r := range packet.answers {
+			if r.qType == SOA && strings.EqualFold(r.domain, origin) {
+				soa = &packet.answers[i]
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if soa == nil {
+		return nil, errors.New("no SOA record in the answer of the primary")
+	}
+	return soa, nil
+}
+
+// receiveTransfer requests a zone transfer and returns the records of the response up to the closing SOA record
+func receiveTransfer(primary string, request *DnsPacket, key *TsigKey) ([]DnsRecord, error) {
+	var records []DnsRecord
+	var serial uint32
+	soas := 0
+	done := false
+	err := exchangeTCP(primary, request, key, func(packet *DnsPacket) bool {
+		for _, r := range packet.answers {
+			if done {
+				break
+			}
+			if len(records) == 0 {
+				serial = r.serial
+			} else if r.qType == SOA {
+				// SOA records alternately start the deleted and the added records of an incremental transfer,
+				// the SOA record with the new serial in place of deleted records ends the transfer
+				done = soas%2 == 0 && r.serial == serial
+				soas++
+			}
+			records = append(records, r)
+		}
+		// a single SOA record answers an IXFR request for a zone that is up to date
+		return done || (len(records) == 1 && request.questions[0].qtype == IXFR)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 || records[0].qType != SOA {
+		return nil, errors.New("zone transfer does not start with a SOA record")
+	}
+	return records, nil
+}
+
+// applyTransfer returns the records of the zone after a transfer. A full transfer lists all records
+// between the opening and closing SOA records, an incremental one lists the differences to the current zone
+// as sequences of the old SOA record with the deleted records, followed by the new SOA record with the added ones.
+func applyTransfer(current *Zone, records []DnsRecord) ([]DnsRecord, error) {
+	records = records[:len(records)-1]
+	if len(records) < 2 || records[1].qType != SOA || records[1].serial == records[0].serial {
+		return records, nil
+	}
+
+	if current == nil || records[1].serial != current.soa().serial {
+		return nil, fmt.Errorf("incremental transfer does not start at the current serial")
+	}
+	zone := map[string]DnsRecord{}
+	for _, r := range current.allRecords() {
+		key, err := recordKey(&r)
+		if err != nil {
+			return nil, err
+		}
+		zone[key] = r
+	}
+
+	adding := true
+	for _, r := range records[1:] {
+		if r.qType == SOA {
+			adding = !adding
+		}
+		key, err := recordKey(&r)
+		if err != nil {
+			return nil, err
+		}
+		if adding {
+			zone[key] = r
+		} else {
+			delete(zone, key)
+		}
+	}
+
+	res := make([]DnsRecord, 0, len(zone))
+	for _, r := range zone {
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// exchangeTCP sends the request over a new tcp connection and passes the response messages to handle until it returns true.
+// With a key the request is signed and the responses must be signed as well.
+func exchangeTCP(addr string, request *DnsPacket, key *TsigKey, handle func(*DnsPacket) bool) error {
+	conn, err := net.DialTimeout("tcp", addr, TRANSFER_READ_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if key != nil {
+		request.tsig = NewTsigSession(key)
+	}
+
+	buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+	if err := request.write(buf); err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(TRANSFER_READ_TIMEOUT))
+	if err := writeMessage(conn, buf.buf[:buf.position()]); err != nil {
+		return err
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(TRANSFER_READ_TIMEOUT))
+		responseBuf, err := readMessage(conn)
+		if err != nil {
+			return err
+		}
+		response := NewDnsPacket()
+		if err := response.fromBuffer(responseBuf); err != nil {
+			return err
+		}
+		if response.header.id != request.header.id {
+			return errors.New("response id does not match the request")
+		}
+		if request.tsig != nil {
+			if err := request.tsig.verify(response, responseBuf.buf); err != nil {
+				return err
+			}
+		}
+		if response.header.resCode != NoError {
+			return &ResultCodeError{resCode: response.header.resCode}
+		}
+		if handle(response) {
+			// the last message of a response is signed
+			if request.tsig != nil && request.tsig.unsignedCount > 0 {
+				return errors.New("unsigned response to a signed request")
+			}
+			return nil
+		}
+	}
+}
+
+// serialNewer reports whether the serial a is newer than b in serial number arithmetic (RFC 1982)
+func serialNewer(a uint32, b uint32) bool {
+	return a != b && int32(a-b) > 0
+}
+
+// soaInterval converts an interval of a SOA record to a duration of at least a second
+func soaInterval(seconds uint32) time.Duration {
+	return max(time.Duration(seconds)*time.Second, time.Second)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPrimary is a primary serving a zone with AXFR and, for the latest change, IXFR
+type testPrimary struct {
+	mu       sync.Mutex
+	records  []DnsRecord
+	deleted  []DnsRecord // records deleted from the previous version
+	added    []DnsRecord // records added to the previous version
+	ixfr     bool
+	requests []QueryType
+}
+
+func (p *testPrimary) serve(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf, err := readMessage(conn)
+				if err != nil {
+					return
+				}
+				request := NewDnsPacket()
+				if err := request.fromBuffer(buf); err != nil {
+					return
+				}
+				for _, data := range p.answer(request) {
+					writeMessage(conn, data)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func (p *testPrimary) answer(request *DnsPacket) [][]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	question := request.questions[0]
+	p.requests = append(p.requests, question.qtype)
+	header := DnsHeader{id: request.header.id, response: true, authoritativeAnswer: true}
+	soa := p.records[0]
+
+	var records []DnsRecord
+	switch question.qtype {
+	case SOA:
+		records = []DnsRecord{soa}
+	case AXFR:
+		records = append(append([]DnsRecord{}, p.records...), soa)
+	case IXFR:
+		if !p.ixfr {
+			header.resCode = NotImp
+			break
+		}
+		records = []DnsRecord{soa, request.authorities[0]}
+		records = append(records, p.deleted...)
+		records = append(records, soa)
+		records = append(records, p.added...)
+		records = append(records, soa)
+	}
+
+	if len(records) == 0 {
+		packet := NewDnsPacket()
+		packet.header = header
+		packet.questions = []DnsQuestion{question}
+		data, _ := writeResponse(packet, MAX_MESSAGE_SIZE)
+		return [][]byte{data}
+	}
+	messages, _ := transferMessages(header, question, records, nil)
+	return messages
+}
+
+// update replaces the zone, keeping the differences for IXFR
+func (p *testPrimary) update(serial uint32, deleted []DnsRecord, added []DnsRecord) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	soa := p.records[0]
+	soa.serial = serial
+
+	var records []DnsRecord
+	for _, r := range p.records[1:] {
+		keep := true
+		for _, d := range deleted {
+			if r.domain == d.domain && r.qType == d.qType && r.addr == d.addr {
+				keep = false
+			}
+		}
+		if keep {
+			records = append(records, r)
+		}
+	}
+	p.records = append(append([]DnsRecord{soa}, records...), added...)
+	p.deleted = deleted
+	p.added = added
+	p.requests = nil
+}
+
+func TestSecondary(t *testing.T) {
+	soa := DnsRecord{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 1, refresh: 3600, retry: 600, expire: 86400, minimum: 300}
+	primary := &testPrimary{records: []DnsRecord{
+		soa,
+		{domain: "example.com", qType: NS, ttl: 3600, host: "ns1.example.com"},
+		{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.1"},
+		{domain: "mail.example.com", qType: A, ttl: 3600, addr: "192.0.2.2"},
+	}}
+	addr := primary.serve(t)
+
+	saved := zones
+	zones = NewZones()
+	t.Cleanup(func() { zones = saved })
+
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	secondary := NewSecondary("example.com", addr)
+	secondary.now = func() time.Time { return now }
+
+	lookupA := func(name string) []string {
+		zone := zones.find(name)
+		if zone == nil {
+			return nil
+		}
+		var addrs []string
+		for _, r := range zone.answer(name, A, false).answers {
+			addrs = append(addrs, r.addr)
+		}
+		return addrs
+	}
+
+	t.Run("initial transfer", func(t *testing.T) {
+		assert.Equal(t, time.Hour, secondary.refresh())
+		assert.Equal(t, []QueryType{SOA, AXFR}, primary.requests)
+		assert.Equal(t, []string{"192.0.2.1"}, lookupA("www.example.com"))
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		primary.requests = nil
+		assert.Equal(t, time.Hour, secondary.refresh())
+		assert.Equal(t, []QueryType{SOA}, primary.requests)
+	})
+
+	t.Run("incremental transfer", func(t *testing.T) {
+		primary.ixfr = true
+		primary.update(2,
+			[]DnsRecord{{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.1"}},
+			[]DnsRecord{{domain: "www.example.com", qType: A, ttl: 3600, addr: "192.0.2.10"}})
+		assert.Equal(t, time.Hour, secondary.refresh())
+		assert.Equal(t, []QueryType{SOA, IXFR}, primary.requests)
+		assert.Equal(t, []string{"192.0.2.10"}, lookupA("www.example.com"))
+		assert.Equal(t, []string{"192.0.2.2"}, lookupA("mail.example.com"))
+		assert.Equal(t, uint32(2), zones.get("example.com").soa().serial)
+	})
+
+	t.Run("fallback to AXFR", func(t *testing.T) {
+		primary.ixfr = false
+		primary.update(3, nil, []DnsRecord{{domain: "new.example.com", qType: A, ttl: 3600, addr: "192.0.2.3"}})
+		assert.Equal(t, time.Hour, secondary.refresh())
+		assert.Equal(t, []QueryType{SOA, IXFR, AXFR}, primary.requests)
+		assert.Equal(t, []string{"192.0.2.3"}, lookupA("new.example.com"))
+		assert.Equal(t, []string{"192.0.2.10"}, lookupA("www.example.com"))
+	})
+
+	t.Run("serial wrap around", func(t *testing.T) {
+		assert.True(t, serialNewer(1, 0xffffffff))
+		assert.False(t, serialNewer(0xffffffff, 1))
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		secondary.primary = "127.0.0.1:1"
+		now = now.Add(time.Hour)
+		assert.Equal(t, 10*time.Minute, secondary.refresh())
+		assert.NotNil(t, zones.find("www.example.com"))
+
+		now = now.Add(86400*time.Second - time.Hour - time.Minute)
+		assert.Equal(t, time.Minute, secondary.refresh())
+		assert.NotNil(t, zones.find("www.example.com"))
+
+		now = now.Add(time.Minute)
+		assert.Equal(t, SECONDARY_INITIAL_RETRY, secondary.refresh())
+		assert.Nil(t, zones.find("www.example.com"))
+	})
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of the signature validity period and the time before expiry signatures are refreshed
+const (
+	DEFAULT_SIGNATURE_VALIDITY = 14 * 24 * time.Hour
+	DEFAULT_SIGNATURE_REFRESH  = 7 * 24 * time.Hour
+)
+
+// Signatures are dated back to tolerate clocks of validators running behind
+const SIGNATURE_INCEPTION_OFFSET = time.Hour
+
+// Maximum number of signatures kept in the cache of a zone
+const MAX_SIGNATURE_CACHE_SIZE = 100000
+
+// SigningKey is a DNSKEY record together with its private key
+type SigningKey struct {
+	dnskey DnsRecord
+	signer crypto.Signer
+}
+
+// loadSigningKey loads a key pair from the .key and .private files of a BIND style key file name,
+// e.g. Kexample.com.+013+12345
+func loadSigningKey(prefix string) (*SigningKey, error) {
+	prefix = strings.TrimSuffix(strings.TrimSuffix(prefix, ".key"), ".private")
+
+	dnskey, err := readKeyFile(prefix + ".key")
+	if err != nil {
+		return nil, err
+	}
+	signer, err := readPrivateKeyFile(prefix + ".private")
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, err := encodePublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(publicKey, dnskey.publicKey) {
+		return nil, fmt.Errorf("%s: private key does not match the DNSKEY record", prefix)
+	}
+	return &SigningKey{dnskey: *dnskey, signer: signer}, nil
+}
+
+// readKeyFile reads the DNSKEY record of a .key file
+func readKeyFile(path string) (*DnsRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := parseZoneFile(f, "")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(records) != 1 || records[0].qType != DNSKEY {
+		return nil, fmt.Errorf("%s: expected a single DNSKEY record", path)
+	}
+	return &records[0], nil
+}
+
+// readPrivateKeyFile reads a private key in the BIND Private-key-format
+func readPrivateKeyFile(path string) (crypto.Signer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	field := func(name string) ([]byte, error) {
+		value, ok := values[name]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing %s", path, name)
+		}
+		return base64.StdEncoding.DecodeString(value)
+	}
+
+	algorithm, _, _ := strings.Cut(values["Algorithm"], " ")
+	switch algorithm {
+	case fmt.Sprint(RSASHA256), fmt.Sprint(RSASHA512):
+		var parts [5]*big.Int
+		for i, name := range []string{"Modulus", "PublicExponent", "PrivateExponent", "Prime1", "Prime2"} {
+			data, err := field(name)
+			if err != nil {
+				return nil, err
+			}
+			parts[i] = new(big.Int).SetBytes(data)
+		}
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: parts[0], E: int(parts[1].Int64())},
+			D:         parts[2],
+			Primes:    []*big.Int{parts[3], parts[4]},
+		}
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		key.Precompute()
+		return key, nil
+	case fmt.Sprint(ECDSAP256SHA256), fmt.Sprint(ECDSAP384SHA384):
+		data, err := field("PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		curve, ecdhCurve := elliptic.P256(), ecdh.P256()
+		if algorithm == fmt.Sprint(ECDSAP384SHA384) {
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		}
+		// derive the public point from the private scalar
+		private, err := ecdhCurve.NewPrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		point := private.PublicKey().Bytes()[1:]
+		size := len(point) / 2
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(point[:size]), Y: new(big.Int).SetBytes(point[size:])},
+			D:         new(big.Int).SetBytes(data),
+		}, nil
+	case fmt.Sprint(ED25519):
+		seed, err := field("PrivateKey")
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: invalid Ed25519 private key", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	return nil, fmt.Errorf("%s: unsupported algorithm %q", path, values["Algorithm"])
+}
+
+// ZoneSigner signs the answers of a zone on the fly
+type ZoneSigner struct {
+	ksks []*SigningKey // sign the DNSKEY set
+	zsks []*SigningKey // sign all other records
+
+	nsec3      bool
+	optOut     bool
+	salt       []byte
+	iterations uint16
+
+	validity time.Duration
+	refresh  time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cachedSignature
+}
+
+type cachedSignature struct {
+	sigs      []DnsRecord
+	refreshAt time.Time
+}
+
+// NewZoneSigner creates a new ZoneSigner. Without zone signing keys the key signing keys sign everything.
+func NewZoneSigner(ksks []*SigningKey, zsks []*SigningKey) (*ZoneSigner, error) {
+	if len(ksks) == 0 {
+		return nil, errors.New("no key signing key")
+	}
+	if len(zsks) == 0 {
+		zsks = ksks
+	}
+	return &ZoneSigner{
+		ksks:     ksks,
+		zsks:     zsks,
+		validity: DEFAULT_SIGNATURE_VALIDITY,
+		refresh:  DEFAULT_SIGNATURE_REFRESH,
+		now:      time.Now,
+		cache:    map[string]cachedSignature{},
+	}, nil
+}
+
+// enableSigning publishes the signer's DNSKEY records in the zone and builds its denial of existence chain
+func (z *Zone) enableSigning(signer *ZoneSigner) {
+	ttl := z.soa().minimum
+	seen := map[uint16]bool{}
+	for _, key := range append(append([]*SigningKey{}, signer.ksks...), signer.zsks...) {
+		tag := calculateKeyTag(&key.dnskey)
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		// the signer name of the RRSIGs made with the key is the zone
+		key.dnskey.domain = z.origin
+		dnskey := key.dnskey
+		dnskey.ttl = ttl
+		z.add(dnskey)
+	}
+
+	if signer.nsec3 {
+		z.add(DnsRecord{qType: NSEC3PARAM, domain: z.origin, hashAlgorithm: NSEC3_SHA1, iterations: signer.iterations, salt: signer.salt})
+	}
+
+	z.signer = signer
+	z.chain = z.buildChain()
+}
+
+// dsRecords returns the DS records of the key signing keys to publish in the parent zone
+func (z *Zone) dsRecords() []DnsRecord {
+	var res []DnsRecord
+	for _, key := range z.signer.ksks {
+		ds, err := newDSRecord(&key.dnskey, DIGEST_SHA256)
+		if err == nil {
+			res = append(res, *ds)
+		}
+	}
+	return res
+}
+
+// delegated reports whether the name is at or below a delegation point of the zone
+func (z *Zone) delegated(name string) bool {
+	for n := strings.ToLower(name); n != z.origin && n != ""; n = parentName(n) {
+		if len(z.records(n, NS)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildChain builds the NSEC or NSEC3 records of the zone
+func (z *Zone) buildChain() []DnsRecord {
+	ttl := z.negativeSOA().ttl
+
+	var owners []string
+	for name := range z.nodes {
+		// data below a delegation point belongs to the child zone
+		if name != z.origin && z.delegated(parentName(name)) {
+			continue
+		}
+		if !z.signer.nsec3 && len(z.names[name]) == 0 {
+			continue // empty non-terminals have no NSEC record
+		}
+		if z.signer.nsec3 && z.signer.optOut && z.delegated(name) && len(z.records(name, DS)) == 0 {
+			continue // unsigned delegations are left out of an opt-out chain
+		}
+		owners = append(owners, name)
+	}
+
+	bitmap := func(name string) []QueryType {
+		var types []QueryType
+		signed := false
+		for _, r := range z.names[name] {
+			if !hasType(types, r.qType) {
+				types = append(types, r.qType)
+			}
+			if !z.delegated(name) || r.qType == DS {
+				signed = true
+			}
+		}
+		if signed {
+			types = append(types, RRSIG)
+		}
+		return types
+	}
+
+	var chain []DnsRecord
+	if !z.signer.nsec3 {
+		sort.Slice(owners, func(i, j int) bool { return compareNames(owners[i], owners[j]) < 0 })
+		for i, owner := range owners {
+			types := bitmap(owner)
+			if !hasType(types, RRSIG) {
+				types = append(types, RRSIG)
+			}
+			chain = append(chain, DnsRecord{
+				qType: NSEC, domain: owner, ttl: ttl, nextDomain: owners[(i+1)%len(owners)], typeBitMap: append(types, NSEC),
+			})
+		}
+		return chain
+	}
+
+	hashes := map[string]string{}
+	var sorted []string
+	for _, owner := range owners {
+		h := string(nsec3Hash(owner, z.signer.salt, z.signer.iterations))
+		hashes[h] = owner
+		sorted = append(sorted, h)
+	}
+	sort.Strings(sorted)
+
+	var flags uint16
+	if z.signer.optOut {
+		flags = NSEC3_OPT_OUT
+	}
+	for i, h := range sorted {
+		chain = append(chain, DnsRecord{
+			qType:         NSEC3,
+			domain:        strings.ToLower(base32Hex.EncodeToString([]byte(h))) + "." + z.origin,
+			ttl:           ttl,
+			hashAlgorithm: NSEC3_SHA1,
+			flags:         flags,
+			iterations:    z.signer.iterations,
+			salt:          z.signer.salt,
+			nextHashed:    []byte(sorted[(i+1)%len(sorted)]),
+			typeBitMap:    bitmap(hashes[h]),
+		})
+	}
+	return chain
+}
+
+// chainIndex finds the chain record matching the name, or else the one covering it
+func (z *Zone) chainIndex(name string) (int, bool) {
+	if len(z.chain) == 0 {
+		return 0, false
+	}
+
+	var i int
+	if z.signer.nsec3 {
+		hash := nsec3Hash(name, z.signer.salt, z.signer.iterations)
+		owner := func(k int) []byte {
+			label, _, _ := strings.Cut(z.chain[k].domain, ".")
+			h, _ := base32Hex.DecodeString(strings.ToUpper(label))
+			return h
+		}
+		i = sort.Search(len(z.chain), func(k int) bool { return bytes.Compare(owner(k), hash) > 0 }) - 1
+		if i >= 0 && bytes.Equal(owner(i), hash) {
+			return i, true
+		}
+	} else {
+		i = sort.Search(len(z.chain), func(k int) bool { return compareNames(z.chain[k].domain, name) > 0 }) - 1
+		if i >= 0 && compareNames(z.chain[i].domain, name) == 0 {
+			return i, true
+		}
+	}
+
+	// names before the first record are covered by the last one, which wraps around
+	if i < 0 {
+		i = len(z.chain) - 1
+	}
+	return i, false
+}
+
+// closestEncloser returns the closest ancestor of the name existing in the zone
+func (z *Zone) closestEncloser(name string) string {
+	n := strings.ToLower(name)
+	for n != z.origin && (!z.exists(n) || (z.signer.nsec3 && z.signer.optOut && z.delegated(n) && len(z.records(n, DS)) == 0)) {
+		n = parentName(n)
+	}
+	return n
+}
+
+// denial returns the NSEC or NSEC3 records proving that the name, or its records of the type, do not exist
+func (z *Zone) denial(name string, qtype QueryType, nxdomain bool) []DnsRecord {
+	var indexes []int
+	addMatching := func(n string) bool {
+		i, ok := z.chainIndex(n)
+		if ok {
+			indexes = append(indexes, i)
+		}
+		return ok
+	}
+	addCovering := func(n string) {
+		i, _ := z.chainIndex(n)
+		indexes = append(indexes, i)
+	}
+
+	name = strings.ToLower(name)
+	if !nxdomain && addMatching(name) {
+		// NODATA: the record of the name shows the types it has
+	} else {
+		encloser := z.closestEncloser(name)
+		if z.signer.nsec3 {
+			// closest encloser proof (RFC 5155 7.2.1)
+			addMatching(encloser)
+			labels := strings.Split(name, ".")
+			addCovering(strings.Join(labels[len(labels)-countLabels(encloser)-1:], "."))
+		} else {
+			addCovering(name)
+		}
+		if nxdomain {
+			addCovering("*." + encloser)
+		}
+	}
+
+	return z.chainRecords(indexes)
+}
+
+// wildcardDenial returns the NSEC or NSEC3 records proving that a name answered from the wildcard does not exist
+// (RFC 4035 3.1.3.3, RFC 5155 7.2.6). With nodata set they also prove the wildcard has no records of the type.
+func (z *Zone) wildcardDenial(name string, wildcard string, nodata bool) []DnsRecord {
+	var indexes []int
+	add := func(n string) {
+		i, _ := z.chainIndex(n)
+		indexes = append(indexes, i)
+	}
+
+	name = strings.ToLower(name)
+	encloser := parentName(wildcard)
+	if z.signer.nsec3 {
+		labels := strings.Split(name, ".")
+		add(strings.Join(labels[len(labels)-countLabels(encloser)-1:], "."))
+		if nodata {
+			add(encloser)
+		}
+	} else {
+		add(name)
+	}
+	if nodata {
+		add(wildcard)
+	}
+	return z.chainRecords(indexes)
+}
+
+// chainRecords returns the chain records at the indexes, without duplicates
+func (z *Zone) chainRecords(indexes []int) []DnsRecord {
+	var res []DnsRecord
+	seen := map[int]bool{}
+	for _, i := range indexes {
+		if !seen[i] {
+			seen[i] = true
+			res = append(res, z.chain[i])
+		}
+	}
+	return res
+}
+
+// signRecords returns the records followed by the RRSIGs of each of their RRsets
+func (s *ZoneSigner) signRecords(records []DnsRecord) ([]DnsRecord, error) {
+	res := append([]DnsRecord{}, records...)
+	rrsets, _ := splitRRsets(records)
+	for _, rrset := range rrsets {
+		sigs, err := s.signatures(rrset)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sigs...)
+	}
+	return res, nil
+}
+
+// signatures returns the RRSIGs over the RRset, from the cache unless they are due to be refreshed
+func (s *ZoneSigner) signatures(rrset []DnsRecord) ([]DnsRecord, error) {
+	key, err := signatureCacheKey(rrset)
+	if err != nil {
+		return nil, err
+	}
+	now := s.now()
+
+	s.mu.Lock()
+	cached, ok := s.cache[key]
+	s.mu.Unlock()
+	if ok && now.Before(cached.refreshAt) {
+		return cached.sigs, nil
+	}
+
+	keys := s.zsks
+	if rrset[0].qType == DNSKEY {
+		keys = s.ksks
+	}
+
+	owner := rrset[0].domain
+	labels := countLabels(owner)
+	if strings.HasPrefix(owner, "*.") || owner == "*" {
+		labels--
+	}
+	expiration := now.Add(s.validity)
+
+	var sigs []DnsRecord
+	for _, k := range keys {
+		sig := DnsRecord{
+			qType:       RRSIG,
+			domain:      owner,
+			ttl:         rrset[0].ttl,
+			typeCovered: rrset[0].qType,
+			algorithm:   k.dnskey.algorithm,
+			labels:      uint8(labels),
+			originalTTL: rrset[0].ttl,
+			expiration:  uint32(expiration.Unix()),
+			inception:   uint32(now.Add(-SIGNATURE_INCEPTION_OFFSET).Unix()),
+			keyTag:      calculateKeyTag(&k.dnskey),
+			signerName:  k.dnskey.domain,
+		}
+		if err := signRRset(k.signer, &sig, rrset); err != nil {
+			return nil, fmt.Errorf("error signing %s %s: %w", owner, rrset[0].qType, err)
+		}
+		sigs = append(sigs, sig)
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= MAX_SIGNATURE_CACHE_SIZE {
+		s.cache = map[string]cachedSignature{}
+	}
+	s.cache[key] = cachedSignature{sigs: sigs, refreshAt: expiration.Add(-s.refresh)}
+	s.mu.Unlock()
+	return sigs, nil
+}
+
+// signatureCacheKey identifies an RRset by its owner, type, ttl and data
+func signatureCacheKey(rrset []DnsRecord) (string, error) {
+	h := sha256.New()
+	for i := range rrset {
+		data, err := canonicalData(&rrset[i])
+		if err != nil {
+			return "", err
+		}
+		h.Write(data)
+	}
+	return fmt.Sprintf("%s/%d/%d/%s", strings.ToLower(rrset[0].domain), rrset[0].qType, rrset[0].ttl, hex.EncodeToString(h.Sum(nil))), nil
+}
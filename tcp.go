@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+)
+
+// Time an idle tcp connection is kept open waiting for the next query
+const TCP_IDLE_TIMEOUT = 10 * time.Second
+
+// serveTCP accepts tcp connections, each served by its own goroutine
+func serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("error accepting tcp connection: %v\n", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := handleTCPConn(conn); err != nil {
+				log.Printf("error handling tcp connection from %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// handleTCPConn answers the queries sent over a tcp connection until the client closes it
+func handleTCPConn(conn net.Conn) error {
+	for {
+		conn.SetDeadline(time.Now().Add(TCP_IDLE_TIMEOUT))
+		requestBuf, err := readMessage(conn)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return nil
+			}
+			return err
+		}
+
+		request := NewDnsPacket()
+		if err := request.fromBuffer(requestBuf); err != nil {
+			return err
+		}
+
+		if err := answerTCPQuery(conn, request); err != nil {
+			return err
+		}
+	}
+}
+
+// answerTCPQuery sends the response to the query, or the zone transfer, over the tcp connection
+func answerTCPQuery(conn net.Conn, request *DnsPacket) error {
+	serving.RLock()
+	defer serving.RUnlock()
+
+	if request.header.opcode == OPCODE_QUERY && len(request.questions) == 1 && request.questions[0].qtype == AXFR {
+		return transferZone(conn, request)
+	}
+
+	packet, err := buildResponse(request, clientIP(conn.RemoteAddr()), true)
+	if err != nil || packet == nil {
+		return err
+	}
+	data, err := writeResponse(packet, MAX_MESSAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	return writeMessage(conn, data)
+}
+
+// readMessage reads a message prefixed by its two byte length
+func readMessage(r io.Reader) (*BytePacketBuffer, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+
+	buf := NewBytePacketBufferSize(int(binary.BigEndian.Uint16(length[:])))
+	if _, err := io.ReadFull(r, buf.buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// writeMessage writes a message prefixed by its two byte length
+func writeMessage(w io.Writer, data []byte) error {
+	if len(data) > MAX_MESSAGE_SIZE {
+		return errors.New("message too long")
+	}
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(data)))
+	_, err := w.Write(append(msg, data...))
+	return err
+}
+
+// clientIP returns the ip address of a client's network address
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"strings"
+	"time"
+)
+
+// Time difference between the clocks of signer and verifier tolerated by TSIG, in seconds
+const TSIG_FUDGE = 300
+
+// Maximum number of unsigned messages between the signed messages of a response
+const TSIG_MAX_UNSIGNED = 99
+
+// TSIG algorithm names
+const (
+	HMAC_SHA256 = "hmac-sha256"
+	HMAC_SHA512 = "hmac-sha512"
+)
+
+var tsigHashes = map[string]func() hash.Hash{
+	HMAC_SHA256: sha256.New,
+	HMAC_SHA512: sha512.New,
+}
+
+// TsigKey is a shared secret for transaction signatures
+type TsigKey struct {
+	name      string
+	algorithm string
+	secret    []byte
+}
+
+// NewTsigKey creates a new TsigKey
+func NewTsigKey(name string, algorithm string, secret []byte) (*TsigKey, error) {
+	algorithm = strings.ToLower(strings.TrimSuffix(algorithm, "."))
+	if _, ok := tsigHashes[algorithm]; !ok {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %s", algorithm)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("empty TSIG secret")
+	}
+	return &TsigKey{name: strings.ToLower(strings.TrimSuffix(name, ".")), algorithm: algorithm, secret: secret}, nil
+}
+
+// TsigSession signs and verifies the messages of a transaction, a request and its responses (RFC 8945).
+// The MAC of each message covers the MAC of the message before it.
+type TsigSession struct {
+	key        *TsigKey
+	mac        []byte     // MAC of the previous message
+	timersOnly bool       // set once the first message of a response has been signed or verified
+	err        ResultCode // TSIG error of a response
+	now        func() time.Time
+
+	// unsigned messages of a response since its last signed one
+	unsigned      []byte
+	unsignedCount int
+}
+
+// NewTsigSession creates a new TsigSession signing a request with the key
+func NewTsigSession(key *TsigKey) *TsigSession {
+	return &TsigSession{key: key, now: time.Now}
+}
+
+// sign appends the TSIG record to the message written to buf
+func (t *TsigSession) sign(buf *BytePacketBuffer) error {
+	message, err := buf.getRange(0, buf.position())
+	if err != nil {
+		return err
+	}
+	if len(message) < 12 {
+		return errors.New("message too short to sign")
+	}
+
+	now := uint64(t.now().Unix())
+	record := DnsRecord{
+		domain:        t.key.name,
+		qType:         TSIG,
+		class:         CLASS_ANY,
+		algorithmName: t.key.algorithm,
+		timeSigned:    now,
+		fudge:         TSIG_FUDGE,
+		originalID:    binary.BigEndian.Uint16(message[0:2]),
+		tsigError:     t.err,
+	}
+	if t.err == BadTime {
+		// the time of the server tells the client how far apart the clocks are
+		record.otherData = binary.BigEndian.AppendUint64(nil, now)[2:]
+	}
+	// responses to requests with unknown keys or invalid signatures are not signed
+	if t.err != BadKey && t.err != BadSig {
+		record.mac = t.computeMAC(message, &record)
+	}
+
+	response := message[2]&0x80 != 0
+	additional := binary.BigEndian.Uint16(message[10:12])
+	if err := record.write(buf); err != nil {
+		return err
+	}
+	if err := buf.set2Byte(10, additional+1); err != nil {
+		return err
+	}
+	t.mac = record.mac
+	t.timersOnly = response
+	return nil
+}
+
+// verify checks the TSIG record of a response to a signed request. The message is the response as received.
+func (t *TsigSession) verify(packet *DnsPacket, message []byte) error {
+	record := packet.tsigRecord()
+	if record == nil {
+		// the first message of a response is signed, later ones may be unsigned in between
+		if !t.timersOnly || t.unsignedCount >= TSIG_MAX_UNSIGNED {
+			return errors.New("unsigned response to a signed request")
+		}
+		t.unsigned = append(t.unsigned, message...)
+		t.unsignedCount++
+		return nil
+	}
+
+	if record.tsigError != NoError {
+		return fmt.Errorf("TSIG error %d", record.tsigError)
+	}
+	if !strings.EqualFold(strings.TrimSuffix(record.domain, "."), t.key.name) ||
+		!strings.EqualFold(strings.TrimSuffix(record.algorithmName, "."), t.key.algorithm) {
+		return errors.New("response signed with another TSIG key")
+	}
+	if !hmac.Equal(record.mac, t.computeMAC(append(t.unsigned, packet.signedData...), record)) {
+		return errors.New("invalid TSIG signature")
+	}
+	if !withinFudge(record, t.now()) {
+		return errors.New("TSIG time outside of the fudge")
+	}
+
+	t.mac = record.mac
+	t.timersOnly = true
+	t.unsigned = nil
+	t.unsignedCount = 0
+	return nil
+}
+
+// computeMAC computes the MAC over the message and the variables of the TSIG record.
+// Later messages of a response only cover the timers of the variables.
+func (t *TsigSession) computeMAC(message []byte, record *DnsRecord) []byte {
+	h := hmac.New(tsigHashes[t.key.algorithm], t.key.secret)
+	if len(t.mac) > 0 {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(t.mac))))
+		h.Write(t.mac)
+	}
+	h.Write(message)
+
+	variables := NewBytePacketBufferSize(2 * MAX_PACKET_SIZE)
+	if !t.timersOnly {
+		variables.writeQName(t.key.name)
+		variables.write2Byte(CLASS_ANY)
+		variables.write4Byte(0)
+		variables.writeQName(t.key.algorithm)
+	}
+	record.writeTSIGTimers(variables)
+	if !t.timersOnly {
+		record.writeTSIGError(variables)
+	}
+	h.Write(variables.buf[:variables.position()])
+	return h.Sum(nil)
+}
+
+// size returns the largest size of the TSIG records
+func (t *TsigSession) size() int {
+	nameLen := len(t.key.name) + 2
+	algorithmLen := len(t.key.algorithm) + 2
+	// type, class, ttl and data length, timers, MAC size, original id, error and other data of BADTIME
+	return nameLen + 10 + algorithmLen + 8 + 2 + tsigHashes[t.key.algorithm]().Size() + 2 + 4 + 6
+}
+
+// withinFudge reports whether the time signed of the TSIG record is close enough to now
+func withinFudge(record *DnsRecord, now time.Time) bool {
+	diff := now.Unix() - int64(record.timeSigned)
+	return diff <= int64(record.fudge) && -diff <= int64(record.fudge)
+}
+
+// verifyRequest checks the TSIG record of a request against the configured keys. The TSIG of a verified
+// request signs its response; when verification fails it sends the TSIG error in the response.
+func verifyRequest(request *DnsPacket) ResultCode {
+	// the TSIG record must be the only one and the last record of the message (RFC 8945 5.1)
+	if request.misplacedTsig() {
+		log.Printf("request with a misplaced TSIG record\n")
+		return Formerr
+	}
+	record := request.tsigRecord()
+	if record == nil {
+		return NoError
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(record.domain, "."))
+	key := tsigKeys[name]
+	if key == nil || !strings.EqualFold(strings.TrimSuffix(record.algorithmName, "."), key.algorithm) {
+		log.Printf("request signed with unknown TSIG key %s\n", fqdn(name))
+		request.tsig = &TsigSession{key: &TsigKey{name: name, algorithm: record.algorithmName}, err: BadKey, now: time.Now}
+		return NotAuth
+	}
+
+	t := NewTsigSession(key)
+	if !hmac.Equal(record.mac, t.computeMAC(request.signedData, record)) {
+		log.Printf("request with invalid TSIG signature of key %s\n", fqdn(name))
+		request.tsig = &TsigSession{key: key, err: BadSig, now: time.Now}
+		return NotAuth
+	}
+	t.mac = record.mac
+	if !withinFudge(record, t.now()) {
+		log.Printf("request signed with TSIG key %s outside of the time fudge\n", fqdn(name))
+		t.err = BadTime
+		request.tsig = t
+		return NotAuth
+	}
+	request.tsig = t
+	return NoError
+}
+
+// tsigKeyName returns the name of the key a received request was verified with, or "" when it is not signed
+func (d *DnsPacket) tsigKeyName() string {
+	if d.tsig == nil || d.tsig.err != NoError {
+		return ""
+	}
+	return d.tsig.key.name
+}
+
+// keyAllowed reports whether the name is in the list of key names
+func keyAllowed(keys []string, name string) bool {
+	for _, k := range keys {
+		if name != "" && k == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRead writes the packet and reads it back, returning the message and the packet read
+func writeRead(t *testing.T, packet *DnsPacket) ([]byte, *DnsPacket) {
+	buf := NewBytePacketBufferSize(MAX_MESSAGE_SIZE)
+	require.NoError(t, packet.write(buf))
+	message := append([]byte(nil), buf.buf[:buf.position()]...)
+
+	res := NewDnsPacket()
+	require.NoError(t, res.fromBuffer(&BytePacketBuffer{buf: message}))
+	return message, res
+}
+
+func TestTsig(t *testing.T) {
+	sha256Key, err := NewTsigKey("transfer.key.", "hmac-sha256", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	sha512Key, err := NewTsigKey("update.key", "HMAC-SHA512.", []byte("another secret of the update key"))
+	require.NoError(t, err)
+	otherKey, err := NewTsigKey("transfer.key", "hmac-sha256", []byte("not the shared secret"))
+	require.NoError(t, err)
+	unknownKey, err := NewTsigKey("unknown.key", "hmac-sha256", []byte("secret"))
+	require.NoError(t, err)
+
+	saved := tsigKeys
+	tsigKeys = map[string]*TsigKey{sha256Key.name: sha256Key, sha512Key.name: sha512Key}
+	t.Cleanup(func() { tsigKeys = saved })
+
+	testcases := []struct {
+		name     string
+		key      *TsigKey
+		offset   time.Duration
+		tamper   bool
+		resCode  ResultCode
+		tsigErr  ResultCode
+		verified bool // whether the client verifies the response
+	}{
+		{name: "hmac-sha256", key: sha256Key, resCode: NoError, verified: true},
+		{name: "hmac-sha512", key: sha512Key, resCode: NoError, verified: true},
+		{name: "within the fudge", key: sha256Key, offset: -4 * time.Minute, resCode: NoError, verified: true},
+		{name: "unknown key", key: unknownKey, resCode: NotAuth, tsigErr: BadKey},
+		{name: "wrong secret", key: otherKey, resCode: NotAuth, tsigErr: BadSig},
+		{name: "tampered message", key: sha256Key, tamper: true, resCode: NotAuth, tsigErr: BadSig},
+		{name: "outside the fudge", key: sha256Key, offset: -10 * time.Minute, resCode: NotAuth, tsigErr: BadTime},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := NewDnsPacket()
+			request.header = DnsHeader{id: 7, opcode: OPCODE_NOTIFY}
+			request.questions = []DnsQuestion{{name: "example.com", qtype: SOA}}
+			client := NewTsigSession(tc.key)
+			client.now = func() time.Time { return time.Now().Add(tc.offset) }
+			request.tsig = client
+
+			_, received := writeRead(t, request)
+			require.NotNil(t, received.tsigRecord())
+			assert.Equal(t, uint16(1), received.header.resourceEntries)
+			if tc.tamper {
+				received.signedData[len(received.signedData)-1] ^= 1
+			}
+
+			assert.Equal(t, tc.resCode, verifyRequest(received))
+			require.NotNil(t, received.tsig)
+			assert.Equal(t, tc.tsigErr, received.tsig.err)
+
+			// the response carries the TSIG error, signed unless the key or signature is bad
+			response := NewDnsPacket()
+			response.header = DnsHeader{id: 7, opcode: OPCODE_NOTIFY, response: true, resCode: tc.resCode}
+			response.questions = request.questions
+			response.tsig = received.tsig
+			responseMessage, responseRead := writeRead(t, response)
+			record := responseRead.tsigRecord()
+			require.NotNil(t, record)
+			assert.Equal(t, tc.tsigErr, record.tsigError)
+			if tc.tsigErr == BadTime {
+				assert.Len(t, record.otherData, 6)
+			}
+
+			err := client.verify(responseRead, responseMessage)
+			if tc.verified {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestTsigZoneTransfer(t *testing.T) {
+	key, err := NewTsigKey("transfer.key", "hmac-sha256", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	saved := tsigKeys
+	tsigKeys = map[string]*TsigKey{key.name: key}
+	t.Cleanup(func() { tsigKeys = saved })
+
+	records := []DnsRecord{
+		{domain: "example.com", qType: SOA, ttl: 3600, host: "ns1.example.com", mailbox: "admin.example.com", serial: 5, refresh: 3600, retry: 600, expire: 86400, minimum: 300},
+		{domain: "example.com", qType: NS, ttl: 3600, host: "ns1.example.com"},
+	}
+	for i := 0; i < 4000; i++ {
+		records = append(records, DnsRecord{domain: fmt.Sprintf("host%d.example.com", i), qType: A, ttl: 3600, addr: fmt.Sprintf("10.1.%d.%d", i>>8, i&0xff)})
+	}
+	zone, err := NewZone("example.com", records)
+	require.NoError(t, err)
+	zone.transferKeys = []string{key.name}
+
+	savedZones := zones
+	zones = NewZones()
+	zones.add(zone)
+	t.Cleanup(func() { zones = savedZones })
+	addr := startTCPServer(t)
+
+	axfr := func() *DnsPacket {
+		request := NewDnsPacket()
+		request.header = DnsHeader{id: newQueryID()}
+		request.questions = []DnsQuestion{{name: "example.com", qtype: AXFR}}
+		return request
+	}
+
+	t.Run("signed", func(t *testing.T) {
+		transferred, err := receiveTransfer(addr, axfr(), key)
+		require.NoError(t, err)
+		assert.Len(t, transferred, len(records)+1)
+	})
+
+	t.Run("unsigned", func(t *testing.T) {
+		_, err := receiveTransfer(addr, axfr(), nil)
+		var rcodeErr *ResultCodeError
+		require.ErrorAs(t, err, &rcodeErr)
+		assert.Equal(t, Refused, rcodeErr.resCode)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		wrong, err := NewTsigKey("transfer.key", "hmac-sha256", []byte("wrong"))
+		require.NoError(t, err)
+		_, err = receiveTransfer(addr, axfr(), wrong)
+		assert.ErrorContains(t, err, "TSIG error 16")
+	})
+
+	t.Run("signed query", func(t *testing.T) {
+		soa, err := querySOA(addr, "example.com", key)
+		require.NoError(t, err)
+		assert.Equal(t, uint32(5), soa.serial)
+	})
+}
+
+func TestTsigPlacement(t *testing.T) {
+	key, err := NewTsigKey("transfer.key", "hmac-sha256", []byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	saved := tsigKeys
+	tsigKeys = map[string]*TsigKey{key.name: key}
+	t.Cleanup(func() { tsigKeys = saved })
+
+	testcases := []struct {
+		name    string
+		modify  func(p *DnsPacket)
+		resCode ResultCode
+	}{
+		{name: "last record", modify: func(p *DnsPacket) {}, resCode: NoError},
+		{name: "before the last record", modify: func(p *DnsPacket) {
+			p.resources = append(p.resources, newOptRecord(EDNS_BUFFER_SIZE, false))
+		}, resCode: Formerr},
+		{name: "twice", modify: func(p *DnsPacket) {
+			p.resources = append(p.resources, p.resources[0])
+		}, resCode: Formerr},
+		{name: "in the answers", modify: func(p *DnsPacket) {
+			p.answers = append(p.answers, p.resources[0])
+			p.resources = nil
+		}, resCode: Formerr},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := NewDnsPacket()
+			request.header = DnsHeader{id: 7, opcode: OPCODE_NOTIFY}
+			request.questions = []DnsQuestion{{name: "example.com", qtype: SOA}}
+			request.tsig = NewTsigSession(key)
+			_, signed := writeRead(t, request)
+
+			// the modified message is sent unsigned, keeping the TSIG record as it is
+			signed.tsig = nil
+			tc.modify(signed)
+			_, received := writeRead(t, signed)
+			assert.Equal(t, tc.resCode, verifyRequest(received))
+		})
+	}
+}
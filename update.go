@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// updateMu serializes dynamic updates, so each one applies to the latest version of its zone
+var updateMu sync.Mutex
+
+// answerUpdate answers an UPDATE message (RFC 2136), applying its changes to a local zone
+func answerUpdate(request *DnsPacket, client net.IP) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{id: request.header.id, opcode: OPCODE_UPDATE, response: true}
+	packet.questions = request.questions
+	packet.tsig = request.tsig
+	packet.header.resCode = applyUpdate(request, client)
+	return packet
+}
+
+// applyUpdate checks the prerequisites of an UPDATE message and applies its updates atomically
+func applyUpdate(request *DnsPacket, client net.IP) ResultCode {
+	// the zone section holds a single SOA question for the zone
+	if len(request.questions) != 1 || request.questions[0].qtype != SOA {
+		return Formerr
+	}
+
+	updateMu.Lock()
+	defer updateMu.Unlock()
+
+	zone := zones.get(request.questions[0].name)
+	if zone == nil {
+		return NotAuth
+	}
+	if _, ok := secondaries[zone.origin]; ok {
+		// forwarding updates to the primary is not supported
+		return NotImp
+	}
+	if !zone.updateAllowed(client, request.tsigKeyName()) {
+		log.Printf("update of zone %s refused for %s\n", fqdn(zone.origin), client)
+		return Refused
+	}
+
+	if resCode := zone.checkPrerequisites(request.answers); resCode != NoError {
+		return resCode
+	}
+	records, resCode := zone.applyUpdates(request.authorities)
+	if resCode != NoError {
+		return resCode
+	}
+
+	deleted, added, err := diffRecords(zone.allRecords(), records)
+	if err != nil {
+		log.Printf("error updating zone %s: %v\n", fqdn(zone.origin), err)
+		return Servfail
+	}
+	if len(deleted) == 0 && len(added) == 0 {
+		return NoError
+	}
+
+	// the serial is increased unless the update set a newer one
+	serial := zone.soa().serial
+	for i, r := range records {
+		if r.qType == SOA && r.serial == serial {
+			records[i].serial++
+			deleted = append(deleted, *zone.soa())
+			added = append(added, records[i])
+		}
+	}
+
+	updated, err := zone.withRecords(records)
+	if err == nil {
+		err = zone.appendJournal(deleted, added)
+	}
+	if err != nil {
+		log.Printf("error updating zone %s: %v\n", fqdn(zone.origin), err)
+		return Servfail
+	}
+	zones.add(updated)
+	log.Printf("updated zone %s to serial %d\n", fqdn(zone.origin), updated.soa().serial)
+	updated.sendNotify()
+	return NoError
+}
+
+// updateAllowed reports whether the client, or the holder of the key the request was signed with, may update the zone
+func (z *Zone) updateAllowed(client net.IP, key string) bool {
+	return keyAllowed(z.updateKeys, key) || (client != nil && containsIP(z.allowUpdate, client))
+}
+
+// checkPrerequisites checks the prerequisite section of an UPDATE message against the zone (RFC 2136 3.2)
+func (z *Zone) checkPrerequisites(prereqs []DnsRecord) ResultCode {
+	// RRsets which must exist with exactly the listed records
+	rrsets := map[string][]DnsRecord{}
+	var keys []string
+	for _, r := range prereqs {
+		if r.ttl != 0 {
+			return Formerr
+		}
+		if !isSubdomain(r.domain, z.origin) {
+			return NotZone
+		}
+
+		name := strings.ToLower(r.domain)
+		switch r.class {
+		case CLASS_ANY:
+			if !r.empty {
+				return Formerr
+			}
+			if r.qType == ANY && len(z.names[name]) == 0 {
+				// the name must be in use
+				return NxDomain
+			}
+			if r.qType != ANY && len(z.records(name, r.qType)) == 0 {
+				// the RRset must exist
+				return NXRRSet
+			}
+		case CLASS_NONE:
+			if !r.empty {
+				return Formerr
+			}
+			if r.qType == ANY && len(z.names[name]) > 0 {
+				// the name must not be in use
+				return YXDomain
+			}
+			if r.qType != ANY && len(z.records(name, r.qType)) > 0 {
+				// the RRset must not exist
+				return YXRRSet
+			}
+		case 0:
+			if r.empty || r.qType == ANY {
+				return Formerr
+			}
+			key := fmt.Sprintf("%s %d", name, r.qType)
+			if _, ok := rrsets[key]; !ok {
+				keys = append(keys, key)
+			}
+			rrsets[key] = append(rrsets[key], r)
+		default:
+			return Formerr
+		}
+	}
+
+	for _, key := range keys {
+		rrset := rrsets[key]
+		if !sameRecords(z.records(rrset[0].domain, rrset[0].qType), rrset) {
+			return NXRRSet
+		}
+	}
+	return NoError
+}
+
+// applyUpdates returns the records of the zone after applying the update section of an UPDATE message (RFC 2136 3.4)
+func (z *Zone) applyUpdates(updates []DnsRecord) ([]DnsRecord, ResultCode) {
+	for _, r := range updates {
+		if !isSubdomain(r.domain, z.origin) {
+			return nil, NotZone
+		}
+		if r.qType == AXFR || r.qType == IXFR || (r.qType == ANY && r.class != CLASS_ANY) {
+			return nil, Formerr
+		}
+		switch r.class {
+		case 0:
+			if r.empty {
+				return nil, Formerr
+			}
+		case CLASS_ANY:
+			if r.ttl != 0 || !r.empty {
+				return nil, Formerr
+			}
+		case CLASS_NONE:
+			if r.ttl != 0 || r.empty {
+				return nil, Formerr
+			}
+		default:
+			return nil, Formerr
+		}
+		if z.signer != nil && signerType(r.qType) {
+			// the records of the online signer are not updatable
+			return nil, Refused
+		}
+	}
+
+	names := map[string][]DnsRecord{}
+	for name, records := range z.names {
+		names[name] = append([]DnsRecord{}, records...)
+	}
+	soaSerial := z.soa().serial
+	for _, r := range updates {
+		name := strings.ToLower(r.domain)
+		apex := name == z.origin
+		key, err := recordKey(&r)
+		if err != nil {
+			return nil, Formerr
+		}
+
+		var kept []DnsRecord
+		switch r.class {
+		case 0:
+			// CNAME records cannot be added to names with other data, nor other data to CNAME records
+			cname := len(filterType(names[name], CNAME)) > 0
+			if len(names[name]) > 0 && cname != (r.qType == CNAME) {
+				continue
+			}
+			if r.qType == SOA && (!apex || !serialNewer(r.serial, soaSerial)) {
+				continue
+			}
+			for _, e := range names[name] {
+				// the record replaces an equal one, SOA and CNAME records replace the existing one
+				k, _ := recordKey(&e)
+				if k != key && !(e.qType == r.qType && (r.qType == SOA || r.qType == CNAME)) {
+					kept = append(kept, e)
+				}
+			}
+			kept = append(kept, r)
+		case CLASS_ANY:
+			for _, e := range names[name] {
+				protected := (apex && (e.qType == SOA || e.qType == NS)) || (z.signer != nil && signerType(e.qType))
+				if protected || (r.qType != ANY && e.qType != r.qType) {
+					kept = append(kept, e)
+				}
+			}
+		case CLASS_NONE:
+			if r.qType == SOA {
+				continue
+			}
+			// the last NS record of the zone is not deleted
+			if apex && r.qType == NS && len(filterType(names[name], NS)) == 1 {
+				continue
+			}
+			for _, e := range names[name] {
+				if k, _ := recordKey(&e); k != key {
+					kept = append(kept, e)
+				}
+			}
+		}
+		names[name] = kept
+	}
+
+	var records []DnsRecord
+	for _, rs := range names {
+		records = append(records, rs...)
+	}
+	return records, NoError
+}
+
+// diffRecords returns the records deleted from and added to old in new, telling apart records differing in the ttl only
+func diffRecords(old []DnsRecord, new []DnsRecord) ([]DnsRecord, []DnsRecord, error) {
+	keys := func(records []DnsRecord) (map[string]DnsRecord, error) {
+		res := map[string]DnsRecord{}
+		for _, r := range records {
+			key, err := recordKey(&r)
+			if err != nil {
+				return nil, err
+			}
+			res[fmt.Sprintf("%s %d", key, r.ttl)] = r
+		}
+		return res, nil
+	}
+	oldKeys, err := keys(old)
+	if err != nil {
+		return nil, nil, err
+	}
+	newKeys, err := keys(new)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var deleted, added []DnsRecord
+	for key, r := range oldKeys {
+		if _, ok := newKeys[key]; !ok {
+			deleted = append(deleted, r)
+		}
+	}
+	for key, r := range newKeys {
+		if _, ok := oldKeys[key]; !ok {
+			added = append(added, r)
+		}
+	}
+	return deleted, added, nil
+}
+
+// sameRecords reports whether both lists hold the same records, ignoring their ttl and order
+func sameRecords(a []DnsRecord, b []DnsRecord) bool {
+	keys := map[string]bool{}
+	for _, r := range a {
+		key, err := recordKey(&r)
+		if err != nil {
+			return false
+		}
+		keys[key] = true
+	}
+	matched := map[string]bool{}
+	for _, r := range b {
+		key, err := recordKey(&r)
+		if err != nil || !keys[key] {
+			return false
+		}
+		matched[key] = true
+	}
+	return len(matched) == len(keys)
+}
+
+// filterType returns the records of the type
+func filterType(records []DnsRecord, qtype QueryType) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range records {
+		if r.qType == qtype {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// signerType reports whether records of the type are maintained by the online signer
+func signerType(qtype QueryType) bool {
+	switch qtype {
+	case DNSKEY, RRSIG, NSEC, NSEC3, NSEC3PARAM:
+		return true
+	}
+	return false
+}
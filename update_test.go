@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const updateTestZone = `$ORIGIN example.com.
+$TTL 3600
+@	IN SOA ns1 admin 1 3600 600 86400 300
+	IN NS ns1
+ns1	IN A 192.0.2.53
+`
+
+// updateMessage creates an UPDATE message, passed through the wire format
+func updateMessage(t *testing.T, zone string, prereqs []DnsRecord, updates []DnsRecord) *DnsPacket {
+	packet := NewDnsPacket()
+	packet.header = DnsHeader{id: 100, opcode: OPCODE_UPDATE}
+	packet.questions = []DnsQuestion{{name: zone, qtype: SOA}}
+	packet.answers = prereqs
+	packet.authorities = updates
+	buf := NewBytePacketBuffer()
+	require.NoError(t, packet.write(buf))
+
+	buf.seek(0)
+	request := NewDnsPacket()
+	require.NoError(t, request.fromBuffer(buf))
+	return request
+}
+
+// zoneState returns the records of the zone in presentation format
+func zoneState(zone *Zone) []string {
+	var res []string
+	for _, r := range zone.allRecords() {
+		res = append(res, r.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestDynamicUpdate(t *testing.T) {
+	dir := t.TempDir()
+	zoneFile := filepath.Join(dir, "example.com.zone")
+	require.NoError(t, os.WriteFile(zoneFile, []byte(updateTestZone), 0644))
+	zc := ZoneConfig{Name: "example.com", File: zoneFile, AllowUpdate: []string{"127.0.0.0/8"}}
+	zone, err := loadZone(zc)
+	require.NoError(t, err)
+
+	saved := zones
+	zones = NewZones()
+	zones.add(zone)
+	t.Cleanup(func() { zones = saved })
+
+	www := func(addr string) DnsRecord {
+		return DnsRecord{domain: "www.example.com", qType: A, ttl: 300, addr: addr}
+	}
+	testcases := []struct {
+		name    string
+		zone    string
+		client  string
+		prereqs []DnsRecord
+		updates []DnsRecord
+		resCode ResultCode
+		serial  uint32
+		addrs   []string // A records of www.example.com afterwards
+	}{
+		{
+			name:    "add when the name is not in use",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: ANY, class: CLASS_NONE, empty: true}},
+			updates: []DnsRecord{www("192.0.2.1")},
+			resCode: NoError, serial: 2, addrs: []string{"192.0.2.1"},
+		},
+		{
+			name:    "name in use",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: ANY, class: CLASS_NONE, empty: true}},
+			updates: []DnsRecord{www("192.0.2.9")},
+			resCode: YXDomain, serial: 2, addrs: []string{"192.0.2.1"},
+		},
+		{
+			name:    "replace the RRset",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: A, class: CLASS_ANY, empty: true}},
+			updates: []DnsRecord{{domain: "www.example.com", qType: A, class: CLASS_ANY, empty: true}, www("192.0.2.2"), www("192.0.2.3")},
+			resCode: NoError, serial: 3, addrs: []string{"192.0.2.2", "192.0.2.3"},
+		},
+		{
+			name:    "RRset differs",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: A, addr: "192.0.2.2"}},
+			updates: []DnsRecord{www("192.0.2.9")},
+			resCode: NXRRSet, serial: 3, addrs: []string{"192.0.2.2", "192.0.2.3"},
+		},
+		{
+			name:    "delete a record",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: A, addr: "192.0.2.2"}, {domain: "www.example.com", qType: A, addr: "192.0.2.3"}},
+			updates: []DnsRecord{{domain: "www.example.com", qType: A, class: CLASS_NONE, addr: "192.0.2.2"}},
+			resCode: NoError, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "CNAME next to other data is ignored",
+			updates: []DnsRecord{{domain: "www.example.com", qType: CNAME, ttl: 300, host: "ns1.example.com"}},
+			resCode: NoError, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "the last NS record is kept",
+			updates: []DnsRecord{{domain: "example.com", qType: NS, class: CLASS_NONE, host: "ns1.example.com"}},
+			resCode: NoError, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "RRset does not exist",
+			prereqs: []DnsRecord{{domain: "www.example.com", qType: MX, class: CLASS_ANY, empty: true}},
+			updates: []DnsRecord{www("192.0.2.9")},
+			resCode: NXRRSet, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "outside of the zone",
+			updates: []DnsRecord{{domain: "www.example.org", qType: A, ttl: 300, addr: "192.0.2.9"}},
+			resCode: NotZone, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "unknown zone",
+			zone:    "example.org",
+			updates: []DnsRecord{{domain: "www.example.org", qType: A, ttl: 300, addr: "192.0.2.9"}},
+			resCode: NotAuth, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+		{
+			name:    "client not allowed",
+			client:  "192.0.2.100",
+			updates: []DnsRecord{www("192.0.2.9")},
+			resCode: Refused, serial: 4, addrs: []string{"192.0.2.3"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.zone == "" {
+				tc.zone = "example.com"
+			}
+			if tc.client == "" {
+				tc.client = "127.0.0.1"
+			}
+			response, err := buildResponse(updateMessage(t, tc.zone, tc.prereqs, tc.updates), net.ParseIP(tc.client), false)
+			require.NoError(t, err)
+			assert.Equal(t, OPCODE_UPDATE, response.header.opcode)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+
+			zone := zones.get("example.com")
+			assert.Equal(t, tc.serial, zone.soa().serial)
+			var addrs []string
+			for _, r := range zone.records("www.example.com", A) {
+				addrs = append(addrs, r.addr)
+			}
+			sort.Strings(addrs)
+			assert.Equal(t, tc.addrs, addrs)
+		})
+	}
+
+	t.Run("journal replay", func(t *testing.T) {
+		reloaded, err := loadZone(zc)
+		require.NoError(t, err)
+		assert.Equal(t, zoneState(zones.get("example.com")), zoneState(reloaded))
+	})
+
+	t.Run("stale journal", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(zoneFile, []byte(updateTestZone+"mail IN A 192.0.2.25\n"), 0644))
+		_, err := loadZone(zc)
+		assert.NoError(t, err)
+		changed := []byte(updateTestZone[:len("$ORIGIN example.com.\n$TTL 3600\n")] + "@	IN SOA ns1 admin 10 3600 600 86400 300\n	IN NS ns1\n")
+		require.NoError(t, os.WriteFile(zoneFile, changed, 0644))
+		_, err = loadZone(zc)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,716 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Number of NSEC3 iterations above which a denial is treated as insecure (RFC 9276)
+const MAX_NSEC3_ITERATIONS = 150
+
+// Bounds on how long validated DNSKEY sets are cached
+const (
+	MIN_KEY_CACHE_TIME = time.Minute
+	MAX_KEY_CACHE_TIME = time.Hour
+)
+
+type ValidationResult int
+
+const (
+	Insecure ValidationResult = iota
+	Secure
+	Bogus
+)
+
+func (r ValidationResult) String() string {
+	switch r {
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+	return "insecure"
+}
+
+// Validator validates DNSSEC signed responses along the chain of trust from its trust anchors
+type Validator struct {
+	anchors []DnsRecord
+	query   func(domain string, qtype QueryType) (*DnsPacket, error)
+	now     func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]zoneKeys
+	ds   map[string]dsRecords
+}
+
+// zoneKeys is the outcome of validating the DNSKEY set of a zone
+type zoneKeys struct {
+	keys    []DnsRecord
+	result  ValidationResult
+	reason  string
+	expires time.Time
+}
+
+// dsRecords is the outcome of validating the DS set of a name
+type dsRecords struct {
+	records []DnsRecord
+	result  ValidationResult
+	reason  string
+	expires time.Time
+}
+
+// NewValidator creates a new Validator fetching DNSKEY and DS records with the query function
+func NewValidator(anchors []DnsRecord, query func(domain string, qtype QueryType) (*DnsPacket, error)) *Validator {
+	return &Validator{anchors: anchors, query: query, now: time.Now, keys: map[string]zoneKeys{}, ds: map[string]dsRecords{}}
+}
+
+// validation holds the state of a single validation, which guards against loops in the chain
+type validation struct {
+	*Validator
+	visiting map[string]bool
+}
+
+// validate validates a response to the question, returning the reason of bogus results
+func (v *Validator) validate(question DnsQuestion, response *DnsPacket) (ValidationResult, string) {
+	c := &validation{Validator: v, visiting: map[string]bool{}}
+	return c.validateResponse(question, response)
+}
+
+func (c *validation) validateResponse(question DnsQuestion, response *DnsPacket) (ValidationResult, string) {
+	if response.header.resCode != NoError && response.header.resCode != NxDomain {
+		return Insecure, ""
+	}
+
+	result := Secure
+	rrsets, sigs := splitRRsets(response.answers)
+	for _, rrset := range rrsets {
+		res, reason, sig := c.verifyRRset(rrset, sigs)
+		if res == Bogus {
+			return Bogus, reason
+		}
+		if res == Insecure {
+			result = Insecure
+			continue
+		}
+
+		// an answer synthesized from a wildcard needs proof that the name itself does not exist
+		if owner := rrset[0].domain; int(sig.labels) < countLabels(owner) && !strings.HasPrefix(owner, "*.") {
+			res, reason := c.validateDenial(response, owner, sig.labels)
+			if res != Secure {
+				return res, reason
+			}
+		}
+	}
+
+	// follow the CNAME chain to the name the answer ends at
+	name := question.name
+	for i := 0; i < len(response.answers); i++ {
+		for _, r := range response.answers {
+			if r.qType == CNAME && question.qtype != CNAME && strings.EqualFold(r.domain, name) {
+				name = r.host
+				break
+			}
+		}
+	}
+	for _, rrset := range rrsets {
+		if strings.EqualFold(rrset[0].domain, name) && rrset[0].qType == question.qtype {
+			return result, ""
+		}
+	}
+
+	// no data for the question: the denial of existence has to be validated
+	nsecs, res, reason := c.denialRecords(response)
+	if res == Bogus {
+		return Bogus, reason
+	}
+	if res == Insecure || len(nsecs) == 0 {
+		if c.isInsecure(name) {
+			return Insecure, ""
+		}
+		return Bogus, fmt.Sprintf("missing denial of existence for %s %s", name, question.qtype)
+	}
+
+	var proof denial
+	if response.header.resCode == NxDomain {
+		proof = proveNXDomain(name, nsecs)
+	} else {
+		proof = proveNoData(name, question.qtype, nsecs)
+	}
+	if !proof.proven {
+		return Bogus, fmt.Sprintf("invalid denial of existence for %s %s", name, question.qtype)
+	}
+	if proof.insecure {
+		return Insecure, ""
+	}
+	return result, ""
+}
+
+// validateDenial validates that the owner of a wildcard expansion does not exist itself
+func (c *validation) validateDenial(response *DnsPacket, owner string, labels uint8) (ValidationResult, string) {
+	nsecs, res, reason := c.denialRecords(response)
+	if res != Secure {
+		if reason == "" {
+			reason = "missing proof for wildcard answer " + owner
+		}
+		return Bogus, reason
+	}
+
+	// the name one label below the wildcard's closest encloser must not exist
+	ownerLabels := strings.Split(owner, ".")
+	nextCloser := strings.Join(ownerLabels[len(ownerLabels)-int(labels)-1:], ".")
+	for i := range nsecs {
+		if nsecs[i].qType == NSEC && nsecCovers(&nsecs[i], owner) {
+			return Secure, ""
+		}
+		if nsecs[i].qType == NSEC3 && nsec3Covers(&nsecs[i], nextCloser) {
+			return Secure, ""
+		}
+	}
+	return Bogus, "missing proof for wildcard answer " + owner
+}
+
+// denialRecords returns the validated NSEC and NSEC3 records of the authority section
+func (c *validation) denialRecords(response *DnsPacket) ([]DnsRecord, ValidationResult, string) {
+	var nsecs []DnsRecord
+	result := Secure
+	rrsets, sigs := splitRRsets(response.authorities)
+	for _, rrset := range rrsets {
+		if rrset[0].qType != NSEC && rrset[0].qType != NSEC3 && rrset[0].qType != SOA {
+			continue
+		}
+		if !hasSignature(rrset, sigs) {
+			// unsigned records prove nothing; the caller decides whether the zone is insecure
+			result = Insecure
+			continue
+		}
+
+		res, reason, _ := c.verifyRRset(rrset, sigs)
+		if res == Bogus {
+			return nil, Bogus, reason
+		}
+		if res == Insecure {
+			result = Insecure
+			continue
+		}
+		if rrset[0].qType != SOA {
+			nsecs = append(nsecs, rrset...)
+		}
+	}
+	return nsecs, result, ""
+}
+
+// verifyRRset verifies the RRset with the RRSIGs covering it, returning the RRSIG that verified
+func (c *validation) verifyRRset(rrset []DnsRecord, sigs []DnsRecord) (ValidationResult, string, *DnsRecord) {
+	owner := rrset[0].domain
+	qtype := rrset[0].qType
+
+	reason := fmt.Sprintf("missing signature for %s %s", owner, qtype)
+	signed := false
+	for i := range sigs {
+		sig := &sigs[i]
+		if sig.typeCovered != qtype || !strings.EqualFold(sig.domain, owner) {
+			continue
+		}
+		signed = true
+		if !isSubdomain(owner, sig.signerName) {
+			reason = fmt.Sprintf("signer %s is not an ancestor of %s", sig.signerName, owner)
+			continue
+		}
+
+		keys := c.zoneKeys(sig.signerName)
+		if keys.result == Insecure {
+			return Insecure, "", nil
+		}
+		if keys.result == Bogus {
+			reason = keys.reason
+			continue
+		}
+		if err := c.checkSignature(keys.keys, sig, rrset); err != nil {
+			reason = fmt.Sprintf("%s %s: %v", owner, qtype, err)
+			continue
+		}
+		return Secure, "", sig
+	}
+
+	if !signed && c.isInsecure(owner) {
+		return Insecure, "", nil
+	}
+	return Bogus, reason, nil
+}
+
+// checkSignature checks an RRSIG over the RRset against the zone's DNSKEY records
+func (c *validation) checkSignature(keys []DnsRecord, sig *DnsRecord, rrset []DnsRecord) error {
+	now := uint32(c.now().Unix())
+	if int32(now-sig.inception) < 0 {
+		return fmt.Errorf("signature not yet valid")
+	}
+	if int32(sig.expiration-now) < 0 {
+		return fmt.Errorf("signature expired")
+	}
+	if int(sig.labels) > countLabels(rrset[0].domain) {
+		return fmt.Errorf("invalid signature label count")
+	}
+
+	err := fmt.Errorf("no DNSKEY with key tag %d", sig.keyTag)
+	for i := range keys {
+		key := &keys[i]
+		if key.algorithm != sig.algorithm || key.flags&DNSKEY_ZONE == 0 || calculateKeyTag(key) != sig.keyTag {
+			continue
+		}
+		if err = verifySignature(key, sig, rrset); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the validated DNSKEY records of a zone
+func (c *validation) zoneKeys(zone string) zoneKeys {
+	zone = strings.ToLower(zone)
+
+	c.mu.Lock()
+	cached, ok := c.keys[zone]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		return cached
+	}
+
+	if c.visiting[zone] {
+		return zoneKeys{result: Bogus, reason: "loop in chain of trust at " + fqdn(zone)}
+	}
+	c.visiting[zone] = true
+	defer delete(c.visiting, zone)
+
+	keys := c.fetchZoneKeys(zone)
+	if keys.expires.IsZero() {
+		keys.expires = c.now().Add(MIN_KEY_CACHE_TIME)
+	}
+	c.mu.Lock()
+	c.keys[zone] = keys
+	c.mu.Unlock()
+	return keys
+}
+
+func (c *validation) fetchZoneKeys(zone string) zoneKeys {
+	var dsSet []DnsRecord
+	for _, anchor := range c.anchors {
+		if strings.EqualFold(anchor.domain, zone) {
+			dsSet = append(dsSet, anchor)
+		}
+	}
+
+	if len(dsSet) == 0 {
+		if !c.underTrustAnchor(zone) {
+			return zoneKeys{result: Insecure}
+		}
+		ds, res, reason := c.dsRecords(zone)
+		if res != Secure {
+			return zoneKeys{result: res, reason: reason}
+		}
+		if len(ds) == 0 {
+			return zoneKeys{result: Bogus, reason: "no DS records for " + fqdn(zone)}
+		}
+		dsSet = ds
+	}
+
+	supported := false
+	for _, ds := range dsSet {
+		if supportedAlgorithm(ds.algorithm) {
+			supported = true
+		}
+	}
+	if !supported {
+		// zones signed only with unknown algorithms are treated as unsigned (RFC 4035 5.2)
+		return zoneKeys{result: Insecure}
+	}
+
+	response, err := c.query(zone, DNSKEY)
+	if err != nil {
+		return zoneKeys{result: Bogus, reason: fmt.Sprintf("error fetching DNSKEY for %s: %v", fqdn(zone), err)}
+	}
+	var dnskeys, sigs []DnsRecord
+	for _, r := range response.answers {
+		if !strings.EqualFold(r.domain, zone) {
+			continue
+		}
+		if r.qType == DNSKEY {
+			dnskeys = append(dnskeys, r)
+		} else if r.qType == RRSIG && r.typeCovered == DNSKEY {
+			sigs = append(sigs, r)
+		}
+	}
+	if len(dnskeys) == 0 {
+		return zoneKeys{result: Bogus, reason: "no DNSKEY records for " + fqdn(zone)}
+	}
+
+	// the DNSKEY set must be signed by a key the DS set (or trust anchor) refers to
+	var trusted []DnsRecord
+	for _, key := range dnskeys {
+		for _, ds := range dsSet {
+			if ds.qType == DS && matchesDS(&key, &ds) {
+				trusted = append(trusted, key)
+				break
+			}
+			if ds.qType == DNSKEY && ds.algorithm == key.algorithm && bytes.Equal(ds.publicKey, key.publicKey) {
+				trusted = append(trusted, key)
+				break
+			}
+		}
+	}
+	if len(trusted) == 0 {
+		return zoneKeys{result: Bogus, reason: "no DNSKEY matching the DS records of " + fqdn(zone)}
+	}
+
+	reason := "no valid signature over the DNSKEY set of " + fqdn(zone)
+	for i := range sigs {
+		if err := c.checkSignature(trusted, &sigs[i], dnskeys); err != nil {
+			reason = fmt.Sprintf("DNSKEY set of %s: %v", fqdn(zone), err)
+			continue
+		}
+
+		return zoneKeys{keys: dnskeys, result: Secure, expires: c.now().Add(keyCacheTime(sigs[i].originalTTL))}
+	}
+	return zoneKeys{result: Bogus, reason: reason}
+}
+
+// dsRecords returns the validated DS records of a name from its parent zone.
+// A secure result without records means the name is proven not to be a zone cut.
+func (c *validation) dsRecords(name string) ([]DnsRecord, ValidationResult, string) {
+	name = strings.ToLower(name)
+
+	c.mu.Lock()
+	cached, ok := c.ds[name]
+	c.mu.Unlock()
+	if ok && c.now().Before(cached.expires) {
+		return cached.records, cached.result, cached.reason
+	}
+
+	ds := c.fetchDSRecords(name)
+	if ds.expires.IsZero() {
+		ds.expires = c.now().Add(MIN_KEY_CACHE_TIME)
+	}
+	c.mu.Lock()
+	c.ds[name] = ds
+	c.mu.Unlock()
+	return ds.records, ds.result, ds.reason
+}
+
+func (c *validation) fetchDSRecords(name string) dsRecords {
+	response, err := c.query(name, DS)
+	if err != nil {
+		return dsRecords{result: Bogus, reason: fmt.Sprintf("error fetching DS for %s: %v", fqdn(name), err)}
+	}
+
+	rrsets, sigs := splitRRsets(response.answers)
+	for _, rrset := range rrsets {
+		if rrset[0].qType != DS || !strings.EqualFold(rrset[0].domain, name) {
+			continue
+		}
+		res, reason, sig := c.verifyRRset(rrset, sigs)
+		if res != Secure {
+			return dsRecords{result: res, reason: reason}
+		}
+		return dsRecords{records: rrset, result: Secure, expires: c.now().Add(keyCacheTime(sig.originalTTL))}
+	}
+
+	nsecs, res, reason := c.denialRecords(response)
+	if res == Bogus {
+		return dsRecords{result: Bogus, reason: reason}
+	}
+	if len(nsecs) == 0 {
+		return dsRecords{result: Bogus, reason: "missing proof of absent DS for " + fqdn(name)}
+	}
+
+	var proof denial
+	if response.header.resCode == NxDomain {
+		proof = proveNXDomain(name, nsecs)
+	} else {
+		proof = proveNoData(name, DS, nsecs)
+	}
+	if !proof.proven {
+		return dsRecords{result: Bogus, reason: "invalid proof of absent DS for " + fqdn(name)}
+	}
+	if proof.insecure || proof.delegation {
+		return dsRecords{result: Insecure}
+	}
+	return dsRecords{result: Secure}
+}
+
+// isInsecure reports whether the name is proven to be below an insecure delegation
+func (c *validation) isInsecure(name string) bool {
+	anchor, ok := c.closestTrustAnchor(name)
+	if !ok {
+		return true
+	}
+
+	labels := strings.Split(name, ".")
+	for i := countLabels(name) - countLabels(anchor) - 1; i >= 0; i-- {
+		child := strings.Join(labels[i:], ".")
+		_, res, _ := c.dsRecords(child)
+		if res == Insecure {
+			return true
+		}
+		if res == Bogus {
+			return false
+		}
+	}
+	return false
+}
+
+// keyCacheTime bounds the time validated DNSKEY and DS records are cached for
+func keyCacheTime(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < MIN_KEY_CACHE_TIME {
+		return MIN_KEY_CACHE_TIME
+	}
+	if d > MAX_KEY_CACHE_TIME {
+		return MAX_KEY_CACHE_TIME
+	}
+	return d
+}
+
+func (c *validation) underTrustAnchor(name string) bool {
+	_, ok := c.closestTrustAnchor(name)
+	return ok
+}
+
+// closestTrustAnchor returns the name of the trust anchor closest to the name
+func (c *validation) closestTrustAnchor(name string) (string, bool) {
+	closest := ""
+	found := false
+	for _, anchor := range c.anchors {
+		if isSubdomain(name, anchor.domain) && (!found || countLabels(anchor.domain) > countLabels(closest)) {
+			closest = anchor.domain
+			found = true
+		}
+	}
+	return closest, found
+}
+
+// splitRRsets groups records into RRsets by owner and type, returning the RRSIG records separately
+func splitRRsets(records []DnsRecord) ([][]DnsRecord, []DnsRecord) {
+	var rrsets [][]DnsRecord
+	var sigs []DnsRecord
+	for _, r := range records {
+		if r.qType == RRSIG {
+			sigs = append(sigs, r)
+			continue
+		}
+		if r.qType == OPT {
+			continue
+		}
+
+		found := false
+		for i, rrset := range rrsets {
+			if rrset[0].qType == r.qType && strings.EqualFold(rrset[0].domain, r.domain) {
+				rrsets[i] = append(rrsets[i], r)
+				found = true
+				break
+			}
+		}
+		if !found {
+			rrsets = append(rrsets, []DnsRecord{r})
+		}
+	}
+	return rrsets, sigs
+}
+
+func hasSignature(rrset []DnsRecord, sigs []DnsRecord) bool {
+	for _, sig := range sigs {
+		if sig.typeCovered == rrset[0].qType && strings.EqualFold(sig.domain, rrset[0].domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// denial is the outcome of checking a denial of existence
+type denial struct {
+	proven     bool
+	insecure   bool // covered by an NSEC3 opt-out span, or NSEC3 parameters too costly to check
+	delegation bool // the name is a delegation point without DS records
+}
+
+// proveNXDomain checks that the NSEC or NSEC3 records prove the name does not exist
+func proveNXDomain(name string, nsecs []DnsRecord) denial {
+	for i := range nsecs {
+		if nsecs[i].qType == NSEC3 && nsecs[i].iterations > MAX_NSEC3_ITERATIONS {
+			return denial{proven: true, insecure: true}
+		}
+	}
+
+	// NSEC: a record covering the name, and one covering the wildcard at the closest encloser
+	for i := range nsecs {
+		nsec := &nsecs[i]
+		if nsec.qType != NSEC || !nsecCovers(nsec, name) {
+			continue
+		}
+		encloser := commonAncestor(name, nsec.domain)
+		if next := commonAncestor(name, nsec.nextDomain); countLabels(next) > countLabels(encloser) {
+			encloser = next
+		}
+		wildcard := "*." + encloser
+		if encloser == "" {
+			wildcard = "*"
+		}
+		for j := range nsecs {
+			if nsecs[j].qType == NSEC && nsecCovers(&nsecs[j], wildcard) {
+				return denial{proven: true}
+			}
+		}
+	}
+
+	// NSEC3: closest encloser proof and a record covering the wildcard at the closest encloser
+	encloser, optOut, ok := closestEncloserProof(name, nsecs)
+	if !ok {
+		return denial{}
+	}
+	wildcard := "*." + encloser
+	for i := range nsecs {
+		if nsecs[i].qType == NSEC3 && nsec3Covers(&nsecs[i], wildcard) {
+			return denial{proven: true, insecure: optOut}
+		}
+	}
+	return denial{}
+}
+
+// proveNoData checks that the NSEC or NSEC3 records prove the name has no records of the type
+func proveNoData(name string, qtype QueryType, nsecs []DnsRecord) denial {
+	for i := range nsecs {
+		if nsecs[i].qType == NSEC3 && nsecs[i].iterations > MAX_NSEC3_ITERATIONS {
+			return denial{proven: true, insecure: true}
+		}
+	}
+
+	for i := range nsecs {
+		nsec := &nsecs[i]
+		matches := (nsec.qType == NSEC && strings.EqualFold(nsec.domain, name)) || (nsec.qType == NSEC3 && nsec3Matches(nsec, name))
+		if matches {
+			types := nsec.typeBitMap
+			if hasType(types, qtype) || hasType(types, CNAME) {
+				return denial{}
+			}
+			// the parent side of a delegation can only deny DS, and only the parent can deny DS
+			isParentSide := hasType(types, NS) && !hasType(types, SOA)
+			if qtype == DS && hasType(types, SOA) && name != "" {
+				return denial{}
+			}
+			if qtype != DS && isParentSide {
+				return denial{}
+			}
+			return denial{proven: true, delegation: qtype == DS && isParentSide}
+		}
+
+		// an empty non-terminal has no NSEC record of its own, but names below it exist
+		if nsec.qType == NSEC && nsecCovers(nsec, name) && isSubdomain(nsec.nextDomain, name) {
+			return denial{proven: true}
+		}
+	}
+
+	// a DS query for a name in an NSEC3 opt-out span
+	encloser, optOut, ok := closestEncloserProof(name, nsecs)
+	if ok && qtype == DS && optOut {
+		return denial{proven: true, insecure: true}
+	}
+
+	// a wildcard matching the name without records of the type
+	if ok {
+		wildcard := "*." + encloser
+		for i := range nsecs {
+			if nsecs[i].qType == NSEC3 && nsec3Matches(&nsecs[i], wildcard) && !hasType(nsecs[i].typeBitMap, qtype) {
+				return denial{proven: true}
+			}
+		}
+	}
+	for i := range nsecs {
+		nsec := &nsecs[i]
+		if nsec.qType != NSEC || !nsecCovers(nsec, name) {
+			continue
+		}
+		encloser := commonAncestor(name, nsec.domain)
+		for j := range nsecs {
+			w := &nsecs[j]
+			if w.qType == NSEC && strings.EqualFold(w.domain, "*."+encloser) && !hasType(w.typeBitMap, qtype) {
+				return denial{proven: true}
+			}
+		}
+	}
+	return denial{}
+}
+
+// closestEncloserProof finds the closest encloser of a name from NSEC3 records (RFC 5155 8.3),
+// also reporting whether the record covering the next closer name has the opt-out flag
+func closestEncloserProof(name string, nsecs []DnsRecord) (string, bool, bool) {
+	nextCloser := name
+	for candidate := parentName(name); ; candidate = parentName(candidate) {
+		for i := range nsecs {
+			if nsecs[i].qType != NSEC3 || !nsec3Matches(&nsecs[i], candidate) {
+				continue
+			}
+			for j := range nsecs {
+				if nsecs[j].qType == NSEC3 && nsec3Covers(&nsecs[j], nextCloser) {
+					return candidate, nsecs[j].flags&NSEC3_OPT_OUT != 0, true
+				}
+			}
+			return "", false, false
+		}
+		if candidate == "" {
+			return "", false, false
+		}
+		nextCloser = candidate
+	}
+}
+
+// nsecCovers reports whether the name falls strictly between the owner and next name of the NSEC record
+func nsecCovers(nsec *DnsRecord, name string) bool {
+	afterOwner := compareNames(nsec.domain, name) < 0
+	beforeNext := compareNames(name, nsec.nextDomain) < 0
+	if compareNames(nsec.domain, nsec.nextDomain) < 0 {
+		return afterOwner && beforeNext
+	}
+	// the last NSEC record of the zone points back to the apex
+	return afterOwner && isSubdomain(name, nsec.nextDomain)
+}
+
+// nsec3Matches reports whether the hashed owner name of the NSEC3 record is the hash of the name
+func nsec3Matches(nsec3 *DnsRecord, name string) bool {
+	label, zone, _ := strings.Cut(nsec3.domain, ".")
+	if !isSubdomain(name, zone) {
+		return false
+	}
+	return strings.EqualFold(label, nsec3Label(name, nsec3.salt, nsec3.iterations))
+}
+
+// nsec3Covers reports whether the hash of the name falls strictly between the owner and next hash of the NSEC3 record
+func nsec3Covers(nsec3 *DnsRecord, name string) bool {
+	label, zone, _ := strings.Cut(nsec3.domain, ".")
+	if !isSubdomain(name, zone) {
+		return false
+	}
+	owner, err := base32Hex.DecodeString(strings.ToUpper(label))
+	if err != nil {
+		return false
+	}
+	hash := nsec3Hash(name, nsec3.salt, nsec3.iterations)
+
+	afterOwner := bytes.Compare(owner, hash) < 0
+	beforeNext := bytes.Compare(hash, nsec3.nextHashed) < 0
+	if bytes.Compare(owner, nsec3.nextHashed) < 0 {
+		return afterOwner && beforeNext
+	}
+	return afterOwner || beforeNext
+}
+
+// commonAncestor returns the longest common ancestor of two names
+func commonAncestor(a string, b string) string {
+	la := reverseLabels(a)
+	lb := reverseLabels(b)
+	var common []string
+	for i := 0; i < len(la) && i < len(lb) && la[i] == lb[i]; i++ {
+		common = append([]string{la[i]}, common...)
+	}
+	return strings.Join(common, ".")
+}
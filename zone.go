@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Zone is a zone served authoritatively from local data
+type Zone struct {
+	origin string
+	names  map[string][]DnsRecord // records by lower case owner name
+	nodes  map[string]bool        // owner names and their ancestors up to the origin
+
+	signer *ZoneSigner // nil for zones served unsigned
+	chain  []DnsRecord // NSEC records in canonical order, or NSEC3 records in hash order
+
+	zoneSettings
+}
+
+// zoneSettings controls the transfers, updates and notifications of a zone
+type zoneSettings struct {
+	allowTransfer []*net.IPNet // clients allowed to transfer the zone
+	transferKeys  []string     // TSIG keys allowed to transfer the zone
+	allowUpdate   []*net.IPNet // clients allowed to send dynamic updates
+	updateKeys    []string     // TSIG keys allowed to send dynamic updates
+	journal       string       // file recording the dynamic updates, empty for none
+	notify        []string     // addresses of the secondaries notified of changes
+	key           *TsigKey     // key signing NOTIFY messages and requests to the primary
+}
+
+// NewZone creates a new Zone from its records, which must include the SOA record
+func NewZone(origin string, records []DnsRecord) (*Zone, error) {
+	z := &Zone{origin: strings.ToLower(origin), names: map[string][]DnsRecord{}, nodes: map[string]bool{}}
+	for _, r := range records {
+		if !isSubdomain(r.domain, z.origin) {
+			return nil, fmt.Errorf("record %s is outside of zone %s", fqdn(r.domain), fqdn(z.origin))
+		}
+		z.add(r)
+	}
+
+	if z.soa() == nil {
+		return nil, errors.New("zone " + fqdn(z.origin) + " has no SOA record")
+	}
+	return z, nil
+}
+
+// withRecords returns a new version of the zone holding the records, with the settings of the zone
+func (z *Zone) withRecords(records []DnsRecord) (*Zone, error) {
+	zone, err := NewZone(z.origin, records)
+	if err != nil {
+		return nil, err
+	}
+	zone.zoneSettings = z.zoneSettings
+	if z.signer != nil {
+		zone.signer = z.signer
+		zone.chain = zone.buildChain()
+	}
+	return zone, nil
+}
+
+func (z *Zone) add(r DnsRecord) {
+	name := strings.ToLower(r.domain)
+	z.names[name] = append(z.names[name], r)
+	for n := name; !z.nodes[n]; n = parentName(n) {
+		z.nodes[n] = true
+		if n == z.origin {
+			break
+		}
+	}
+}
+
+// soa returns the SOA record at the zone apex
+func (z *Zone) soa() *DnsRecord {
+	for i, r := range z.names[z.origin] {
+		if r.qType == SOA {
+			return &z.names[z.origin][i]
+		}
+	}
+	return nil
+}
+
+// negativeSOA returns the SOA record sent with negative answers, its ttl limited by the minimum field (RFC 2308)
+func (z *Zone) negativeSOA() DnsRecord {
+	soa := *z.soa()
+	soa.ttl = min(soa.ttl, soa.minimum)
+	return soa
+}
+
+// records returns the records of the name with the type
+func (z *Zone) records(name string, qtype QueryType) []DnsRecord {
+	var res []DnsRecord
+	for _, r := range z.names[strings.ToLower(name)] {
+		if r.qType == qtype {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// allRecords returns all records of the zone
+func (z *Zone) allRecords() []DnsRecord {
+	var res []DnsRecord
+	for _, records := range z.names {
+		res = append(res, records...)
+	}
+	return res
+}
+
+// exists reports whether the name exists in the zone, either with records or as an empty non-terminal
+func (z *Zone) exists(name string) bool {
+	return z.nodes[strings.ToLower(name)]
+}
+
+// Maximum number of CNAME records followed within a zone
+const MAX_CNAME_CHAIN = 8
+
+// answer answers a question from the zone data following RFC 1034 4.3.2: names at or below a delegation
+// are referred to the child zone, CNAME records are followed within the zone and names without data of
+// their own are synthesized from the wildcard at their closest encloser (RFC 4592).
+// With dnssec set, the answer of a signed zone carries signatures and proofs of nonexistence.
+func (z *Zone) answer(name string, qtype QueryType, dnssec bool) *DnsPacket {
+	packet, err := z.resolve(name, qtype, dnssec)
+	if err != nil {
+		// the answer would be bogus without its signatures
+		log.Printf("error answering %s %s from zone %s: %v\n", name, qtype, fqdn(z.origin), err)
+		packet = NewDnsPacket()
+		packet.header.resCode = Servfail
+	}
+	return packet
+}
+
+// resolve answers the question from the zone data, failing when the answer of a signed zone cannot be signed
+func (z *Zone) resolve(name string, qtype QueryType, dnssec bool) (*DnsPacket, error) {
+	packet := NewDnsPacket()
+	packet.header.authoritativeAnswer = true
+	signed := dnssec && z.signer != nil
+
+	for i := 0; i <= MAX_CNAME_CHAIN; i++ {
+		if cut := z.delegation(name, qtype); cut != "" {
+			return packet, z.refer(packet, cut, signed)
+		}
+
+		// names without data of their own are synthesized from the wildcard at the closest encloser
+		owner := strings.ToLower(name)
+		wildcard := false
+		if !z.exists(owner) {
+			owner = wildcardName(z.encloser(owner))
+			wildcard = true
+			if !z.exists(owner) {
+				packet.header.resCode = NxDomain
+				return packet, z.deny(packet, signed, func() []DnsRecord { return z.denial(name, qtype, true) })
+			}
+		}
+
+		rrsets, _ := splitRRsets(z.names[owner])
+		var matched [][]DnsRecord
+		var cname []DnsRecord
+		for _, rrset := range rrsets {
+			if rrset[0].qType == qtype || qtype == ANY {
+				matched = append(matched, rrset)
+			} else if rrset[0].qType == CNAME {
+				cname = rrset
+			}
+		}
+		if len(matched) == 0 && cname != nil {
+			matched = [][]DnsRecord{cname}
+		}
+
+		if len(matched) == 0 {
+			if wildcard {
+				return packet, z.deny(packet, signed, func() []DnsRecord { return z.wildcardDenial(name, owner, true) })
+			}
+			return packet, z.deny(packet, signed, func() []DnsRecord { return z.denial(name, qtype, false) })
+		}
+
+		for _, rrset := range matched {
+			if err := z.addAnswer(packet, rrset, name, signed); err != nil {
+				return nil, err
+			}
+		}
+		if wildcard && signed {
+			// the expansion is only valid when the name itself does not exist
+			proof, err := z.signer.signRecords(z.wildcardDenial(name, owner, false))
+			if err != nil {
+				return nil, err
+			}
+			packet.authorities = append(packet.authorities, proof...)
+		}
+
+		if len(matched) > 1 || matched[0][0].qType != CNAME || qtype == CNAME {
+			return packet, nil
+		}
+		name = matched[0][0].host
+		if !isSubdomain(name, z.origin) {
+			return packet, nil
+		}
+	}
+	return packet, nil
+}
+
+// delegation returns the topmost delegation point at or above the name, or "" when the zone is authoritative for the name.
+// DS records are the exception, the parent zone is authoritative for them at the delegation point.
+func (z *Zone) delegation(name string, qtype QueryType) string {
+	name = strings.ToLower(name)
+	cut := ""
+	for n := name; n != z.origin && n != ""; n = parentName(n) {
+		if n == name && qtype == DS {
+			continue
+		}
+		if len(z.records(n, NS)) > 0 {
+			cut = n
+		}
+	}
+	return cut
+}
+
+// encloser returns the closest encloser of a name that does not exist in the zone, its closest existing ancestor
+func (z *Zone) encloser(name string) string {
+	n := parentName(name)
+	for n != z.origin && !z.exists(n) {
+		n = parentName(n)
+	}
+	return n
+}
+
+// wildcardName returns the wildcard name below the name
+func wildcardName(name string) string {
+	if name == "" {
+		return "*"
+	}
+	return "*." + name
+}
+
+// refer adds a referral to the child zone at the delegation point: its NS records, the addresses of its
+// name servers held by the zone as glue and, when signed, its DS records or the proof that there are none
+func (z *Zone) refer(packet *DnsPacket, cut string, signed bool) error {
+	if len(packet.answers) == 0 {
+		packet.header.authoritativeAnswer = false
+	}
+
+	ns := z.records(cut, NS)
+	packet.authorities = append(packet.authorities, ns...)
+	if signed {
+		ds := z.records(cut, DS)
+		if len(ds) == 0 {
+			ds = z.denial(cut, DS, false)
+		}
+		signedDS, err := z.signer.signRecords(ds)
+		if err != nil {
+			return err
+		}
+		packet.authorities = append(packet.authorities, signedDS...)
+	}
+
+	for _, r := range ns {
+		packet.resources = append(packet.resources, z.records(r.host, A)...)
+		packet.resources = append(packet.resources, z.records(r.host, AAAA)...)
+	}
+	return nil
+}
+
+// deny adds the SOA record of a negative answer and, when signed, the proof of nonexistence with its signatures
+func (z *Zone) deny(packet *DnsPacket, signed bool, proof func() []DnsRecord) error {
+	records := []DnsRecord{z.negativeSOA()}
+	if signed {
+		var err error
+		if records, err = z.signer.signRecords(append(records, proof()...)); err != nil {
+			return err
+		}
+	}
+	packet.authorities = append(packet.authorities, records...)
+	return nil
+}
+
+// addAnswer adds the RRset to the answer, with the owner of the question when it is synthesized from a wildcard
+func (z *Zone) addAnswer(packet *DnsPacket, rrset []DnsRecord, name string, signed bool) error {
+	var sigs []DnsRecord
+	if signed {
+		var err error
+		if sigs, err = z.signer.signatures(rrset); err != nil {
+			return err
+		}
+	}
+	for _, r := range append(append([]DnsRecord{}, rrset...), sigs...) {
+		if strings.HasPrefix(r.domain, "*.") {
+			r.domain = name
+		}
+		packet.answers = append(packet.answers, r)
+	}
+	return nil
+}
+
+// Zones holds the locally served zones
+type Zones struct {
+	mu    sync.RWMutex
+	zones map[string]*Zone
+}
+
+// NewZones creates a new empty Zones
+func NewZones() *Zones {
+	return &Zones{zones: map[string]*Zone{}}
+}
+
+// add adds the zone, replacing an earlier version of it
+func (z *Zones) add(zone *Zone) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.zones[zone.origin] = zone
+}
+
+// remove stops serving the zone with the origin
+func (z *Zones) remove(origin string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	delete(z.zones, strings.ToLower(origin))
+}
+
+// get returns the zone with the origin
+func (z *Zones) get(origin string) *Zone {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	return z.zones[strings.ToLower(origin)]
+}
+
+// find returns the closest zone enclosing the name, or nil if the name is not in a local zone
+func (z *Zones) find(name string) *Zone {
+	z.mu.RLock()
+	defer z.mu.RUnlock()
+	if len(z.zones) == 0 {
+		return nil
+	}
+
+	for n := strings.ToLower(name); ; n = parentName(n) {
+		if zone, ok := z.zones[n]; ok {
+			return zone
+		}
+		if n == "" {
+			return nil
+		}
+	}
+}
+
+// recordKey identifies a record by its owner, type and data, ignoring the ttl and the case of names
+func recordKey(r *DnsRecord) (string, error) {
+	data, err := canonicalData(r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s %d %x", strings.ToLower(r.domain), r.qType, data), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneAnswer(t *testing.T) {
+	zoneFile := `$ORIGIN example.com.
+$TTL 300
+@	IN	SOA	ns1 hostmaster 1 3600 600 86400 60
+	IN	NS	ns1
+ns1	IN	A	192.0.2.53
+www	IN	A	192.0.2.1
+a.b	IN	A	192.0.2.2
+*.wild	IN	A	192.0.2.3
+	IN	MX	10 mail
+alias	IN	CNAME	chain
+chain	IN	CNAME	www
+out	IN	CNAME	www.example.net.
+dangling	IN	CNAME	missing
+sub	IN	NS	ns.sub
+	IN	NS	ns.example.net.
+ns.sub	IN	A	192.0.2.54
+`
+	records, err := parseZoneFile(strings.NewReader(zoneFile), "")
+	require.NoError(t, err)
+	zone, err := NewZone("example.com", records)
+	require.NoError(t, err)
+
+	testcases := []struct {
+		name          string
+		qname         string
+		qtype         QueryType
+		resCode       ResultCode
+		authoritative bool
+		answers       []string
+		authorities   []string
+		resources     []string
+	}{
+		{
+			name: "exact match", qname: "www.example.com", qtype: A, authoritative: true,
+			answers: []string{"www.example.com.\t300\tIN\tA\t192.0.2.1"},
+		},
+		{
+			name: "empty non-terminal", qname: "b.example.com", qtype: A, authoritative: true,
+			authorities: []string{"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"},
+		},
+		{
+			name: "nonexistent name", qname: "missing.example.com", qtype: A, resCode: NxDomain, authoritative: true,
+			authorities: []string{"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"},
+		},
+		{
+			name: "wildcard", qname: "a.host.wild.example.com", qtype: A, authoritative: true,
+			answers: []string{"a.host.wild.example.com.\t300\tIN\tA\t192.0.2.3"},
+		},
+		{
+			name: "wildcard any", qname: "host.wild.example.com", qtype: ANY, authoritative: true,
+			answers: []string{"host.wild.example.com.\t300\tIN\tA\t192.0.2.3", "host.wild.example.com.\t300\tIN\tMX\t10 mail.example.com."},
+		},
+		{
+			name: "wildcard without the type", qname: "host.wild.example.com", qtype: AAAA, authoritative: true,
+			authorities: []string{"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"},
+		},
+		{
+			name: "wildcard owner", qname: "*.wild.example.com", qtype: A, authoritative: true,
+			answers: []string{"*.wild.example.com.\t300\tIN\tA\t192.0.2.3"},
+		},
+		{
+			name: "cname chain", qname: "alias.example.com", qtype: A, authoritative: true,
+			answers: []string{
+				"alias.example.com.\t300\tIN\tCNAME\tchain.example.com.",
+				"chain.example.com.\t300\tIN\tCNAME\twww.example.com.",
+				"www.example.com.\t300\tIN\tA\t192.0.2.1",
+			},
+		},
+		{
+			name: "cname query", qname: "alias.example.com", qtype: CNAME, authoritative: true,
+			answers: []string{"alias.example.com.\t300\tIN\tCNAME\tchain.example.com."},
+		},
+		{
+			name: "cname out of zone", qname: "out.example.com", qtype: A, authoritative: true,
+			answers: []string{"out.example.com.\t300\tIN\tCNAME\twww.example.net."},
+		},
+		{
+			name: "cname to nonexistent name", qname: "dangling.example.com", qtype: A, resCode: NxDomain, authoritative: true,
+			answers:     []string{"dangling.example.com.\t300\tIN\tCNAME\tmissing.example.com."},
+			authorities: []string{"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"},
+		},
+		{
+			name: "referral", qname: "host.sub.example.com", qtype: A,
+			authorities: []string{"sub.example.com.\t300\tIN\tNS\tns.sub.example.com.", "sub.example.com.\t300\tIN\tNS\tns.example.net."},
+			resources:   []string{"ns.sub.example.com.\t300\tIN\tA\t192.0.2.54"},
+		},
+		{
+			name: "referral at the delegation point", qname: "sub.example.com", qtype: NS,
+			authorities: []string{"sub.example.com.\t300\tIN\tNS\tns.sub.example.com.", "sub.example.com.\t300\tIN\tNS\tns.example.net."},
+			resources:   []string{"ns.sub.example.com.\t300\tIN\tA\t192.0.2.54"},
+		},
+		{
+			name: "ds at the delegation point", qname: "sub.example.com", qtype: DS, authoritative: true,
+			authorities: []string{"example.com.\t60\tIN\tSOA\tns1.example.com. hostmaster.example.com. 1 3600 600 86400 60"},
+		},
+	}
+
+	strs := func(records []DnsRecord) []string {
+		var res []string
+		for _, r := range records {
+			res = append(res, r.String())
+		}
+		return res
+	}
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := zone.answer(tc.qname, tc.qtype, false)
+			assert.Equal(t, tc.resCode, response.header.resCode)
+			assert.Equal(t, tc.authoritative, response.header.authoritativeAnswer)
+			assert.Equal(t, tc.answers, strs(response.answers))
+			assert.Equal(t, tc.authorities, strs(response.authorities))
+			assert.Equal(t, tc.resources, strs(response.resources))
+		})
+	}
+}
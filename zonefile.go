@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Default ttl of zone file records when the file has no $TTL directive
+const DEFAULT_ZONE_TTL = 3600
+
+// loadZoneFile reads the records of the zone file at path
+func loadZoneFile(path string, origin string) ([]DnsRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := parseZoneFile(f, origin)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return records, nil
+}
+
+// parseZoneFile reads records in RFC 1035 master file format.
+// Supported are comments, $ORIGIN and $TTL, parentheses spanning lines and blank owner names.
+func parseZoneFile(r io.Reader, origin string) ([]DnsRecord, error) {
+	var records []DnsRecord
+	ttl := uint32(DEFAULT_ZONE_TTL)
+	lastOwner := origin
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	var fields []string
+	depth := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+
+		// a line starting with a blank belongs to the owner of the previous record
+		if depth == 0 && strings.TrimSpace(line) != "" && (line[0] == ' ' || line[0] == '\t') {
+			fields = append(fields, fqdn(lastOwner))
+		}
+		depth += strings.Count(line, "(") - strings.Count(line, ")")
+		line = strings.NewReplacer("(", " ", ")", " ").Replace(line)
+		fields = append(fields, strings.Fields(line)...)
+		if depth > 0 || len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: missing origin", lineNo)
+			}
+			origin = absoluteName(fields[1], origin)
+		case "$TTL":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: missing ttl", lineNo)
+			}
+			n, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			ttl = uint32(n)
+		default:
+			if strings.HasPrefix(fields[0], "$") {
+				return nil, fmt.Errorf("line %d: unsupported directive %s", lineNo, fields[0])
+			}
+			record, err := parseRecordFields(fields, origin, ttl)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			records = append(records, *record)
+			lastOwner = record.domain
+		}
+		fields = nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses")
+	}
+	return records, nil
+}